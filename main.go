@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"pivot-internal/pivot"
 )
 
 func main() {
@@ -18,9 +26,21 @@ func main() {
 		fmt.Println("  ./pivot-internal server -key <secret> -c agent  (starts in agent mode)")
 		fmt.Println("  ./pivot-internal agent -key <secret> -l <listen_addr> -i <internal_addr>")
 		fmt.Println("  ./pivot-internal client -key <secret> -r <remote_addr> -l <local_addr>")
+		fmt.Println("  ./pivot-internal client -key <secret> -exec \"ssh host pivot-internal server -stdio\" -l <local_addr>")
+		fmt.Println("  ./pivot-internal keygen -t symmetric|ed25519 -o <file>")
+		fmt.Println("  ./pivot-internal bench [-transports tcp,quic] [-ciphers rc4] [-streams 8]")
+		fmt.Println("")
+		fmt.Println("  -keyfile <file> may be used instead of -key in every mode")
+		fmt.Println("  -config <file> reads flags from a file, one per line, and is reread on SIGHUP")
+		fmt.Println("  Tunnel addresses accept tcp://, tls://, ws://, wss:// and quic:// prefixes")
 		os.Exit(1)
 	}
 
+	// A previous process may have handed its listeners over on upgrade
+	if err := pivot.InheritListeners(); err != nil {
+		log.Fatal(err)
+	}
+
 	mode := os.Args[1]
 
 	switch mode {
@@ -30,6 +50,10 @@ func main() {
 		runAgent()
 	case "client":
 		runClient()
+	case "keygen":
+		runKeygen()
+	case "bench":
+		runBench()
 	default:
 		fmt.Printf("Unknown mode: %s\n", mode)
 		os.Exit(1)
@@ -37,161 +61,824 @@ func main() {
 }
 
 func runServer() {
-	serverCmd := flag.NewFlagSet("server", flag.ExitOnError)
+	opts, start, err := serverOptions(os.Args[2:], flag.ExitOnError)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, err := pivot.NewServer(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start.announce()
+
+	serve("Server", server, start.stdio, func() error {
+		opts, _, err := serverOptions(os.Args[2:], flag.ContinueOnError)
+		if err != nil {
+			return err
+		}
+		return server.Reload(opts)
+	})
+}
+
+// serverOptions builds the server options from the flags in args and the
+// -config file
+func serverOptions(args []string, handling flag.ErrorHandling) (pivot.ServerOptions, startup, error) {
+	var opts pivot.ServerOptions
+	var start startup
+	serverCmd := newFlagSet("server", handling)
+	retryDefaults := pivot.NewBackoff()
 	key := serverCmd.String("key", "", "Encryption key")
+	keyFile := serverCmd.String("keyfile", "", "Read encryption key from file")
 	listen := serverCmd.String("l", ":1080", "Listen address")
 	connect := serverCmd.String("c", "", "Agent server address to connect to")
+	identity := serverCmd.String("identity", "", "Identity private key for public-key authentication")
+	authorizedKeys := serverCmd.String("authorized-keys", "", "File of client public keys allowed to connect")
+	pin := serverCmd.String("pin", "", "Expected agent public key (fingerprint or .pub file) when using -c")
+	cipher := serverCmd.String("cipher", pivot.CipherRC4, "Tunnel cipher: rc4, or none over an encrypted transport")
+	proxy := serverCmd.String("proxy", "", "Upstream proxy for the agent connection (http://, socks5:// or socks5h://[user:pass@]host:port)")
+	stdio := serverCmd.Bool("stdio", false, "Serve a single tunnel over stdin/stdout, e.g. as an SSH remote command")
+	name := serverCmd.String("name", "", "Name announced to the agent or upstream server with -c, used in client routes")
+	hopListen := serverCmd.String("hop-listen", "", "Accept downstream servers on this address for multi-hop routes")
+	domainsFlag := serverCmd.String("domains", "", "Comma-separated internal domains reported to clients for their PAC files")
+	fallback := serverCmd.String("fallback", "", "Comma-separated agent addresses tried in order when the -c agent is unreachable")
+	retryInitial := serverCmd.Duration("retry-initial", retryDefaults.Initial, "Delay before the first reconnect to the agent, doubled after every failed round")
+	retryMax := serverCmd.Duration("retry-max", retryDefaults.Max, "Maximum delay between reconnects to the agent")
+	retryJitter := serverCmd.Float64("retry-jitter", retryDefaults.Jitter, "Random fraction (0-1) added to or taken off every reconnect delay")
+	retryAttempts := serverCmd.Int("retry-attempts", 0, "Give up after this many failed rounds over all agent addresses (0 retries forever)")
+	tlsOpts := addTLSFlags(serverCmd)
+	heartbeatOpts := addHeartbeatFlags(serverCmd)
+	timeoutOpts := addTimeoutFlags(serverCmd)
+	limitOpts := addLimitFlags(serverCmd, true)
+
+	if err := parseFlags(serverCmd, args); err != nil {
+		return opts, start, err
+	}
 
-	serverCmd.Parse(os.Args[2:])
+	tunnelKey, err := pivot.LoadKey(*key, *keyFile)
+	if err != nil {
+		return opts, start, err
+	}
 
-	if *key == "" {
-		log.Fatal("Key is required")
+	auth, err := loadAuthenticator(*identity, *authorizedKeys, *pin)
+	if err != nil {
+		return opts, start, err
 	}
 
-	var server *Server
+	if *stdio && *connect != "" {
+		return opts, start, errors.New("-stdio and -c are mutually exclusive")
+	}
+	if *fallback != "" && *connect == "" {
+		return opts, start, errors.New("-fallback requires -c")
+	}
+	if *name != "" && *connect == "" {
+		return opts, start, errors.New("-name requires -c")
+	}
+
+	transport, err := tlsOpts.transport()
+	if err != nil {
+		return opts, start, err
+	}
+	if transport.Proxy, err = pivot.ParseProxyURL(*proxy); err != nil {
+		return opts, start, err
+	}
+	if transport.Proxy != nil && *connect == "" {
+		return opts, start, errors.New("-proxy requires -c")
+	}
+	heartbeat, err := heartbeatOpts.config()
+	if err != nil {
+		return opts, start, err
+	}
+	timeouts, err := timeoutOpts.timeouts()
+	if err != nil {
+		return opts, start, err
+	}
+	limits, err := limitOpts.limits()
+	if err != nil {
+		return opts, start, err
+	}
+
+	opts = pivot.ServerOptions{
+		Key:       tunnelKey,
+		Addr:      *listen,
+		Fallbacks: pivot.SplitList(*fallback),
+		Stdio:     *stdio,
+		Name:      *name,
+		HopAddr:   *hopListen,
+		Domains:   pivot.SplitList(*domainsFlag),
+		Cipher:    *cipher,
+		Auth:      auth,
+		Transport: transport,
+		Backoff: &pivot.Backoff{
+			Initial:     *retryInitial,
+			Max:         *retryMax,
+			Jitter:      *retryJitter,
+			MaxAttempts: *retryAttempts,
+		},
+		Heartbeat: &heartbeat,
+		Timeouts:  &timeouts,
+		Limits:    limits,
+	}
 	if *connect != "" {
+		opts.Addr = *connect
+	} else if opts.Addr == "" {
+		opts.Addr = ":1080"
+	}
+
+	if *stdio {
+		start = startup{stdio: true, message: fmt.Sprintf("Starting server on stdio with key: %s", pivot.KeyFingerprint(tunnelKey))}
+	} else if *connect != "" {
 		// Agent mode - server connects to agent
-		fmt.Printf("Starting server connecting to agent at %s with key: %s\n", *connect, *key)
-		server = NewServer(*key, *connect)
+		start.message = fmt.Sprintf("Starting server connecting to agent at %s with key: %s", *connect, pivot.KeyFingerprint(tunnelKey))
 	} else {
 		// Traditional listen mode
-		if *listen == "" {
-			*listen = ":1080"
-		}
-		fmt.Printf("Starting server on %s with key: %s\n", *listen, *key)
-		server = NewServer(*key, *listen)
+		start.message = fmt.Sprintf("Starting server on %s with key: %s", opts.Addr, pivot.KeyFingerprint(tunnelKey))
 	}
+	return opts, start, nil
+}
 
-	// Setup graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func runAgent() {
+	opts, start, err := agentOptions(os.Args[2:], flag.ExitOnError)
+	if err != nil {
+		log.Fatal(err)
+	}
+	agent, err := pivot.NewAgent(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start.announce()
 
-	// Handle signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	serve("Agent", agent, false, func() error {
+		opts, _, err := agentOptions(os.Args[2:], flag.ContinueOnError)
+		if err != nil {
+			return err
+		}
+		return agent.Reload(opts)
+	})
+}
 
-	// Start server in goroutine
-	errChan := make(chan error, 1)
-	go func() {
-		errChan <- server.Start(ctx)
-	}()
+// agentOptions builds the agent options from the flags in args and the
+// -config file
+func agentOptions(args []string, handling flag.ErrorHandling) (pivot.AgentOptions, startup, error) {
+	var opts pivot.AgentOptions
+	var start startup
+	agentCmd := newFlagSet("agent", handling)
+	key := agentCmd.String("key", "", "Encryption key")
+	keyFile := agentCmd.String("keyfile", "", "Read encryption key from file")
+	listen := agentCmd.String("l", ":1080", "Listen address for clients")
+	internal := agentCmd.String("i", ":8000", "Internal listen address for victim server")
+	identity := agentCmd.String("identity", "", "Identity private key for public-key authentication")
+	authorizedKeys := agentCmd.String("authorized-keys", "", "File of client and victim public keys allowed to connect")
+	cipher := agentCmd.String("cipher", pivot.CipherRC4, "Tunnel cipher: rc4, or none over an encrypted transport")
+	tlsOpts := addTLSFlags(agentCmd)
+	heartbeatOpts := addHeartbeatFlags(agentCmd)
+	timeoutOpts := addTimeoutFlags(agentCmd)
+	limitOpts := addLimitFlags(agentCmd, false)
+
+	if err := parseFlags(agentCmd, args); err != nil {
+		return opts, start, err
+	}
 
-	// Wait for signal or error
-	select {
-	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down gracefully...", sig)
-		cancel()
+	tunnelKey, err := pivot.LoadKey(*key, *keyFile)
+	if err != nil {
+		return opts, start, err
+	}
 
-		// Give server time to cleanup
-		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer shutdownCancel()
+	auth, err := loadAuthenticator(*identity, *authorizedKeys, "")
+	if err != nil {
+		return opts, start, err
+	}
 
-		server.Shutdown(shutdownCtx)
-		log.Println("Server shutdown complete")
+	transport, err := tlsOpts.transport()
+	if err != nil {
+		return opts, start, err
+	}
+	heartbeat, err := heartbeatOpts.config()
+	if err != nil {
+		return opts, start, err
+	}
+	timeouts, err := timeoutOpts.timeouts()
+	if err != nil {
+		return opts, start, err
+	}
+	limits, err := limitOpts.limits()
+	if err != nil {
+		return opts, start, err
+	}
+
+	opts = pivot.AgentOptions{
+		Key:          tunnelKey,
+		ClientAddr:   *listen,
+		InternalAddr: *internal,
+		Cipher:       *cipher,
+		Auth:         auth,
+		Transport:    transport,
+		Heartbeat:    &heartbeat,
+		Timeouts:     &timeouts,
+		Limits:       limits,
+	}
+	start.message = fmt.Sprintf("Starting agent server: client listen=%s, internal listen=%s with key: %s", *listen, *internal, pivot.KeyFingerprint(tunnelKey))
+	return opts, start, nil
+}
 
-	case err := <-errChan:
+func runClient() {
+	opts, start, err := clientOptions(os.Args[2:], flag.ExitOnError)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := pivot.NewClient(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	start.announce()
+
+	serve("Client", client, start.stdio, func() error {
+		opts, _, err := clientOptions(os.Args[2:], flag.ContinueOnError)
 		if err != nil {
-			log.Fatal("Server error:", err)
+			return err
+		}
+		return client.Reload(opts)
+	})
+}
+
+// clientOptions builds the client options from the flags in args and the
+// -config file
+func clientOptions(args []string, handling flag.ErrorHandling) (pivot.ClientOptions, startup, error) {
+	var opts pivot.ClientOptions
+	var start startup
+	clientCmd := newFlagSet("client", handling)
+	key := clientCmd.String("key", "", "Encryption key")
+	keyFile := clientCmd.String("keyfile", "", "Read encryption key from file")
+	remote := clientCmd.String("r", "", "Remote server address, or a comma-separated list of them")
+	strategy := clientCmd.String("strategy", pivot.StrategyFailover, "How to pick among several remotes: failover, round-robin or least-latency")
+	healthInterval := clientCmd.Duration("health-interval", pivot.DefaultHealthInterval, "Time between health checks of several remotes (0 disables them)")
+	stdio := clientCmd.Bool("stdio", false, "Tunnel over stdin/stdout instead of connecting to -r")
+	routeFlag := clientCmd.String("route", "", "Named pivots to go through behind the remote, e.g. hop1/hop2")
+	command := clientCmd.String("exec", "", "Run a command and tunnel over its stdin/stdout, e.g. \"ssh host pivot-internal server -stdio\"")
+	rulesFile := clientCmd.String("rules", "", "Per-destination routing rules file (direct, reject, named remotes and routes)")
+	pacAddr := clientCmd.String("pac", "", "Serve a proxy auto-config file built from the rules on this HTTP address")
+	local := clientCmd.String("l", ":1081", "Local listen address")
+	identity := clientCmd.String("identity", "", "Identity private key for public-key authentication")
+	pin := clientCmd.String("pin", "", "Expected server public key (fingerprint or .pub file)")
+	cipher := clientCmd.String("cipher", pivot.CipherRC4, "Tunnel cipher: rc4, or none over an encrypted transport")
+	proxy := clientCmd.String("proxy", "", "Upstream proxy for the remote connection (http://, socks5:// or socks5h://[user:pass@]host:port)")
+	tlsOpts := addTLSFlags(clientCmd)
+	heartbeatOpts := addHeartbeatFlags(clientCmd)
+	timeoutOpts := addTimeoutFlags(clientCmd)
+
+	if err := parseFlags(clientCmd, args); err != nil {
+		return opts, start, err
+	}
+
+	tunnelKey, err := pivot.LoadKey(*key, *keyFile)
+	if err != nil {
+		return opts, start, err
+	}
+	remotes := pivot.SplitList(*remote)
+	links := 0
+	for _, set := range []bool{len(remotes) > 0, *stdio, *command != ""} {
+		if set {
+			links++
+		}
+	}
+	if links > 1 {
+		return opts, start, errors.New("-r, -stdio and -exec are mutually exclusive")
+	}
+	if links == 0 {
+		return opts, start, errors.New("Remote address is required")
+	}
+
+	auth, err := loadAuthenticator(*identity, "", *pin)
+	if err != nil {
+		return opts, start, err
+	}
+
+	route, err := pivot.ParseRoute(*routeFlag)
+	if err != nil {
+		return opts, start, err
+	}
+
+	var rules *pivot.RuleSet
+	if *rulesFile != "" {
+		if rules, err = pivot.LoadRules(*rulesFile); err != nil {
+			return opts, start, err
 		}
 	}
+
+	transport, err := tlsOpts.transport()
+	if err != nil {
+		return opts, start, err
+	}
+	if transport.Proxy, err = pivot.ParseProxyURL(*proxy); err != nil {
+		return opts, start, err
+	}
+	heartbeat, err := heartbeatOpts.config()
+	if err != nil {
+		return opts, start, err
+	}
+	timeouts, err := timeoutOpts.timeouts()
+	if err != nil {
+		return opts, start, err
+	}
+
+	opts = pivot.ClientOptions{
+		Key:            tunnelKey,
+		Remotes:        remotes,
+		Strategy:       *strategy,
+		HealthInterval: *healthInterval,
+		Route:          route,
+		Rules:          rules,
+		LocalAddr:      *local,
+		PACAddr:        *pacAddr,
+		Cipher:         *cipher,
+		Auth:           auth,
+		Transport:      transport,
+		Heartbeat:      &heartbeat,
+		Timeouts:       &timeouts,
+	}
+	if opts.HealthInterval == 0 {
+		// 0 disables health checks on the command line, unlike in the options
+		opts.HealthInterval = -1
+	}
+	switch {
+	case *stdio:
+		opts.Link, opts.LinkName = pivot.StdioLink(), "stdio"
+	case *command != "":
+		opts.Link, opts.LinkName = pivot.ExecLink(*command), *command
+	}
+
+	switch {
+	case *stdio:
+		start = startup{stdio: true, message: fmt.Sprintf("Starting client: local=%s -> remote=stdio with key: %s", *local, pivot.KeyFingerprint(tunnelKey))}
+	case *command != "":
+		start.message = fmt.Sprintf("Starting client: local=%s -> remote=exec:%s with key: %s", *local, *command, pivot.KeyFingerprint(tunnelKey))
+	default:
+		start.message = fmt.Sprintf("Starting client: local=%s -> remote=%s with key: %s", *local, *remote, pivot.KeyFingerprint(tunnelKey))
+	}
+	return opts, start, nil
 }
 
-func runAgent() {
-	agentCmd := flag.NewFlagSet("agent", flag.ExitOnError)
-	key := agentCmd.String("key", "", "Encryption key")
-	listen := agentCmd.String("l", ":1080", "Listen address for clients")
-	internal := agentCmd.String("i", ":8000", "Internal listen address for victim server")
+// startup is the startup message of a role
+type startup struct {
+	message string
+	stdio   bool // the tunnel runs over stdin/stdout
+}
+
+// announce prints the startup message
+func (s startup) announce() {
+	if s.stdio {
+		// stdout carries the tunnel, so nothing else may be printed there
+		fmt.Fprintln(os.Stderr, s.message)
+		return
+	}
+	fmt.Println(s.message)
+}
+
+// newFlagSet creates the flag set of a mode. One parsed on reload keeps
+// quiet about errors, which the reload logs instead.
+func newFlagSet(name string, handling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, handling)
+	if handling == flag.ContinueOnError {
+		fs.SetOutput(io.Discard)
+	}
+	return fs
+}
+
+// parseFlags parses args into fs along with the flags of the -config file
+// it names, which hold one flag per line as on the command line but without
+// the dash, e.g. "l :1080" or "stdio". Blank lines and lines starting with #
+// are skipped, and the command line overrides the file.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	config := fs.String("config", "", "File of flags, one per line like \"l :1080\", reread on SIGHUP where available")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *config == "" {
+		return nil
+	}
 
-	agentCmd.Parse(os.Args[2:])
+	path := *config
+	fileArgs, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := fs.Parse(fileArgs); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return fs.Parse(args)
+}
 
-	if *key == "" {
-		log.Fatal("Key is required")
+// readConfig reads a -config file into command-line arguments
+func readConfig(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
 	}
 
-	fmt.Printf("Starting agent server: client listen=%s, internal listen=%s with key: %s\n", *listen, *internal, *key)
+	var args []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		arg := line
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			arg = line[:i] + "=" + strings.TrimSpace(line[i+1:])
+		}
+		args = append(args, "-"+strings.TrimLeft(arg, "-"))
+	}
+	return args, nil
+}
 
-	agent := NewAgent(*key, *listen, *internal)
+// role is a server, agent or client run from the command line
+type role interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+	Drain(ctx context.Context) error
+}
 
-	// Setup graceful shutdown
+// serve runs r until it fails or a signal stops it. SIGINT and SIGTERM shut
+// it down, giving open connections 10 seconds to finish, even while it
+// drains. On platforms that have them, SIGUSR1 drains it, SIGUSR2 hands its
+// listeners to a new copy of this program before draining, which a role on
+// stdin/stdout can't do, and SIGHUP rereads the configuration and applies
+// it with reload.
+func serve(name string, r role, stdio bool, reload func() error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Handle signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	drainChan := make(chan os.Signal, 1)
+	for _, sig := range []os.Signal{drainSignal, upgradeSignal} {
+		if sig != nil {
+			signal.Notify(drainChan, sig)
+		}
+	}
+
+	reloadChan := make(chan os.Signal, 1)
+	if reloadSignal != nil {
+		signal.Notify(reloadChan, reloadSignal)
+	}
 
-	// Start agent in goroutine
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- agent.Start(ctx)
+		errChan <- r.Start(ctx)
 	}()
 
-	// Wait for signal or error
-	select {
-	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down gracefully...", sig)
-		cancel()
+	draining := false
+	for {
+		select {
+		case sig := <-sigChan:
+			log.Printf("Received signal %v, shutting down gracefully...", sig)
+
+			// Give open connections time to finish. Cancelling ctx instead
+			// would cut them off right away.
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer shutdownCancel()
+
+			r.Shutdown(shutdownCtx)
+			log.Printf("%s shutdown complete", name)
+			return
+
+		case sig := <-drainChan:
+			if draining {
+				continue
+			}
+			if sig == upgradeSignal {
+				if stdio {
+					log.Printf("Received signal %v, but a %s on stdin/stdout can't hand over to a new process", sig, strings.ToLower(name))
+					continue
+				}
+				if err := upgrade(); err != nil {
+					log.Printf("Received signal %v, but the upgrade failed: %v", sig, err)
+					continue
+				}
+			}
+			log.Printf("Received signal %v, draining...", sig)
+			draining = true
+			go r.Drain(context.Background())
+
+		case sig := <-reloadChan:
+			log.Printf("Received signal %v, reloading configuration...", sig)
+			if err := reload(); err != nil {
+				log.Printf("Reload failed, keeping the running configuration: %v", err)
+			}
+
+		case err := <-errChan:
+			if err != nil {
+				log.Fatalf("%s error: %v", name, err)
+			}
+			if draining {
+				log.Printf("%s drained", name)
+			}
+			return
+		}
+	}
+}
+
+// upgradeTimeout bounds how long a new process may take to start serving
+// before the upgrade is given up
+const upgradeTimeout = 30 * time.Second
+
+// upgrade starts a new copy of this program with the same arguments, which
+// takes over the listeners of this one, and returns once it is serving
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer cancel()
+	if err := pivot.Handoff(ctx, cmd); err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	log.Printf("Started %s as process %d on the listeners of this one", exe, cmd.Process.Pid)
+	return nil
+}
+
+// heartbeatFlags holds the session heartbeat options shared by every mode
+type heartbeatFlags struct {
+	interval *time.Duration
+	misses   *int
+}
+
+func addHeartbeatFlags(fs *flag.FlagSet) *heartbeatFlags {
+	defaults := pivot.DefaultHeartbeat()
+	return &heartbeatFlags{
+		interval: fs.Duration("heartbeat", defaults.Interval, "Interval between heartbeats on session links (0 disables sending them)"),
+		misses:   fs.Int("heartbeat-misses", defaults.Misses, "Unanswered heartbeats in a row before the peer is considered dead"),
+	}
+}
+
+// config builds the heartbeat settings from the flags
+func (f *heartbeatFlags) config() (pivot.HeartbeatConfig, error) {
+	config := pivot.HeartbeatConfig{Interval: *f.interval, Misses: *f.misses}
+	return config, config.Validate()
+}
 
-		// Give agent time to cleanup
-		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer shutdownCancel()
+// timeoutFlags holds the stream timeouts shared by every mode
+type timeoutFlags struct {
+	handshake *time.Duration
+	dial      *time.Duration
+	idle      *time.Duration
+}
+
+func addTimeoutFlags(fs *flag.FlagSet) *timeoutFlags {
+	defaults := pivot.DefaultTimeouts()
+	return &timeoutFlags{
+		handshake: fs.Duration("handshake-timeout", defaults.Handshake, "Time allowed for a stream's SOCKS5 negotiation and route"),
+		dial:      fs.Duration("dial-timeout", defaults.Dial, "Time allowed for connecting to a target or remote server"),
+		idle:      fs.Duration("idle-timeout", defaults.Idle, "Close streams with no data in either direction for this long (0 disables it)"),
+	}
+}
+
+// timeouts builds the timeout settings from the flags
+func (f *timeoutFlags) timeouts() (pivot.Timeouts, error) {
+	timeouts := pivot.Timeouts{Handshake: *f.handshake, Dial: *f.dial, Idle: *f.idle}
+	return timeouts, timeouts.Validate()
+}
 
-		agent.Shutdown(shutdownCtx)
-		log.Println("Agent shutdown complete")
+// limitFlags holds the stream and bandwidth limits of the server and agent
+type limitFlags struct {
+	clientStreams  *int
+	sessionStreams *int
+	rate           *float64
+	bandwidth      *string
+}
+
+// addLimitFlags registers the limit flags. Only the server serves sessions
+// with streams of its own, so only it has a per-session limit.
+func addLimitFlags(fs *flag.FlagSet, sessions bool) *limitFlags {
+	f := &limitFlags{
+		clientStreams: fs.Int("max-client-streams", 0, "Concurrent streams per client address (0 for no limit)"),
+		rate:          fs.Float64("stream-rate", 0, "New streams per second per client or session (0 for no limit)"),
+		bandwidth:     fs.String("bandwidth", "", "Bandwidth per client or session in bytes per second, e.g. 512k or 10m"),
+	}
+	if sessions {
+		f.sessionStreams = fs.Int("max-session-streams", 0, "Concurrent streams per session (0 for no limit)")
+	}
+	return f
+}
+
+// limits builds the limit settings from the flags
+func (f *limitFlags) limits() (pivot.Limits, error) {
+	bandwidth, err := pivot.ParseByteRate(*f.bandwidth)
+	if err != nil {
+		return pivot.Limits{}, err
+	}
+	limits := pivot.Limits{
+		ClientStreams: *f.clientStreams,
+		StreamRate:    *f.rate,
+		Bandwidth:     bandwidth,
+	}
+	if f.sessionStreams != nil {
+		limits.SessionStreams = *f.sessionStreams
+	}
+	return limits, limits.Validate()
+}
+
+// tlsFlags holds the options for tls://, wss:// and quic:// endpoints shared
+// by every mode
+type tlsFlags struct {
+	cert       *string
+	key        *string
+	pin        *string
+	ca         *string
+	clientCA   *string
+	serverName *string
+}
 
-	case err := <-errChan:
+func addTLSFlags(fs *flag.FlagSet) *tlsFlags {
+	return &tlsFlags{
+		cert:       fs.String("tls-cert", "", "TLS certificate, generated self-signed if missing (listeners default to "+pivot.DefaultTLSCertFile+")"),
+		key:        fs.String("tls-key", "", "TLS private key (listeners default to "+pivot.DefaultTLSKeyFile+")"),
+		pin:        fs.String("tls-pin", "", "Expected server certificate public key (fingerprint or PEM file)"),
+		ca:         fs.String("tls-ca", "", "CA bundle for verifying the server when no pin is set"),
+		clientCA:   fs.String("tls-client-ca", "", "Certificates allowed as TLS clients, enables mTLS"),
+		serverName: fs.String("tls-sni", "", "TLS server name to send, defaults to the remote host"),
+	}
+}
+
+// transport builds the tunnel transport from the TLS flags
+func (f *tlsFlags) transport() (*pivot.Transport, error) {
+	pin, err := pivot.ParseCertificatePin(*f.pin)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := pivot.NewTransport()
+	transport.TLS = &pivot.TLSOptions{
+		CertFile:     *f.cert,
+		KeyFile:      *f.key,
+		Pin:          pin,
+		CAFile:       *f.ca,
+		ClientCAFile: *f.clientCA,
+		ServerName:   *f.serverName,
+	}
+	return transport, nil
+}
+
+// loadAuthenticator builds the public-key handshake from the -identity,
+// -authorized-keys and -pin flags. It returns nil when no identity is set.
+func loadAuthenticator(identityPath, authorizedPath, pin string) (*pivot.Authenticator, error) {
+	if identityPath == "" {
+		if authorizedPath != "" || pin != "" {
+			return nil, fmt.Errorf("-authorized-keys and -pin require -identity")
+		}
+		return nil, nil
+	}
+
+	identity, err := pivot.LoadIdentity(identityPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %v", err)
+	}
+
+	var authorized *pivot.AuthorizedKeys
+	if authorizedPath != "" {
+		authorized, err = pivot.LoadAuthorizedKeys(authorizedPath)
 		if err != nil {
-			log.Fatal("Agent error:", err)
+			return nil, fmt.Errorf("failed to load authorized keys: %v", err)
 		}
 	}
+
+	pinned, err := pivot.ParsePin(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := pivot.NewAuthenticator(identity, authorized, pinned)
+	log.Printf("Using identity %s", auth.Fingerprint())
+	if authorized != nil {
+		log.Printf("Loaded %d authorized keys from %s", authorized.Len(), authorizedPath)
+	}
+	if pinned != "" {
+		log.Printf("Pinned remote key %s", pinned)
+	}
+	return auth, nil
 }
 
-func runClient() {
-	clientCmd := flag.NewFlagSet("client", flag.ExitOnError)
-	key := clientCmd.String("key", "", "Encryption key")
-	remote := clientCmd.String("r", "", "Remote server address")
-	local := clientCmd.String("l", ":1081", "Local listen address")
+func runKeygen() {
+	keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keyType := keygenCmd.String("t", "symmetric", "Key type: symmetric or ed25519")
+	output := keygenCmd.String("o", "", "Output file (ed25519 public key is written to <file>.pub)")
+	comment := keygenCmd.String("C", "", "Comment stored with an ed25519 public key")
+	force := keygenCmd.Bool("f", false, "Overwrite existing key files")
+	show := keygenCmd.String("l", "", "Show the fingerprint of an existing key file and exit")
 
-	clientCmd.Parse(os.Args[2:])
+	keygenCmd.Parse(os.Args[2:])
 
-	if *key == "" || *remote == "" {
-		log.Fatal("Key and remote address are required")
+	if *show != "" {
+		desc, err := pivot.DescribeKeyFile(*show)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(desc)
+		return
 	}
 
-	fmt.Printf("Starting client: local=%s -> remote=%s with key: %s\n", *local, *remote, *key)
+	if *output == "" {
+		log.Fatal("Output file is required")
+	}
 
-	client := NewClient(*key, *remote, *local)
+	switch *keyType {
+	case "symmetric":
+		key, err := pivot.GenerateSymmetricKey()
+		if err != nil {
+			log.Fatal("Failed to generate key:", err)
+		}
+		if err := pivot.WriteKeyFile(*output, []byte(key+"\n"), 0o600, *force); err != nil {
+			log.Fatal("Failed to write key file:", err)
+		}
+		fmt.Printf("Symmetric key written to %s\n", *output)
+		fmt.Printf("Fingerprint: %s\n", pivot.KeyFingerprint(key))
 
-	// Setup graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	case "ed25519":
+		priv, err := pivot.GenerateIdentity()
+		if err != nil {
+			log.Fatal("Failed to generate identity:", err)
+		}
+		privPEM, err := pivot.MarshalIdentity(priv)
+		if err != nil {
+			log.Fatal("Failed to encode identity:", err)
+		}
+		pub := priv.Public().(ed25519.PublicKey)
 
-	// Handle signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		if err := pivot.WriteKeyFile(*output, privPEM, 0o600, *force); err != nil {
+			log.Fatal("Failed to write identity file:", err)
+		}
+		if err := pivot.WriteKeyFile(*output+".pub", []byte(pivot.MarshalPublicKey(pub, *comment)+"\n"), 0o644, *force); err != nil {
+			log.Fatal("Failed to write public key file:", err)
+		}
+		fmt.Printf("Identity written to %s, public key to %s.pub\n", *output, *output)
+		fmt.Printf("Fingerprint: %s\n", pivot.PublicKeyFingerprint(pub))
 
-	// Start client in goroutine
-	errChan := make(chan error, 1)
-	go func() {
-		errChan <- client.Start(ctx)
-	}()
+	default:
+		log.Fatalf("Unknown key type: %s", *keyType)
+	}
+}
 
-	// Wait for signal or error
-	select {
-	case sig := <-sigChan:
-		log.Printf("Received signal %v, shutting down gracefully...", sig)
-		cancel()
+func runBench() {
+	benchCmd := flag.NewFlagSet("bench", flag.ExitOnError)
+	transports := benchCmd.String("transports", pivot.DefaultBenchTransports, "Comma-separated tunnel transports to measure")
+	ciphers := benchCmd.String("ciphers", pivot.DefaultBenchCiphers, "Comma-separated tunnel ciphers to measure, none only runs on encrypted transports")
+	streams := benchCmd.Int("streams", pivot.DefaultBenchStreams, "Concurrent streams in the throughput test")
+	size := benchCmd.String("size", "32m", "Data echoed through each stream (k, m and g suffixes)")
+	connects := benchCmd.Int("connects", pivot.DefaultBenchConnects, "Sequential connects timed for the latency percentiles")
+	verbose := benchCmd.Bool("v", false, "Show the log of the server and client under test")
 
-		// Give client time to cleanup
-		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer shutdownCancel()
+	benchCmd.Parse(os.Args[2:])
 
-		client.Shutdown(shutdownCtx)
-		log.Println("Client shutdown complete")
+	sizeBytes, err := pivot.ParseByteRate(*size)
+	if err != nil || sizeBytes <= 0 {
+		log.Fatalf("Invalid -size %q", *size)
+	}
+	if *streams <= 0 || *connects <= 0 {
+		log.Fatal("-streams and -connects must be positive")
+	}
 
-	case err := <-errChan:
-		if err != nil {
-			log.Fatal("Client error:", err)
+	certs, err := pivot.NewBenchTLS()
+	if err != nil {
+		log.Fatal("Failed to create TLS certificate:", err)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	fmt.Printf("%d streams of %s each, %d connects, over loopback\n", *streams, *size, *connects)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRANSPORT\tCIPHER\tTHROUGHPUT\tCONNECT P50\tCONNECT P99\tCPU/GB")
+	for _, transport := range pivot.SplitList(*transports) {
+		for _, cipher := range pivot.SplitList(*ciphers) {
+			config := pivot.BenchConfig{
+				Transport: transport,
+				Cipher:    cipher,
+				Streams:   *streams,
+				Size:      sizeBytes,
+				Connects:  *connects,
+			}
+			if pivot.CheckCipher(cipher, transport+"://127.0.0.1:0") != nil {
+				continue
+			}
+
+			result, err := pivot.RunBench(context.Background(), config, certs)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%s\tfailed: %v\n", transport, cipher, err)
+				continue
+			}
+			cpu := "n/a"
+			if result.CPUPerGB > 0 {
+				cpu = result.CPUPerGB.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.1f MB/s\t%v\t%v\t%s\n", transport, cipher,
+				result.Throughput/1e6, result.ConnectP50.Round(time.Microsecond),
+				result.ConnectP99.Round(time.Microsecond), cpu)
 		}
 	}
+	w.Flush()
 }
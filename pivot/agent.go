@@ -0,0 +1,301 @@
+package pivot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Agent represents the agent server that bridges victim server and clients
+type Agent struct {
+	agentSettings
+	mu sync.Mutex // guards agentSettings while serving
+
+	life      lifecycle
+	connCount int32
+	transport *Transport
+	cipher    string
+	heartbeat HeartbeatConfig
+	limits    limiter // per client address
+
+	// Sessions of the connected victim servers, by announced name
+	victims hopTable
+
+	// The listeners of the current run. reloadMu serializes Reload with
+	// itself and with Start opening them, so holding it also makes the
+	// settings safe to read without mu.
+	reloadMu         sync.Mutex
+	clientListener   listenSlot
+	internalListener listenSlot
+}
+
+// agentSettings are the settings of an agent that Reload changes in place
+type agentSettings struct {
+	key          string
+	clientAddr   string // Address to listen for client connections
+	internalAddr string // Address to listen for victim server connections
+	auth         *Authenticator
+	timeouts     Timeouts
+}
+
+// newAgent creates an agent with the default settings
+func newAgent(key, clientAddr, internalAddr string) *Agent {
+	return &Agent{
+		agentSettings: agentSettings{
+			key:          key,
+			clientAddr:   clientAddr,
+			internalAddr: internalAddr,
+			timeouts:     DefaultTimeouts(),
+		},
+		transport: NewTransport(),
+		cipher:    CipherRC4,
+		heartbeat: DefaultHeartbeat(),
+	}
+}
+
+// settings returns the settings in force, for a connection to use until it
+// ends
+func (a *Agent) settings() agentSettings {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.agentSettings
+}
+
+// Start starts the agent server and serves until ctx ends or Shutdown is
+// called. Ending ctx abandons the relays in flight, while Shutdown lets them
+// finish first. The agent can be started again once Start has returned.
+func (a *Agent) Start(ctx context.Context) error {
+	r, err := a.life.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer a.life.finish(r)
+
+	a.reloadMu.Lock()
+	a.clientListener, a.internalListener = listenSlot{}, listenSlot{}
+	var moves listenerMoves
+	err = moves.open(&a.internalListener, a.internalAddr, func(addr string) (*acceptor, error) {
+		return a.listenVictims(r, addr)
+	})
+	if err == nil {
+		err = moves.open(&a.clientListener, a.clientAddr, func(addr string) (*acceptor, error) {
+			return a.listenClients(r, addr)
+		})
+	}
+	if err != nil {
+		moves.abort()
+		a.reloadMu.Unlock()
+		return err
+	}
+	a.mu.Lock()
+	moves.commit()
+	a.mu.Unlock()
+	a.reloadMu.Unlock()
+	reportReady()
+
+	<-r.serving.Done()
+	return ctx.Err()
+}
+
+// listenVictims accepts victim server connections on addr. Victim sessions
+// end as soon as the agent stops serving, taking the relays over them along,
+// unless the agent drains.
+func (a *Agent) listenVictims(r *run, addr string) (*acceptor, error) {
+	listener, err := a.transport.ListenSession(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on internal address %s: %v", addr, err)
+	}
+
+	log.Printf("Agent listening for victim server on %s", addr)
+
+	return r.acceptSessions(listener, "victim connection", func(conn net.Conn) {
+		a.handleVictimConnection(r, conn)
+	}), nil
+}
+
+// listenClients accepts client connections on addr
+func (a *Agent) listenClients(r *run, addr string) (*acceptor, error) {
+	listener, err := a.transport.Listen(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on client address %s: %v", addr, err)
+	}
+
+	log.Printf("Agent listening for clients on %s", addr)
+
+	return r.acceptLoop(listener, "client connection", func(conn net.Conn) {
+		a.handleClientConnection(r.ctx, conn)
+	}), nil
+}
+
+// handleClientConnection handles a connection from a client
+func (a *Agent) handleClientConnection(ctx context.Context, clientConn net.Conn) {
+	defer clientConn.Close()
+	atomic.AddInt32(&a.connCount, 1)
+	defer atomic.AddInt32(&a.connCount, -1)
+
+	clientAddr := clientConn.RemoteAddr().String()
+	log.Printf("New client connection from %s", clientAddr)
+	cfg := a.settings()
+
+	// Create encrypted connection with client
+	clientRC4, err := wrapCipher(clientConn, a.cipher, cfg.key)
+	if err != nil {
+		log.Printf("Error creating encrypted connection for client: %v", err)
+		return
+	}
+	defer clientRC4.Close()
+
+	if cfg.auth.enabled() {
+		peer, err := cfg.auth.Accept(clientRC4)
+		if err != nil {
+			log.Printf("Handshake with client %s (%s) failed: %v", clientAddr, peer, err)
+			return
+		}
+		log.Printf("Authenticated client %s as %s", clientAddr, peer)
+	}
+
+	// The stream may start with a route naming the victim and further hops
+	clientRC4.SetDeadline(cfg.timeouts.handshakeDeadline())
+	clientTunnel, route, err := readRoute(clientRC4)
+	if err != nil {
+		log.Printf("Failed to read route from client %s: %v", clientAddr, err)
+		return
+	}
+	clientRC4.SetDeadline(time.Time{})
+	if len(route) == 0 {
+		route = []string{""}
+	}
+
+	group := a.limits.group(clientConn.RemoteAddr())
+	if err := group.acquire(); err != nil {
+		log.Printf("Refused client %s: %v", clientAddr, err)
+		rejectSOCKS5(clientTunnel, SOCKS5_REPLY_NOT_ALLOWED)
+		return
+	}
+	defer group.release()
+
+	// Open a SOCKS5 stream to the victim over its session
+	victimStream, err := openRoute(ctx, &a.victims, route, cfg.timeouts.Dial)
+	if err != nil {
+		log.Printf("Failed to open stream to victim server for client %s: %v", clientAddr, err)
+		return
+	}
+	defer victimStream.Close()
+
+	log.Printf("Established relay between client %s and victim server", clientAddr)
+
+	// Start bidirectional relay between client and victim
+	result := relayWith(clientTunnel, victimStream, relayOptions{bandwidth: group.shaper(), idle: cfg.timeouts.Idle, done: ctx.Done()})
+
+	log.Printf("Client relay finished: %s (%v)", clientAddr, result)
+}
+
+// handleVictimConnection handles a connection from a victim server, for as
+// long as r keeps its session
+func (a *Agent) handleVictimConnection(r *run, conn net.Conn) {
+	defer conn.Close()
+	atomic.AddInt32(&a.connCount, 1)
+	defer atomic.AddInt32(&a.connCount, -1)
+
+	log.Printf("New victim server connection from %s", conn.RemoteAddr())
+
+	cfg := a.settings()
+	name, session, err := acceptHopSession(conn, a.cipher, cfg.key, cfg.auth, a.heartbeat)
+	if err != nil {
+		log.Printf("Victim %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer session.Close()
+
+	// Store the victim session for client relay. It becomes the default for
+	// clients without a route and replaces an older one with the same name.
+	a.victims.add(name, session)
+
+	if name != "" {
+		log.Printf("Victim server %q connected and ready to handle SOCKS5 requests", name)
+	} else {
+		log.Printf("Victim server connected and ready to handle SOCKS5 requests")
+	}
+
+	if r.keep(session) {
+		log.Printf("Victim server disconnected (last rtt %v)", session.RTT())
+	}
+
+	a.victims.remove(name, session)
+}
+
+// Reload applies opts to the agent in place. The key, authentication,
+// timeouts, limits and listen addresses change right away; the other
+// settings are kept and logged as taking a restart. Relays and victim
+// sessions in flight carry on under the settings they started with. Nothing
+// changes when opts are invalid or a new listener fails.
+func (a *Agent) Reload(opts AgentOptions) error {
+	next, err := NewAgent(opts)
+	if err != nil {
+		return err
+	}
+
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	cfg := next.agentSettings
+	var diff reloadDiff
+	diff.keep("cipher", next.cipher != a.cipher)
+	diff.keep("transport settings", !sameTransport(next.transport, a.transport))
+	diff.keep("heartbeat", next.heartbeat != a.heartbeat)
+	diff.compare("client listen address", a.clientAddr, cfg.clientAddr)
+	diff.compare("internal listen address", a.internalAddr, cfg.internalAddr)
+	diff.compareKey(a.key, cfg.key)
+	diff.compareAuth(a.auth, cfg.auth)
+	diff.compare("timeouts", a.timeouts, cfg.timeouts)
+	diff.compare("limits", a.limits.current(), next.limits.Limits)
+
+	var moves listenerMoves
+	_, err = a.life.within(func(r *run) error {
+		err := moves.open(&a.internalListener, cfg.internalAddr, func(addr string) (*acceptor, error) {
+			return a.listenVictims(r, addr)
+		})
+		if err != nil {
+			return err
+		}
+		return moves.open(&a.clientListener, cfg.clientAddr, func(addr string) (*acceptor, error) {
+			return a.listenClients(r, addr)
+		})
+	})
+	if err != nil {
+		moves.abort()
+		return err
+	}
+
+	a.mu.Lock()
+	replaced := moves.commit()
+	a.agentSettings = cfg
+	a.mu.Unlock()
+	stopAcceptors(replaced)
+	if limits := next.limits.Limits; limits != a.limits.current() {
+		a.limits.set(limits)
+	}
+
+	diff.log("Agent")
+	return nil
+}
+
+// Shutdown shuts down the agent server. It stops accepting and waits for
+// the relays in flight until ctx ends, then cuts them off. Calling it on an
+// agent that isn't running does nothing.
+func (a *Agent) Shutdown(ctx context.Context) error {
+	return a.life.shutdown(ctx)
+}
+
+// Drain stops the agent from accepting and asks victim servers to dial a
+// new session, while the relays in flight carry on. Start returns once all
+// of them are done. Drain waits for that until ctx ends; Shutdown cuts off
+// whatever is left.
+func (a *Agent) Drain(ctx context.Context) error {
+	log.Println("Draining, waiting for active relays to finish")
+	return a.life.drain(ctx)
+}
@@ -0,0 +1,87 @@
+package pivot
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Default reconnect settings for the victim's link to its agent
+const (
+	defaultRetryInitial = 1 * time.Second
+	defaultRetryMax     = 60 * time.Second
+	defaultRetryJitter  = 0.2
+
+	retryMultiplier = 2
+)
+
+// Backoff computes reconnect delays. Each failed attempt doubles the delay,
+// starting at Initial and capped at Max, and Jitter randomizes every delay by
+// up to that fraction in either direction so many pivots don't retry in
+// lockstep.
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Jitter      float64
+	MaxAttempts int // 0 retries forever
+
+	attempts int
+}
+
+// NewBackoff creates a backoff with the default settings
+func NewBackoff() *Backoff {
+	return &Backoff{
+		Initial: defaultRetryInitial,
+		Max:     defaultRetryMax,
+		Jitter:  defaultRetryJitter,
+	}
+}
+
+// Validate checks the settings
+func (b *Backoff) Validate() error {
+	if b.Initial <= 0 {
+		return fmt.Errorf("initial retry delay must be positive")
+	}
+	if b.Max < b.Initial {
+		return fmt.Errorf("maximum retry delay %v is below the initial delay %v", b.Max, b.Initial)
+	}
+	if b.Jitter < 0 || b.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+	if b.MaxAttempts < 0 {
+		return fmt.Errorf("retry attempts can't be negative")
+	}
+	return nil
+}
+
+// Next records a failed attempt and returns the delay before the next one.
+// It returns false once MaxAttempts failures have been reached.
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.attempts++
+	if b.MaxAttempts > 0 && b.attempts >= b.MaxAttempts {
+		return 0, false
+	}
+
+	delay := b.Initial
+	for i := 1; i < b.attempts && delay < b.Max; i++ {
+		delay *= retryMultiplier
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+
+	if b.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + b.Jitter*(2*rand.Float64()-1)))
+	}
+	return delay, true
+}
+
+// Attempts returns the number of failed attempts since the last Reset
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset starts over after a successful connection
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,100 @@
+package pivot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelays(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: 5 * time.Second}
+
+	expected := []time.Duration{1, 2, 4, 5, 5}
+	for i, want := range expected {
+		delay, retry := b.Next()
+		if !retry {
+			t.Fatalf("Attempt %d: unexpected give up", i+1)
+		}
+		if delay != want*time.Second {
+			t.Errorf("Attempt %d: expected %v, got %v", i+1, want*time.Second, delay)
+		}
+	}
+
+	b.Reset()
+	if delay, _ := b.Next(); delay != time.Second {
+		t.Errorf("Expected the initial delay after Reset, got %v", delay)
+	}
+}
+
+func TestBackoffJitterAndLimit(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: time.Second, Jitter: 0.5, MaxAttempts: 50}
+	for i := 1; i < 50; i++ {
+		delay, retry := b.Next()
+		if !retry {
+			t.Fatalf("Gave up after %d attempts, expected 50", i)
+		}
+		if delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Errorf("Delay %v outside the jitter range", delay)
+		}
+	}
+	if _, retry := b.Next(); retry {
+		t.Error("Expected to give up after MaxAttempts")
+	}
+}
+
+func TestServerFallbackAgent(t *testing.T) {
+	// A stand-in agent that reports the name of the pivot that dialed in
+	listener, err := NewTransport().ListenSession("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	names := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		name, session, err := acceptHopSession(conn, CipherRC4, "test-key", nil, DefaultHeartbeat())
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		names <- name
+		<-session.Done()
+	}()
+
+	// Nothing listens on the primary address
+	server := newServer("test-key", "127.0.0.1:1")
+	server.name = "pivot"
+	server.fallbacks = []string{listener.Addr().String()}
+	server.backoff = &Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Start(ctx)
+
+	select {
+	case name := <-names:
+		if name != "pivot" {
+			t.Errorf("Expected the pivot name, got %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server never reached the fallback agent")
+	}
+}
+
+func TestServerGivesUp(t *testing.T) {
+	server := newServer("test-key", "127.0.0.1:1")
+	server.backoff = &Backoff{Initial: time.Millisecond, Max: time.Millisecond, MaxAttempts: 2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := server.Start(ctx)
+	if err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Errorf("Expected to give up, got: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package pivot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategies for spreading client connections over several remotes
+const (
+	StrategyFailover     = "failover"      // first healthy remote in the order given
+	StrategyRoundRobin   = "round-robin"   // healthy remotes in turn
+	StrategyLeastLatency = "least-latency" // healthy remote with the lowest connect time
+)
+
+const (
+	DefaultHealthInterval = 10 * time.Second
+	healthCheckTimeout    = 5 * time.Second
+)
+
+// checkStrategy validates a remote selection strategy
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastLatency:
+		return nil
+	default:
+		return fmt.Errorf("unknown strategy: %s", strategy)
+	}
+}
+
+// SplitList splits a comma-separated list, such as one of addresses,
+// dropping empty entries
+func SplitList(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// remoteState is the health of one remote
+type remoteState struct {
+	addr    string
+	up      bool
+	latency time.Duration // smoothed connect time, 0 until measured
+}
+
+// remotePool picks the remote for each new client connection. Remotes that
+// fail to connect are marked down and probed in the background until they
+// answer again.
+type remotePool struct {
+	strategy string
+	interval time.Duration // time between health checks, 0 disables them
+
+	mu      sync.Mutex
+	remotes []*remoteState
+	next    int // round-robin position
+}
+
+// newRemotePool creates a failover pool over addrs, all initially up
+func newRemotePool(addrs []string) *remotePool {
+	p := &remotePool{
+		strategy: StrategyFailover,
+		interval: DefaultHealthInterval,
+	}
+	for _, addr := range addrs {
+		p.remotes = append(p.remotes, &remoteState{addr: addr, up: true})
+	}
+	return p
+}
+
+// addrs returns all remotes in the order given
+func (p *remotePool) addrs() []string {
+	addrs := make([]string, len(p.remotes))
+	for i, r := range p.remotes {
+		addrs[i] = r.addr
+	}
+	return addrs
+}
+
+// candidates returns the remotes to try for a new connection. Healthy remotes
+// come first, ordered by the strategy. Down remotes follow as a last resort,
+// so connections still get through if every remote was marked down.
+func (p *remotePool) candidates() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var up, down []*remoteState
+	for _, r := range p.remotes {
+		if r.up {
+			up = append(up, r)
+		} else {
+			down = append(down, r)
+		}
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(up) > 0 {
+			start := p.next % len(up)
+			p.next++
+			up = append(up[start:], up[:start]...)
+		}
+	case StrategyLeastLatency:
+		sort.SliceStable(up, func(i, j int) bool {
+			return up[i].latency < up[j].latency
+		})
+	}
+
+	addrs := make([]string, 0, len(p.remotes))
+	for _, r := range append(up, down...) {
+		addrs = append(addrs, r.addr)
+	}
+	return addrs
+}
+
+func (p *remotePool) find(addr string) *remoteState {
+	for _, r := range p.remotes {
+		if r.addr == addr {
+			return r
+		}
+	}
+	return nil
+}
+
+// markUp records a successful connect and how long it took
+func (p *remotePool) markUp(addr string, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := p.find(addr)
+	if r == nil {
+		return
+	}
+	if !r.up {
+		log.Printf("Remote %s is back up", addr)
+		r.up = true
+	}
+	if r.latency == 0 {
+		r.latency = latency
+	} else {
+		r.latency = (3*r.latency + latency) / 4
+	}
+}
+
+// markDown takes a remote out of rotation until a health check succeeds
+func (p *remotePool) markDown(addr string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := p.find(addr)
+	if r == nil || !r.up {
+		return
+	}
+	log.Printf("Remote %s is down: %v", addr, err)
+	r.up = false
+}
+
+// check probes the remotes once. Only down remotes need a probe, except for
+// least-latency, which keeps measuring all of them.
+func (p *remotePool) check(ctx context.Context, probe func(context.Context, string) error) {
+	p.mu.Lock()
+	var addrs []string
+	for _, r := range p.remotes {
+		if !r.up || p.strategy == StrategyLeastLatency {
+			addrs = append(addrs, r.addr)
+		}
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			if err := probe(probeCtx, addr); err != nil {
+				if ctx.Err() == nil {
+					p.markDown(addr, err)
+				}
+				return
+			}
+			p.markUp(addr, time.Since(start))
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// monitor runs health checks until ctx ends
+func (p *remotePool) monitor(ctx context.Context, probe func(context.Context, string) error) {
+	if p.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.check(ctx, probe)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
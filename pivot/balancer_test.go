@@ -0,0 +1,97 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemotePoolStrategies(t *testing.T) {
+	pool := newRemotePool([]string{"a", "b", "c"})
+	if got := pool.candidates(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Failover: expected a, b, c, got %v", got)
+	}
+
+	// Down remotes are only a last resort
+	pool.markDown("a", errors.New("refused"))
+	if got := pool.candidates(); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+		t.Errorf("Failover with a down: expected b, c, a, got %v", got)
+	}
+
+	pool.strategy = StrategyRoundRobin
+	first := pool.candidates()
+	second := pool.candidates()
+	if first[0] == second[0] || first[2] != "a" || second[2] != "a" {
+		t.Errorf("Round-robin: expected rotation over b and c, got %v then %v", first, second)
+	}
+
+	pool.strategy = StrategyLeastLatency
+	pool.markUp("a", 30*time.Millisecond)
+	pool.markUp("b", 20*time.Millisecond)
+	pool.markUp("c", 10*time.Millisecond)
+	if got := pool.candidates(); !reflect.DeepEqual(got, []string{"c", "b", "a"}) {
+		t.Errorf("Least-latency: expected c, b, a, got %v", got)
+	}
+}
+
+func TestRemotePoolHealthCheck(t *testing.T) {
+	pool := newRemotePool([]string{"a", "b"})
+	pool.markDown("a", errors.New("refused"))
+
+	var probed []string
+	pool.check(context.Background(), func(ctx context.Context, addr string) error {
+		probed = append(probed, addr)
+		return nil
+	})
+
+	// Failover only probes the remote that is down, and brings it back
+	if !reflect.DeepEqual(probed, []string{"a"}) {
+		t.Errorf("Expected only a to be probed, got %v", probed)
+	}
+	if got := pool.candidates(); got[0] != "a" {
+		t.Errorf("Expected a back in first place, got %v", got)
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan struct{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+		accepted <- struct{}{}
+	}()
+
+	// Nothing listens on the first remote
+	client := newClient("test-key", "127.0.0.1:1,"+listener.Addr().String(), "127.0.0.1:0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.dialRemote(ctx, 1, client.remotes)
+	if err != nil {
+		t.Fatalf("Expected the second remote to take over, got %v", err)
+	}
+	conn.Close()
+
+	select {
+	case <-accepted:
+	case <-ctx.Done():
+		t.Fatal("Second remote never saw the connection")
+	}
+
+	if got := client.remotes.candidates(); got[0] != listener.Addr().String() {
+		t.Errorf("Expected the dead remote to be marked down, got order %v", got)
+	}
+}
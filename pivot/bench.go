@@ -0,0 +1,244 @@
+package pivot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Defaults of the bench subcommand
+const (
+	DefaultBenchTransports = "tcp,tls,ws,wss,quic"
+	DefaultBenchCiphers    = "rc4,none"
+	DefaultBenchStreams    = 8
+	DefaultBenchConnects   = 200
+
+	benchKey  = "pivot-internal-bench"
+	benchPath = "/bench"
+)
+
+// BenchConfig describes one benchmark run over a transport and cipher
+type BenchConfig struct {
+	Transport string // tunnel scheme, such as tcp or quic
+	Cipher    string
+	Streams   int   // concurrent streams in the throughput phase
+	Size      int64 // bytes echoed through each stream
+	Connects  int   // sequential connects timed in the latency phase
+}
+
+// BenchResult is what one run measured
+type BenchResult struct {
+	Throughput float64 // bytes per second echoed back, counted one way
+	ConnectP50 time.Duration
+	ConnectP99 time.Duration
+	CPUPerGB   time.Duration // process CPU time per GiB relayed, 0 if unknown
+}
+
+// BenchTLS holds an in-memory certificate shared by every TLS run, so the
+// benchmark leaves no files behind
+type BenchTLS struct {
+	cert *tls.Certificate
+	pin  string
+}
+
+func NewBenchTLS() (*BenchTLS, error) {
+	certPEM, keyPEM, err := newSelfSigned()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &BenchTLS{cert: &cert, pin: CertificatePin(leaf)}, nil
+}
+
+// RunBench stands up an echo target, a server and a client in this process
+// and measures the full client to server path over loopback: first the
+// latency of sequential SOCKS5 connects, then the throughput of concurrent
+// streams echoing data through the tunnel. The CPU time covers all three
+// parts, so it is an upper bound for a real deployment.
+func RunBench(ctx context.Context, config BenchConfig, certs *BenchTLS) (BenchResult, error) {
+	var result BenchResult
+	if err := CheckCipher(config.Cipher, config.Transport+"://127.0.0.1:0"); err != nil {
+		return result, err
+	}
+
+	target, err := listenEcho()
+	if err != nil {
+		return result, err
+	}
+	defer target.Close()
+
+	server := newServer(benchKey, "")
+	server.cipher = config.Cipher
+	server.transport = &Transport{TLS: &TLSOptions{cert: certs.cert}}
+
+	// WebSocket endpoints need a path, other schemes take none
+	path := ""
+	if config.Transport == SchemeWS || config.Transport == SchemeWSS {
+		path = benchPath
+	}
+
+	listener, err := server.transport.Listen(config.Transport + "://127.0.0.1:0" + path)
+	if err != nil {
+		return result, err
+	}
+	defer listener.Close()
+	go serveConns(listener, func(conn net.Conn) {
+		server.handleClient(ctx, conn)
+	})
+
+	client := newClient(benchKey, config.Transport+"://"+listener.Addr().String()+path, "")
+	client.cipher = config.Cipher
+	client.transport = &Transport{TLS: &TLSOptions{Pin: certs.pin}}
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return result, err
+	}
+	defer local.Close()
+	go serveConns(local, func(conn net.Conn) {
+		client.handleLocalConnection(ctx, conn)
+	})
+
+	connect := func() (net.Conn, time.Duration, error) {
+		start := time.Now()
+		conn, err := net.Dial("tcp", local.Addr().String())
+		if err != nil {
+			return nil, 0, err
+		}
+		conn.SetDeadline(time.Now().Add(client.timeouts.Dial + client.timeouts.Handshake))
+		if err := NewSOCKS5Client("").handshake(conn, target.Addr().String()); err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, time.Since(start), nil
+	}
+
+	// Latency of opening a stream through the tunnel
+	latencies := make([]time.Duration, 0, config.Connects)
+	for i := 0; i < config.Connects; i++ {
+		conn, latency, err := connect()
+		if err != nil {
+			return result, fmt.Errorf("connect: %v", err)
+		}
+		conn.Close()
+		latencies = append(latencies, latency)
+	}
+	result.ConnectP50 = percentile(latencies, 0.50)
+	result.ConnectP99 = percentile(latencies, 0.99)
+
+	// Throughput of concurrent streams
+	streams := make([]net.Conn, 0, config.Streams)
+	defer func() {
+		for _, conn := range streams {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < config.Streams; i++ {
+		conn, _, err := connect()
+		if err != nil {
+			return result, fmt.Errorf("connect: %v", err)
+		}
+		streams = append(streams, conn)
+	}
+
+	cpuBefore, cpuOK := processCPUTime()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, config.Streams)
+	for _, conn := range streams {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			errs <- echoThrough(conn, config.Size)
+		}(conn)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	cpuAfter, _ := processCPUTime()
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return result, err
+		}
+	}
+
+	total := config.Size * int64(config.Streams)
+	result.Throughput = float64(total) / elapsed.Seconds()
+	if cpuOK {
+		// Every byte crosses the tunnel twice, once each way
+		gib := float64(2*total) / (1 << 30)
+		result.CPUPerGB = time.Duration(float64(cpuAfter-cpuBefore) / gib)
+	}
+	return result, nil
+}
+
+// echoThrough writes size bytes to conn while reading them back
+func echoThrough(conn net.Conn, size int64) error {
+	written := make(chan error, 1)
+	go func() {
+		buf := make([]byte, relayBufferSize)
+		var err error
+		for left := size; left > 0 && err == nil; left -= int64(len(buf)) {
+			_, err = conn.Write(buf[:min(left, int64(len(buf)))])
+		}
+		written <- err
+	}()
+
+	n, err := io.CopyN(io.Discard, conn, size)
+	if err != nil {
+		return fmt.Errorf("echo: %d of %d bytes came back: %v", n, size, err)
+	}
+	return <-written
+}
+
+// listenEcho starts a target that sends back everything it receives
+func listenEcho() (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go serveConns(listener, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	return listener, nil
+}
+
+// serveConns hands every connection accepted by listener to handle until
+// the listener is closed
+func serveConns(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// percentile returns the p-th percentile of samples, sorting them in place
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	slices.Sort(samples)
+	i := int(float64(len(samples)-1) * p)
+	return samples[i]
+}
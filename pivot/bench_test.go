@@ -0,0 +1,44 @@
+package pivot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	certs, err := NewBenchTLS()
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	for _, config := range []BenchConfig{
+		{Transport: SchemeTCP, Cipher: CipherRC4},
+		{Transport: SchemeWS, Cipher: CipherRC4},
+		{Transport: SchemeQUIC, Cipher: CipherNone},
+	} {
+		config.Streams, config.Size, config.Connects = 2, 256<<10, 5
+		result, err := RunBench(context.Background(), config, certs)
+		if err != nil {
+			t.Errorf("%s/%s: %v", config.Transport, config.Cipher, err)
+			continue
+		}
+		if result.Throughput <= 0 || result.ConnectP50 <= 0 || result.ConnectP99 < result.ConnectP50 {
+			t.Errorf("%s/%s: implausible result %+v", config.Transport, config.Cipher, result)
+		}
+	}
+
+	if _, err := RunBench(context.Background(), BenchConfig{Transport: SchemeTCP, Cipher: CipherNone}, certs); err == nil {
+		t.Error("Expected the none cipher to be refused over plain TCP")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	samples := []time.Duration{5, 1, 4, 2, 3}
+	if got := percentile(samples, 0.5); got != 3 {
+		t.Errorf("Expected p50 of 3, got %v", got)
+	}
+	if got := percentile(samples, 0.99); got != 4 {
+		t.Errorf("Expected p99 of 4 with five samples, got %v", got)
+	}
+}
@@ -0,0 +1,626 @@
+package pivot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client represents the pivot client
+type Client struct {
+	clientSettings
+	mu sync.Mutex // guards clientSettings and the listeners while serving
+
+	server    *SOCKS5Server // answers SOCKS5 for the rules
+	life      lifecycle
+	connCount int32
+	transport *Transport
+	cipher    string
+	heartbeat HeartbeatConfig
+
+	// The internal domains last reported by the server, for PAC files
+	pacMu      sync.Mutex
+	pacDomains []string
+	pacFetched time.Time
+
+	// link, when set, replaces per-connection dials of remoteAddr. Every
+	// local connection then becomes a stream of one session over the link,
+	// as for stdio and -exec tunnels.
+	link      func() (net.Conn, error)
+	linkName  string
+	session   Session
+	sessionMu sync.Mutex
+
+	// The listeners and health checks of the current run. reloadMu
+	// serializes Reload with itself and with Start setting them up, so
+	// holding it also makes the settings safe to read without mu.
+	reloadMu sync.Mutex
+	local    listenSlot
+	pac      listenSlot
+	monitors context.CancelFunc
+}
+
+// clientSettings are the settings of a client that Reload changes in place
+type clientSettings struct {
+	key        string
+	remoteAddr string
+	remotes    *remotePool // remoteAddr split into its comma-separated remotes
+	localAddr  string
+	pacAddr    string // where the PAC file is served, if anywhere
+	auth       *Authenticator
+	route      []string // named pivots to pass through behind the remote
+	timeouts   Timeouts
+
+	// rules, when set, pick a route per destination. The client then answers
+	// SOCKS5 itself and hands requests on to the remote the rule selects.
+	rules *RuleSet
+	named map[string]*remotePool // the rules' named remotes
+}
+
+// newClient creates a client with the default settings
+func newClient(key, remoteAddr, localAddr string) *Client {
+	return &Client{
+		clientSettings: clientSettings{
+			key:        key,
+			remoteAddr: remoteAddr,
+			remotes:    newRemotePool(SplitList(remoteAddr)),
+			localAddr:  localAddr,
+			timeouts:   DefaultTimeouts(),
+		},
+		server:    &SOCKS5Server{},
+		transport: NewTransport(),
+		cipher:    CipherRC4,
+		heartbeat: DefaultHeartbeat(),
+	}
+}
+
+// settings returns the settings in force, for a connection to use until it
+// ends
+func (c *Client) settings() clientSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientSettings
+}
+
+// Start starts the client and serves SOCKS5 until ctx ends or Shutdown is
+// called. Ending ctx abandons the connections in flight, while Shutdown lets
+// them finish first. The client can be started again once Start has
+// returned.
+func (c *Client) Start(ctx context.Context) error {
+	r, err := c.life.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// The link session goes last, once the connections using it are done
+	defer c.closeSession()
+	defer c.life.finish(r)
+
+	c.reloadMu.Lock()
+	err = c.setUp(r)
+	c.reloadMu.Unlock()
+	if err != nil {
+		return err
+	}
+	reportReady()
+
+	<-r.serving.Done()
+	return ctx.Err()
+}
+
+// setUp starts the health checks and listeners of r
+func (c *Client) setUp(r *run) error {
+	if c.link != nil {
+		// Set the session up front so handshake errors show at startup
+		if _, err := c.currentSession(); err != nil {
+			return err
+		}
+	} else if addrs := c.remotes.addrs(); len(addrs) > 1 {
+		log.Printf("Will forward to remote servers %s (%s)", strings.Join(addrs, ", "), c.remotes.strategy)
+	} else {
+		log.Printf("Will forward to remote server at %s", c.remoteAddr)
+	}
+
+	if c.rules != nil {
+		c.mu.Lock()
+		c.setupRules()
+		c.mu.Unlock()
+		log.Printf("Routing by %d rules", len(c.rules.rules))
+	}
+	c.monitors = c.monitorRemotes(r, c.clientSettings)
+
+	c.local, c.pac = listenSlot{}, listenSlot{}
+	var moves listenerMoves
+	err := moves.open(&c.local, c.localAddr, func(addr string) (*acceptor, error) {
+		return c.listen(r, addr)
+	})
+	if err == nil {
+		err = moves.open(&c.pac, c.pacAddr, func(addr string) (*acceptor, error) {
+			return c.startPAC(r, addr)
+		})
+	}
+	if err != nil {
+		moves.abort()
+		return err
+	}
+	c.mu.Lock()
+	moves.commit()
+	c.mu.Unlock()
+	return nil
+}
+
+// listen serves SOCKS5 on addr
+func (c *Client) listen(r *run, addr string) (*acceptor, error) {
+	listener, err := listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Client SOCKS5 server listening on %s", addr)
+
+	return r.acceptLoop(listener, "connection", func(conn net.Conn) {
+		c.handleLocalConnection(r.ctx, conn)
+	}), nil
+}
+
+// monitorRemotes health-checks the pools of cfg that have several remotes
+// until r stops serving or the returned function is called
+func (c *Client) monitorRemotes(r *run, cfg clientSettings) context.CancelFunc {
+	ctx, cancel := context.WithCancel(r.serving)
+	pools := []*remotePool{cfg.remotes}
+	for _, pool := range cfg.named {
+		pools = append(pools, pool)
+	}
+	for _, pool := range pools {
+		if len(pool.remotes) > 1 {
+			r.spawn(func() { pool.monitor(ctx, c.probeRemote) })
+		}
+	}
+	return cancel
+}
+
+func (c *Client) handleLocalConnection(ctx context.Context, localConn net.Conn) {
+	defer localConn.Close()
+
+	connID := atomic.AddInt32(&c.connCount, 1)
+	log.Printf("New local SOCKS5 connection #%d from %s", connID, localConn.RemoteAddr())
+
+	cfg := c.settings()
+	if cfg.rules != nil {
+		c.handleRuledConnection(ctx, cfg, localConn, connID)
+		return
+	}
+
+	remote, err := c.openRemote(ctx, connID, cfg.remotes)
+	if err != nil {
+		log.Printf("Connection #%d: %v", connID, err)
+		return
+	}
+	defer remote.Close()
+
+	if err := writeRoute(remote, cfg.route); err != nil {
+		log.Printf("Connection #%d: Failed to send route: %v", connID, err)
+		return
+	}
+
+	log.Printf("Connection #%d: Starting relay", connID)
+
+	// Start relaying all data between local and remote
+	result := relayWith(localConn, remote, relayOptions{idle: cfg.timeouts.Idle})
+	log.Printf("Connection #%d: Closed (%v)", connID, result)
+}
+
+// handleRuledConnection answers the SOCKS5 handshake locally and sends the
+// request where the first matching rule of cfg says
+func (c *Client) handleRuledConnection(ctx context.Context, cfg clientSettings, localConn net.Conn, connID int32) {
+	localConn.SetDeadline(cfg.timeouts.handshakeDeadline())
+	defer localConn.SetDeadline(time.Time{})
+
+	if err := c.server.handleAuth(localConn); err != nil {
+		log.Printf("Connection #%d: SOCKS5 auth error: %v", connID, err)
+		return
+	}
+	target, request, err := c.server.readRequest(localConn)
+	if err != nil {
+		log.Printf("Connection #%d: SOCKS5 request error: %v", connID, err)
+		return
+	}
+	localConn.SetDeadline(time.Time{})
+
+	rule, pool, route := cfg.routeFor(target)
+	action := ActionDefault
+	if rule != nil {
+		action = rule.Action
+		log.Printf("Connection #%d: %s matches rule %q", connID, target, rule)
+	}
+
+	var remote net.Conn
+	switch action {
+	case ActionReject:
+		c.server.writeReply(localConn, SOCKS5_REPLY_NOT_ALLOWED)
+		log.Printf("Connection #%d: Rejected %s", connID, target)
+		return
+
+	case ActionDirect:
+		dialer := net.Dialer{Timeout: cfg.timeouts.Dial}
+		remote, err = dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			c.server.writeReply(localConn, SOCKS5_REPLY_FAILURE)
+			log.Printf("Connection #%d: Failed to connect to %s directly: %v", connID, target, err)
+			return
+		}
+		defer remote.Close()
+		if err := c.server.writeReply(localConn, SOCKS5_REPLY_SUCCESS); err != nil {
+			return
+		}
+		log.Printf("Connection #%d: Connected to %s directly", connID, target)
+
+	default:
+		remote, err = c.openRemote(ctx, connID, pool)
+		if err == nil {
+			defer remote.Close()
+			remote.SetDeadline(cfg.timeouts.handshakeDeadline())
+			err = forwardRequest(remote, route, request)
+			remote.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			c.server.writeReply(localConn, SOCKS5_REPLY_FAILURE)
+			log.Printf("Connection #%d: %v", connID, err)
+			return
+		}
+	}
+
+	log.Printf("Connection #%d: Starting relay", connID)
+	result := relayWith(localConn, remote, relayOptions{idle: cfg.timeouts.Idle})
+	log.Printf("Connection #%d: Closed (%v)", connID, result)
+}
+
+// setupRules creates the remote pools of the rules' named remotes, once
+func (cfg *clientSettings) setupRules() {
+	if cfg.named != nil {
+		return
+	}
+	cfg.named = make(map[string]*remotePool)
+	for name, addrs := range cfg.rules.Remotes() {
+		pool := newRemotePool(addrs)
+		pool.strategy = cfg.remotes.strategy
+		pool.interval = cfg.remotes.interval
+		cfg.named[name] = pool
+	}
+}
+
+// routeFor looks target up in the rules and returns the matching rule, nil
+// for the default action, along with the remotes and route to reach target
+// through unless the rule says otherwise
+func (cfg *clientSettings) routeFor(target string) (*Rule, *remotePool, []string) {
+	if cfg.rules == nil {
+		return nil, cfg.remotes, cfg.route
+	}
+	rule := cfg.rules.Match(target)
+	if rule == nil {
+		return nil, cfg.remotes, cfg.route
+	}
+	switch rule.Action {
+	case ActionRemote:
+		return rule, cfg.named[rule.Remote], rule.Route
+	case ActionRoute:
+		return rule, cfg.remotes, rule.Route
+	}
+	return rule, cfg.remotes, cfg.route
+}
+
+// Dial connects to addr through the tunnel, see DialContext
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the tunnel, following the client's
+// route and rules like a connection to its SOCKS5 port would. It fits
+// net/http.Transport and golang.org/x/net/proxy, and works whether or not
+// the client was started; only started clients health-check their remotes.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	connID := atomic.AddInt32(&c.connCount, 1)
+	cfg := c.settings()
+
+	rule, pool, route := cfg.routeFor(addr)
+	if rule != nil {
+		switch rule.Action {
+		case ActionReject:
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s rejected by rule %q", addr, rule)}
+		case ActionDirect:
+			dialer := net.Dialer{Timeout: cfg.timeouts.Dial}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	remote, err := c.openRemote(ctx, connID, pool)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	// Cancelling ctx cuts the handshake short
+	remote.SetDeadline(cfg.timeouts.handshakeDeadline())
+	stop := context.AfterFunc(ctx, func() { remote.SetDeadline(time.Now()) })
+	err = writeRoute(remote, route)
+	if err == nil {
+		err = NewSOCKS5Client("").handshake(remote, addr)
+	}
+	if !stop() || err != nil {
+		remote.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	remote.SetDeadline(time.Time{})
+	return remote, nil
+}
+
+// forwardRequest sends the route and a SOCKS5 request already read from the
+// local side to the remote server. The remote's reply to the request is
+// left for the relay to pass back.
+func forwardRequest(remote net.Conn, route []string, request []byte) error {
+	if err := writeRoute(remote, route); err != nil {
+		return fmt.Errorf("failed to send route: %v", err)
+	}
+	if _, err := remote.Write([]byte{SOCKS5_VERSION, 0x01, SOCKS5_AUTH_NONE}); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 greeting: %v", err)
+	}
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(remote, response); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 greeting: %v", err)
+	}
+	if response[0] != SOCKS5_VERSION || response[1] != SOCKS5_AUTH_NONE {
+		return fmt.Errorf("remote refused the SOCKS5 greeting")
+	}
+	if _, err := remote.Write(request); err != nil {
+		return fmt.Errorf("failed to send SOCKS5 request: %v", err)
+	}
+	return nil
+}
+
+// openRemote connects to a remote of pool. The default remote goes over the
+// link session when there is one.
+func (c *Client) openRemote(ctx context.Context, connID int32, pool *remotePool) (net.Conn, error) {
+	if c.link != nil && pool == c.settings().remotes {
+		return c.openStream(ctx)
+	}
+	return c.dialRemote(ctx, connID, pool)
+}
+
+// dialRemote opens a new encrypted connection to a remote server, trying
+// the remotes in the order the pool picks until one connects
+func (c *Client) dialRemote(ctx context.Context, connID int32, pool *remotePool) (net.Conn, error) {
+	cfg := c.settings()
+	var remoteConn net.Conn
+	var err error
+	for _, addr := range pool.candidates() {
+		start := time.Now()
+		dialCtx, cancel := context.WithTimeout(ctx, cfg.timeouts.Dial)
+		remoteConn, err = c.transport.Dial(dialCtx, addr)
+		cancel()
+		if err == nil {
+			pool.markUp(addr, time.Since(start))
+			log.Printf("Connection #%d: Connected to remote server %s", connID, addr)
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		pool.markDown(addr, err)
+	}
+	if remoteConn == nil {
+		return nil, fmt.Errorf("failed to connect to remote server: %v", err)
+	}
+
+	// Wrap remote connection with the tunnel cipher
+	rc4Conn, err := wrapCipher(remoteConn, c.cipher, cfg.key)
+	if err != nil {
+		remoteConn.Close()
+		return nil, fmt.Errorf("failed to create encrypted connection: %v", err)
+	}
+
+	if cfg.auth.enabled() {
+		peer, err := cfg.auth.Dial(rc4Conn)
+		if err != nil {
+			rc4Conn.Close()
+			return nil, fmt.Errorf("handshake with %s failed: %v", peer, err)
+		}
+		log.Printf("Connection #%d: Authenticated server %s", connID, peer)
+	}
+
+	return rc4Conn, nil
+}
+
+// probeRemote checks that a remote accepts connections
+func (c *Client) probeRemote(ctx context.Context, addr string) error {
+	conn, err := c.transport.Dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// openStream opens a stream to the remote server over the link session
+func (c *Client) openStream(ctx context.Context) (net.Conn, error) {
+	session, err := c.currentSession()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.settings().timeouts.Dial)
+	defer cancel()
+	return session.OpenStream(ctx)
+}
+
+// currentSession returns the link session, setting up a new one if there is
+// none yet or the previous one ended
+func (c *Client) currentSession() (Session, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if c.session != nil {
+		select {
+		case <-c.session.Done():
+			log.Printf("Tunnel session closed")
+			c.session = nil
+		case <-c.session.GoneAway():
+			// The server closes the old session once its streams are done
+			log.Printf("Tunnel session going away, starting a new one")
+			c.session = nil
+		default:
+			return c.session, nil
+		}
+	}
+
+	conn, err := c.link()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start tunnel: %v", err)
+	}
+
+	cfg := c.settings()
+	rc4Conn, err := wrapCipher(conn, c.cipher, cfg.key)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create encrypted connection: %v", err)
+	}
+
+	if cfg.auth.enabled() {
+		peer, err := cfg.auth.Dial(rc4Conn)
+		if err != nil {
+			rc4Conn.Close()
+			return nil, fmt.Errorf("handshake with %s failed: %v", peer, err)
+		}
+		log.Printf("Authenticated server %s", peer)
+	}
+
+	c.session = NewSession(conn, rc4Conn, true, c.heartbeat)
+	log.Printf("Established tunnel session over %s", conn.RemoteAddr())
+	return c.session, nil
+}
+
+// closeSession closes the link session, if there is one
+func (c *Client) closeSession() {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+}
+
+// Reload applies opts to the client in place. The key, authentication,
+// timeouts, remotes, route, rules and listen addresses change right away;
+// the other settings are kept and logged as taking a restart, as are the
+// remotes of a client on a link. Connections in flight carry on under the
+// settings they started with. Nothing changes when opts are invalid or a new
+// listener fails.
+func (c *Client) Reload(opts ClientOptions) error {
+	next, err := NewClient(opts)
+	if err != nil {
+		return err
+	}
+
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	cfg := next.clientSettings
+	var diff reloadDiff
+	diff.keep("cipher", next.cipher != c.cipher)
+	diff.keep("transport settings", !sameTransport(next.transport, c.transport))
+	diff.keep("heartbeat", next.heartbeat != c.heartbeat)
+	if c.link != nil || next.link != nil {
+		diff.keep("link", (next.link != nil) != (c.link != nil))
+		diff.keep("link command", next.link != nil && c.link != nil && next.linkName != c.linkName)
+		cfg.remoteAddr, cfg.remotes = c.remoteAddr, c.remotes
+	} else if samePolicy(c.remotes, cfg.remotes) && slices.Equal(c.remotes.addrs(), cfg.remotes.addrs()) {
+		// The pool carries on, health state and all
+		cfg.remotes = c.remotes
+	} else {
+		diff.compare("remotes", c.remotes.addrs(), cfg.remotes.addrs())
+		diff.compare("strategy", c.remotes.strategy, cfg.remotes.strategy)
+		diff.compare("health interval", c.remotes.interval, cfg.remotes.interval)
+	}
+	diff.compare("route", strings.Join(c.route, routeSeparator), strings.Join(cfg.route, routeSeparator))
+	diff.compareList("rules", ruleLines(c.rules), ruleLines(cfg.rules))
+	diff.compareList("named remotes", namedRemoteLines(c.rules), namedRemoteLines(cfg.rules))
+	if c.named != nil && slices.Equal(namedRemoteLines(c.rules), namedRemoteLines(cfg.rules)) && samePolicy(c.remotes, next.remotes) {
+		cfg.named = c.named
+	}
+	diff.compare("listen address", c.localAddr, cfg.localAddr)
+	diff.compare("PAC address", c.pacAddr, cfg.pacAddr)
+	diff.compareKey(c.key, cfg.key)
+	diff.compareAuth(c.auth, cfg.auth)
+	diff.compare("timeouts", c.timeouts, cfg.timeouts)
+
+	var moves listenerMoves
+	var monitors context.CancelFunc
+	_, err = c.life.within(func(r *run) error {
+		err := moves.open(&c.local, cfg.localAddr, func(addr string) (*acceptor, error) {
+			return c.listen(r, addr)
+		})
+		if err == nil {
+			err = moves.open(&c.pac, cfg.pacAddr, func(addr string) (*acceptor, error) {
+				return c.startPAC(r, addr)
+			})
+		}
+		if err == nil && (cfg.remotes != c.remotes || !maps.Equal(cfg.named, c.named)) {
+			monitors = c.monitorRemotes(r, cfg)
+		}
+		return err
+	})
+	if err != nil {
+		moves.abort()
+		return err
+	}
+	if monitors != nil {
+		c.monitors()
+		c.monitors = monitors
+	}
+
+	c.mu.Lock()
+	replaced := moves.commit()
+	c.clientSettings = cfg
+	c.mu.Unlock()
+	stopAcceptors(replaced)
+
+	diff.log("Client")
+	return nil
+}
+
+// Shutdown gracefully shuts down the client. It stops accepting and waits
+// for the connections in flight until ctx ends, then cuts them off. Calling
+// it on a client that isn't running does nothing.
+func (c *Client) Shutdown(ctx context.Context) error {
+	log.Printf("Shutting down client...")
+
+	err := c.life.shutdown(ctx)
+	if err != nil {
+		log.Printf("Shutdown timeout reached, forcing close")
+	} else {
+		log.Printf("All client connections closed")
+	}
+	return err
+}
+
+// Drain stops the client from accepting while the connections in flight
+// carry on. Start returns once all of them are done. Drain waits for that
+// until ctx ends; Shutdown cuts off whatever is left.
+func (c *Client) Drain(ctx context.Context) error {
+	log.Printf("Draining client...")
+	return c.life.drain(ctx)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package pivot
+
+import "time"
+
+// processCPUTime isn't available on this platform
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
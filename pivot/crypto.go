@@ -1,11 +1,31 @@
-package main
+package pivot
 
 import (
 	"crypto/rc4"
+	"errors"
+	"fmt"
 	"net"
 	"time"
 )
 
+// Tunnel ciphers
+const (
+	CipherRC4  = "rc4"
+	CipherNone = "none" // only for transports that encrypt on their own, such as TLS
+)
+
+// wrapCipher applies the tunnel cipher to a transport connection
+func wrapCipher(conn net.Conn, cipher, key string) (net.Conn, error) {
+	switch cipher {
+	case CipherRC4, "":
+		return NewRC4Conn(conn, key)
+	case CipherNone:
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unknown cipher: %s", cipher)
+	}
+}
+
 // RC4Stream provides encryption/decryption functionality
 type RC4Stream struct {
 	cipher *rc4.Cipher
@@ -56,24 +76,56 @@ func NewRC4Conn(conn net.Conn, key string) (*RC4Conn, error) {
 	}, nil
 }
 
-// Read reads and decrypts data
-func (rc *RC4Conn) Read(p []byte) (n int, err error) {
-	n, err = rc.conn.Read(p)
+// Rekey replaces the shared tunnel key with per-direction session keys
+func (rc *RC4Conn) Rekey(sendKey, recvKey []byte) error {
+	encStream, err := NewRC4Stream(string(sendKey))
+	if err != nil {
+		return err
+	}
+
+	decStream, err := NewRC4Stream(string(recvKey))
 	if err != nil {
-		return n, err
+		return err
 	}
 
+	rc.encStream = encStream
+	rc.decStream = decStream
+	return nil
+}
+
+// Read reads and decrypts data. Some transports, such as QUIC streams,
+// return the final bytes together with io.EOF, so data is decrypted before
+// the error is looked at.
+func (rc *RC4Conn) Read(p []byte) (n int, err error) {
+	n, err = rc.conn.Read(p)
 	rc.decStream.Decrypt(p[:n])
-	return n, nil
+	return n, err
 }
 
-// Write encrypts and writes data
+// Write encrypts and writes data. p is left untouched, so it is encrypted
+// into pooled buffers a chunk at a time.
 func (rc *RC4Conn) Write(p []byte) (n int, err error) {
-	encrypted := make([]byte, len(p))
-	copy(encrypted, p)
-	rc.encStream.Encrypt(encrypted)
+	bufp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bufp)
+	buf := *bufp
+
+	for n < len(p) {
+		chunk := min(len(p)-n, len(buf))
+		rc.encStream.cipher.XORKeyStream(buf[:chunk], p[n:n+chunk])
+		written, err := rc.conn.Write(buf[:chunk])
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
 
-	return rc.conn.Write(encrypted)
+// writeInPlace encrypts p in place and writes it, for callers that are done
+// with p such as the relay
+func (rc *RC4Conn) writeInPlace(p []byte) (int, error) {
+	rc.encStream.Encrypt(p)
+	return rc.conn.Write(p)
 }
 
 // Close closes the underlying connection
@@ -81,6 +133,19 @@ func (rc *RC4Conn) Close() error {
 	return rc.conn.Close()
 }
 
+// CloseWrite half-closes the underlying connection if it supports that
+func (rc *RC4Conn) CloseWrite() error {
+	if cw, ok := rc.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// reset aborts the underlying connection
+func (rc *RC4Conn) reset() error {
+	return resetConn(rc.conn)
+}
+
 // LocalAddr returns the local network address
 func (rc *RC4Conn) LocalAddr() net.Addr {
 	return rc.conn.LocalAddr()
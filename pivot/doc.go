@@ -0,0 +1,10 @@
+// Package pivot implements the encrypted SOCKS5 tunnel behind the
+// pivot-internal command: the server that reaches targets, the agent that
+// relays for servers dialing out from inside a network, and the client that
+// serves SOCKS5 locally or dials through the tunnel directly.
+//
+// Each role is created from an options struct, started with Start and a
+// context, and stopped with Shutdown. A Client also works as a dialer
+// without being started; its DialContext fits net/http.Transport and
+// golang.org/x/net/proxy.
+package pivot
@@ -0,0 +1,142 @@
+package pivot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Internal domain reporting. A client asks the server at the end of its route
+// which internal domains it knows by sending domainsMarker in place of the
+// SOCKS5 greeting. The server answers with one domain per line and closes the
+// stream. The client builds its PAC file from them.
+
+const (
+	// domainsMarker opens a domains query. Like routeMarker it can't be
+	// mistaken for the SOCKS5 version byte.
+	domainsMarker = 0xF1
+
+	maxDomainsReply = 16 * 1024
+)
+
+// resolvConf lists the DNS search domains on Unix systems
+var resolvConf = "/etc/resolv.conf"
+
+// checkDomain validates a domain name reported by a server or set with -domains
+func checkDomain(domain string) error {
+	if domain == "" || len(domain) > 253 {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	for _, c := range domain {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// normalizeDomain lowercases a domain and strips leading and trailing dots
+func normalizeDomain(domain string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// localDomains returns the internal domains of the machine's DNS setup: the
+// search and domain entries of resolv.conf, or the logon domain on Windows
+func localDomains() []string {
+	if runtime.GOOS == "windows" {
+		if domain := normalizeDomain(os.Getenv("USERDNSDOMAIN")); checkDomain(domain) == nil {
+			return []string{domain}
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil
+	}
+
+	var domains []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "search" && fields[0] != "domain") {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			if domain = normalizeDomain(domain); checkDomain(domain) == nil {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	return domains
+}
+
+// mergeDomains joins domain lists, dropping duplicates
+func mergeDomains(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, list := range lists {
+		for _, domain := range list {
+			if !seen[domain] {
+				seen[domain] = true
+				merged = append(merged, domain)
+			}
+		}
+	}
+	return merged
+}
+
+// readDomainsQuery checks whether conn starts with a domains query and
+// consumes the marker if so. The returned connection must be used for the
+// rest of the stream.
+func readDomainsQuery(conn net.Conn) (net.Conn, bool, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	if first[0] != domainsMarker {
+		return wrapBuffered(conn, br), false, nil
+	}
+	br.Discard(1)
+	return wrapBuffered(conn, br), true, nil
+}
+
+// writeDomains answers a domains query
+func writeDomains(w io.Writer, domains []string) error {
+	var reply strings.Builder
+	for _, domain := range domains {
+		reply.WriteString(domain)
+		reply.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, reply.String())
+	return err
+}
+
+// queryDomains sends a domains query over conn and reads the answer. A server
+// that doesn't know the query closes the stream, which reads as no domains.
+func queryDomains(conn net.Conn) ([]string, error) {
+	if _, err := conn.Write([]byte{domainsMarker}); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(conn, maxDomainsReply))
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if domain := normalizeDomain(line); domain != "" {
+			if err := checkDomain(domain); err != nil {
+				return nil, err
+			}
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
@@ -0,0 +1,431 @@
+package pivot
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errFaultCut is returned by reads on a connection a fault has cut
+var errFaultCut = errors.New("connection cut by fault injection")
+
+// faultPlan describes how a faultConn misbehaves from the start
+type faultPlan struct {
+	latency   time.Duration // delay before every write goes out
+	bandwidth float64       // bytes per second each way, 0 for unlimited
+	cutAfter  int64         // bytes read before the connection is cut, 0 never
+	reset     bool          // cut with a TCP reset rather than a close
+}
+
+// faultConn wraps a connection and injects the faults of its plan, plus the
+// ones a test triggers while it runs: stalled reads and cuts
+type faultConn struct {
+	net.Conn
+	plan   faultPlan
+	reader io.Reader
+	writes *tokenBucket
+	read   atomic.Int64
+
+	mu     sync.Mutex
+	resume chan struct{} // closed when stalled reads go on, nil while they flow
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFaultConn(conn net.Conn, plan faultPlan) *faultConn {
+	c := &faultConn{Conn: conn, plan: plan, reader: conn, closed: make(chan struct{})}
+	if plan.bandwidth > 0 {
+		burst := min(plan.bandwidth, relayBufferSize)
+		c.reader = shapeReader(conn, newTokenBucket(plan.bandwidth, burst), c.closed)
+		c.writes = newTokenBucket(plan.bandwidth, burst)
+	}
+	return c
+}
+
+// Read holds data back while reads are stalled and cuts the connection once
+// the plan's byte count has been read
+func (c *faultConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if err := c.waitStall(); err != nil {
+		return 0, err
+	}
+
+	if c.plan.cutAfter > 0 {
+		total := c.read.Add(int64(n))
+		if total >= c.plan.cutAfter {
+			n -= int(total - c.plan.cutAfter)
+			c.cut()
+			return max(n, 0), errFaultCut
+		}
+	}
+	return n, err
+}
+
+// Write delays and throttles data on its way out
+func (c *faultConn) Write(p []byte) (n int, err error) {
+	time.Sleep(c.plan.latency)
+	for n < len(p) {
+		chunk := len(p) - n
+		if c.writes != nil {
+			chunk = min(chunk, int(c.writes.burst))
+			if !c.writes.wait(chunk, c.closed) {
+				return n, net.ErrClosed
+			}
+		}
+		written, err := c.Conn.Write(p[n : n+chunk])
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *faultConn) waitStall() error {
+	c.mu.Lock()
+	resume := c.resume
+	c.mu.Unlock()
+
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// stall holds back everything read from now on, as a peer that stopped
+// answering would, without closing anything
+func (c *faultConn) stall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume == nil {
+		c.resume = make(chan struct{})
+	}
+}
+
+// unstall lets stalled reads go on
+func (c *faultConn) unstall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+// cut drops the connection as a broken network would, with a reset if the
+// plan says so
+func (c *faultConn) cut() {
+	if c.plan.reset {
+		c.reset()
+	} else {
+		c.Close()
+	}
+}
+
+func (c *faultConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *faultConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *faultConn) reset() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return resetConn(c.Conn)
+}
+
+// faultListener hands out faultConns following plan and keeps track of them,
+// so a test can break every connection at once. Closing it takes the host
+// down: the listener closes and every connection it accepted is cut.
+type faultListener struct {
+	net.Listener
+	plan faultPlan
+
+	// refuse resets connections as soon as they arrive, counting them in
+	// refused, as a host that is up but not serving would
+	refuse  atomic.Bool
+	refused atomic.Int32
+
+	mu    sync.Mutex
+	conns []*faultConn
+}
+
+func newFaultListener(listener net.Listener, plan faultPlan) *faultListener {
+	return &faultListener{Listener: listener, plan: plan}
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.refuse.Load() {
+			l.refused.Add(1)
+			resetConn(conn)
+			continue
+		}
+
+		fc := newFaultConn(conn, l.plan)
+		l.mu.Lock()
+		l.conns = append(l.conns, fc)
+		l.mu.Unlock()
+		return fc, nil
+	}
+}
+
+// accepted returns how many connections were let through
+func (l *faultListener) accepted() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns)
+}
+
+func (l *faultListener) each(f func(*faultConn)) {
+	l.mu.Lock()
+	conns := append([]*faultConn(nil), l.conns...)
+	l.mu.Unlock()
+
+	for _, c := range conns {
+		f(c)
+	}
+}
+
+// cutAll cuts every connection accepted so far
+func (l *faultListener) cutAll() { l.each((*faultConn).cut) }
+
+// stallAll stalls reads on every connection accepted so far
+func (l *faultListener) stallAll() { l.each((*faultConn).stall) }
+
+func (l *faultListener) Close() error {
+	err := l.Listener.Close()
+	l.cutAll()
+	return err
+}
+
+// startFaultProxy forwards loopback connections to target through a
+// faultListener and returns it with the address to dial instead of target.
+// It stands in for the network between two roles; the faults apply to the
+// side facing whoever dials the proxy.
+func startFaultProxy(t *testing.T, target string, plan faultPlan) (*faultListener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	faults := newFaultListener(listener, plan)
+	t.Cleanup(func() { faults.Close() })
+
+	go serveConns(faults, func(conn net.Conn) {
+		defer conn.Close()
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			resetConn(conn)
+			return
+		}
+		defer upstream.Close()
+		relay(conn, upstream)
+	})
+	return faults, listener.Addr().String()
+}
+
+func TestFaultConnCut(t *testing.T) {
+	client, server := tcpPair(t)
+	faulty := newFaultConn(server, faultPlan{cutAfter: 100, reset: true})
+
+	go client.Write(make([]byte, 1000))
+	got, err := io.ReadAll(faulty)
+	if len(got) != 100 || !errors.Is(err, errFaultCut) {
+		t.Fatalf("Expected a cut after 100 bytes, got %d bytes and %v", len(got), err)
+	}
+
+	// The peer sees the reset, not an orderly close
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Expected the peer to see a reset, got %v", err)
+	}
+}
+
+func TestFaultConnStall(t *testing.T) {
+	client, server := tcpPair(t)
+	faulty := newFaultConn(server, faultPlan{})
+	faulty.stall()
+
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := faulty.Read(buf)
+		read <- buf[:n]
+	}()
+
+	client.Write([]byte("ping"))
+	select {
+	case got := <-read:
+		t.Fatalf("Read %q through a stalled connection", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	faulty.unstall()
+	select {
+	case got := <-read:
+		if string(got) != "ping" {
+			t.Errorf("Expected the held back data after resuming, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't go on after resuming")
+	}
+
+	// Closing ends a stalled read too
+	faulty.stall()
+	done := make(chan error, 1)
+	go func() {
+		_, err := faulty.Read(make([]byte, 16))
+		done <- err
+	}()
+	client.Write([]byte("pong"))
+	time.Sleep(50 * time.Millisecond)
+	faulty.Close()
+	if err := <-done; err == nil {
+		t.Error("Expected a stalled read to fail once closed")
+	}
+}
+
+func TestFaultConnShaping(t *testing.T) {
+	client, server := tcpPair(t)
+	faulty := newFaultConn(server, faultPlan{latency: 50 * time.Millisecond, bandwidth: 64 << 10})
+
+	start := time.Now()
+	go io.Copy(io.Discard, client)
+	if _, err := faulty.Write(make([]byte, 64<<10)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The first 32 KiB go out at once, the rest at the limited rate
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected 64 KiB at 64 KiB/s to take about 550ms, took %v", elapsed)
+	}
+}
+
+func TestResilienceVictimReconnects(t *testing.T) {
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent()
+	faults, link := startFaultProxy(t, internalAddr, faultPlan{reset: true})
+	h.startVictim(agent, link, func(s *Server) {
+		s.backoff = &Backoff{Initial: 20 * time.Millisecond, Max: 100 * time.Millisecond}
+	})
+	proxy, _ := h.startClient(clientAddr)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 64<<10)
+	first := agent.victims.get("")
+
+	// The link drops and stays down for a few reconnect attempts
+	faults.refuse.Store(true)
+	faults.cutAll()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the stream to end with the link")
+	}
+	h.waitFor("the victim to retry", func() bool { return faults.refused.Load() >= 2 })
+
+	faults.refuse.Store(false)
+	h.waitFor("the victim to reconnect", func() bool {
+		victim := agent.victims.get("")
+		return victim != nil && victim != first
+	})
+
+	again, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect after reconnecting failed: %v", err)
+	}
+	defer again.Close()
+	h.echo(again, 64<<10)
+}
+
+func TestResilienceAgentDropsStalledVictim(t *testing.T) {
+	heartbeat := HeartbeatConfig{Interval: 50 * time.Millisecond, Misses: 3}
+
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent(func(a *Agent) { a.heartbeat = heartbeat })
+	faults, link := startFaultProxy(t, internalAddr, faultPlan{latency: 5 * time.Millisecond})
+	h.startVictim(agent, link, func(s *Server) { s.heartbeat = heartbeat })
+	proxy, _ := h.startClient(clientAddr)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 1024)
+	first := agent.victims.get("")
+
+	// Nothing from the victim gets through any more, but nothing closes
+	// either, so only missed heartbeats tell the agent the link is dead
+	faults.stallAll()
+	h.waitFor("the agent to drop the victim", func() bool { return agent.victims.get("") != first })
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the stream to end with the victim's session")
+	}
+
+	// The victim notices too and comes back over a fresh connection
+	h.waitFor("the victim to reconnect", func() bool { return agent.victims.get("") != nil })
+	again, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect after reconnecting failed: %v", err)
+	}
+	defer again.Close()
+	h.echo(again, 1024)
+}
+
+func TestResilienceClientFailover(t *testing.T) {
+	h := newHarness(t)
+	first, _ := h.startServer()
+	second, _ := h.startServer()
+	faults1, link1 := startFaultProxy(t, first, faultPlan{cutAfter: 256 << 10, reset: true})
+	faults2, link2 := startFaultProxy(t, second, faultPlan{bandwidth: 4 << 20})
+	proxy, _ := h.startClient(link1 + "," + link2)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 1024)
+	before := faults2.accepted()
+
+	// The first remote's link breaks in the middle of a transfer
+	go conn.Write(make([]byte, 1<<20))
+	if _, err := io.ReadFull(conn, make([]byte, 1<<20)); err == nil {
+		t.Fatal("Expected the transfer to fail when the link was cut")
+	}
+
+	// and then its host goes away, so new streams take the second remote
+	faults1.Close()
+	again, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect after failing over failed: %v", err)
+	}
+	defer again.Close()
+	h.echo(again, 256<<10)
+
+	if faults2.accepted() == before {
+		t.Error("Expected the second remote to carry the new stream")
+	}
+}
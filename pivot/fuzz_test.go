@@ -0,0 +1,302 @@
+package pivot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fuzzConn serves fuzz input as the bytes sent by the peer, ending in a clean
+// EOF. Anything written to it is kept in writeData.
+type fuzzConn struct {
+	mockConn
+}
+
+func newFuzzConn(data []byte) *fuzzConn {
+	return &fuzzConn{mockConn{readData: data}}
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error) {
+	if c.readPos >= len(c.readData) {
+		return 0, io.EOF
+	}
+	return c.mockConn.Read(p)
+}
+
+// capture decodes a hex dump of bytes seen on the wire
+func capture(s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Requests sent by curl to a SOCKS proxy. Only SOCKS5 is supported, the
+// SOCKS4 and HTTP requests are there to be refused at the greeting.
+var socksCaptures = []string{
+	"050200 01 050100017f0000011f90",                                            // socks5://, IPv4 target
+	"050200 01 0501000400000000000000000000000000000001 01bb",                   // socks5://, IPv6 target
+	"050200 01 05010003106578616d706c652e696e7465726e616c1f90",                  // socks5h://, domain target
+	"04011f907f00000100",                                                        // socks4://, refused
+	"04011f9000000001006578616d706c652e696e7465726e616c00",                      // socks4a://, refused
+	hex.EncodeToString([]byte("CONNECT example.internal:443 HTTP/1.1\r\n\r\n")), // HTTP proxy request, refused
+}
+
+func FuzzSOCKS5Request(f *testing.F) {
+	for _, c := range socksCaptures {
+		f.Add(capture(c))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{SOCKS5_VERSION, 0xFF})
+	f.Add(capture("050100 050100030000 0050"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newFuzzConn(data)
+		var s SOCKS5Server
+		if err := s.handleAuth(conn); err != nil {
+			return
+		}
+		if data[0] != SOCKS5_VERSION {
+			t.Fatalf("Accepted a greeting for SOCKS version %d", data[0])
+		}
+
+		target, request, err := s.readRequest(conn)
+		if err != nil {
+			return
+		}
+
+		// The request handed on to another server is exactly what was read
+		start := 2 + int(data[1])
+		if !bytes.Equal(request, data[start:start+len(request)]) {
+			t.Fatalf("Recorded request %x differs from the input", request)
+		}
+		if !strings.Contains(target, ":") {
+			t.Fatalf("Target %q has no port", target)
+		}
+	})
+}
+
+func FuzzServerSOCKS5(f *testing.F) {
+	for _, c := range socksCaptures {
+		f.Add(capture(c))
+	}
+	f.Add(capture("050100 05010005"))
+	f.Add(capture("050100 05010003ff"))
+	f.Add(capture("050100 05020001000000000000"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, conn := net.Pipe()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		replies := make(chan []byte, 1)
+		go func() {
+			reply, _ := io.ReadAll(client)
+			replies <- reply
+		}()
+
+		var dialed string
+		s := newServer("", "")
+		s.dialTarget = func(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+			dialed = addr
+			target, peer := net.Pipe()
+			peer.Close()
+			return target, nil
+		}
+
+		var target net.Conn
+		err := s.handleSOCKS5Auth(conn)
+		if err == nil {
+			target, err = s.handleSOCKS5Connect(context.Background(), conn, time.Second)
+		}
+		conn.Close()
+		reply := <-replies
+		if target != nil {
+			target.Close()
+		}
+
+		if len(reply) >= 2 && !bytes.Equal(reply[:2], []byte{SOCKS5_VERSION, 0x00}) {
+			t.Fatalf("Greeting answered with %x", reply[:2])
+		}
+		if dialed == "" {
+			if err == nil {
+				t.Fatal("Connected without dialing")
+			}
+			return
+		}
+
+		// A target is only dialed for a complete SOCKS5 CONNECT request,
+		// and on the port it names
+		start := 2 + int(data[1])
+		request := data[start:]
+		end := 4
+		switch request[3] {
+		case SOCKS5_IPV4:
+			end += net.IPv4len + 2
+		case SOCKS5_DOMAIN:
+			end += 1 + int(request[4]) + 2
+		case SOCKS5_IPV6:
+			end += net.IPv6len + 2
+		default:
+			t.Fatalf("Dialed %q for address type %d", dialed, request[3])
+		}
+		if data[0] != SOCKS5_VERSION || request[0] != SOCKS5_VERSION || request[1] != SOCKS5_CONNECT || len(request) < end {
+			t.Fatalf("Dialed %q for request %x", dialed, request)
+		}
+		port := strconv.Itoa(int(binary.BigEndian.Uint16(request[end-2:])))
+		if !strings.HasSuffix(dialed, ":"+port) {
+			t.Fatalf("Dialed %q, expected port %s", dialed, port)
+		}
+	})
+}
+
+func FuzzSOCKS5Reply(f *testing.F) {
+	f.Add(capture("0500 05000001000000000000"), false)                          // this server's success reply
+	f.Add(capture("0500 05010001000000000000"), false)                          // this server's failure reply
+	f.Add(capture("0500 0500000400000000000000000000000000000001 1f90"), false) // bound IPv6 address
+	f.Add(capture("0500 05000003096c6f63616c686f7374 1f90"), false)             // bound domain
+	f.Add(capture("0502 0100 05000001000000000000"), true)                      // username/password accepted
+	f.Add(capture("0502 0101"), true)                                           // username/password refused
+	f.Add(capture("05ff"), false)                                               // no acceptable method
+
+	f.Fuzz(func(t *testing.T, data []byte, auth bool) {
+		client := NewSOCKS5Client("")
+		if auth {
+			client.SetAuth("user", "pass")
+		}
+		client.handshake(newFuzzConn(data), "example.internal:8080")
+	})
+}
+
+func FuzzReadRoute(f *testing.F) {
+	var buf bytes.Buffer
+	writeRoute(&buf, []string{"dmz", "db"})
+	f.Add(append(buf.Bytes(), capture(socksCaptures[2])...))
+	f.Add(capture(socksCaptures[0]))
+	f.Add([]byte{routeMarker, 0xFF, 'a'})
+	f.Add([]byte{routeMarker, 3, ',', ',', ','})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn, route, err := readRoute(newFuzzConn(data))
+		if err != nil {
+			return
+		}
+
+		consumed := 0
+		if data[0] == routeMarker {
+			consumed = 2 + int(data[1])
+		}
+		for _, hop := range route {
+			if err := checkHopName(hop); err != nil {
+				t.Fatalf("Route %q has an invalid hop: %v", route, err)
+			}
+		}
+
+		// Whatever follows the route is left for the stream
+		rest, _ := io.ReadAll(conn)
+		if !bytes.Equal(rest, data[consumed:]) {
+			t.Fatalf("Stream after the route is %x, expected %x", rest, data[consumed:])
+		}
+	})
+}
+
+func FuzzQueryDomains(f *testing.F) {
+	f.Add([]byte("corp.example\nlab.corp.example\n"))
+	f.Add([]byte(""))
+	f.Add([]byte("bad domain\n"))
+	f.Add(bytes.Repeat([]byte("a."), maxDomainsReply))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		domains, err := queryDomains(newFuzzConn(data))
+		if err != nil {
+			return
+		}
+		for _, domain := range domains {
+			if err := checkDomain(domain); err != nil {
+				t.Fatalf("Accepted invalid domain %q: %v", domain, err)
+			}
+		}
+	})
+}
+
+// muxCapture records what a client session sends for one short stream
+func muxCapture(f *testing.F) []byte {
+	local, remote := net.Pipe()
+	captured := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(remote)
+		captured <- data
+	}()
+
+	session := newMuxSession(local, true, HeartbeatConfig{})
+	stream, err := session.OpenStream(context.Background())
+	if err != nil {
+		f.Fatalf("Failed to open stream: %v", err)
+	}
+	stream.Write(capture(socksCaptures[2]))
+	stream.(*muxStream).CloseWrite()
+	session.Close()
+	return <-captured
+}
+
+func FuzzMuxSession(f *testing.F) {
+	f.Add(muxCapture(f))
+	f.Add(capture("06 00000000 0008 0102030405060708"))                  // ping
+	f.Add(capture("01 00000001 0000 02 00000001 8001"))                  // data frame over the payload limit
+	f.Add(capture("01 00000001 0000 03 00000001 0004 ffffffff"))         // huge window grant
+	f.Add(capture("01 00000001 0000 01 00000001 0000 05 00000001 0000")) // duplicate open, reset
+	f.Add(capture("01 00000002 0000"))                                   // open with the server's parity
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		session := newMuxSession(newFuzzConn(data), false, HeartbeatConfig{})
+		defer session.Close()
+
+		// Drain every stream the input opens
+		go func() {
+			for {
+				stream, err := session.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go io.Copy(io.Discard, stream)
+			}
+		}()
+
+		select {
+		case <-session.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Session didn't end with its input")
+		}
+	})
+}
+
+func FuzzWebSocketFrames(f *testing.F) {
+	// Frames as this code sends them, masked like a client's
+	client := newWSConn(&mockConn{}, true)
+	client.Write(capture(socksCaptures[2]))
+	client.writeFrame(wsOpPing, []byte("hi"))
+	client.Close()
+	f.Add(client.Conn.(*mockConn).writeData, false)
+
+	f.Add(capture("82 05 68656c6c6f"), true)       // unmasked binary frame from a server
+	f.Add(capture("82 7f ffffffffffffffff"), true) // 64-bit length with no payload
+	f.Add(capture("89 7e 0100"), true)             // ping over the control frame limit
+	f.Add(capture("88 82 01020304 0000"), false)   // masked close frame
+
+	f.Fuzz(func(t *testing.T, data []byte, isClient bool) {
+		conn := newWSConn(newFuzzConn(data), isClient)
+		n, _ := io.Copy(io.Discard, conn)
+		if n > int64(len(data)) {
+			t.Fatalf("Read %d payload bytes out of %d input bytes", n, len(data))
+		}
+	})
+}
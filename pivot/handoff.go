@@ -0,0 +1,428 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handoffEnv passes the listeners handed off to a new process, as
+// comma-separated address=descriptor pairs. The addresses of QUIC sockets
+// carry handoffUDPPrefix.
+const (
+	handoffEnv       = "PIVOT_LISTENERS"
+	handoffUDPPrefix = "udp:"
+)
+
+// readyEnv passes the descriptor of the pipe a new process reports on once
+// its roles have opened their listeners
+const readyEnv = "PIVOT_READY"
+
+// releasedEnv passes a pipe for each QUIC socket handed off, as
+// address=descriptor pairs. The old process closes the pipe once it has
+// closed its copy of the socket, so the new one can start reading it.
+const releasedEnv = "PIVOT_RELEASED"
+
+// handoff tracks the TCP listeners and QUIC sockets of this process by the
+// address they were opened for, and those inherited from the process it
+// replaced
+var handoff struct {
+	mu           sync.Mutex
+	active       map[string]*net.TCPListener
+	inherited    map[string]*net.TCPListener
+	activeUDP    map[string]*net.UDPConn
+	inheritedUDP map[string]*net.UDPConn
+	ready        *os.File // the pipe to report on, nil once reported
+
+	// A QUIC socket is read by one process at a time. The old process
+	// keeps the release pipes of each QUIC socket it has open and closes
+	// them with it, and the new one closes the socket's released channel
+	// when it sees that.
+	release  map[*net.UDPConn][]*os.File
+	released map[string]chan struct{}
+}
+
+// handoffListener is a TCP listener Handoff can pass on while it is open
+type handoffListener struct {
+	*net.TCPListener
+	addr string
+}
+
+// Close stops tracking the listener and closes it
+func (l *handoffListener) Close() error {
+	handoff.mu.Lock()
+	if handoff.active[l.addr] == l.TCPListener {
+		delete(handoff.active, l.addr)
+	}
+	handoff.mu.Unlock()
+	return l.TCPListener.Close()
+}
+
+// listenTCP listens on addr. A listener inherited for addr is taken over
+// rather than binding the address again.
+func listenTCP(addr string) (net.Listener, error) {
+	handoff.mu.Lock()
+	listener := handoff.inherited[addr]
+	delete(handoff.inherited, addr)
+	handoff.mu.Unlock()
+
+	if listener == nil {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener = l.(*net.TCPListener)
+	}
+
+	handoff.mu.Lock()
+	if handoff.active == nil {
+		handoff.active = make(map[string]*net.TCPListener)
+	}
+	handoff.active[addr] = listener
+	handoff.mu.Unlock()
+	return &handoffListener{TCPListener: listener, addr: addr}, nil
+}
+
+// handoffPacketConn is a QUIC socket Handoff can pass on until it is released
+type handoffPacketConn struct {
+	*net.UDPConn
+	addr string
+
+	// Closed once the process that handed the socket over has let go of
+	// it, nil for a socket this process opened itself
+	released <-chan struct{}
+}
+
+// release stops tracking the socket, which stays open for the connections
+// still using it
+func (c *handoffPacketConn) release() {
+	handoff.mu.Lock()
+	if handoff.activeUDP[c.addr] == c.UDPConn {
+		delete(handoff.activeUDP, c.addr)
+	}
+	handoff.mu.Unlock()
+}
+
+// Close stops tracking the socket and closes it. A process the socket was
+// handed off to starts reading it then.
+func (c *handoffPacketConn) Close() error {
+	c.release()
+	err := c.UDPConn.Close()
+
+	handoff.mu.Lock()
+	closeFiles(handoff.release[c.UDPConn])
+	delete(handoff.release, c.UDPConn)
+	handoff.mu.Unlock()
+	return err
+}
+
+// listenUDP opens the QUIC socket for addr, taking over one inherited for
+// addr like listenTCP does. An inherited socket mustn't be read before its
+// released channel is closed.
+func listenUDP(addr string) (*handoffPacketConn, error) {
+	handoff.mu.Lock()
+	conn := handoff.inheritedUDP[addr]
+	delete(handoff.inheritedUDP, addr)
+	var released <-chan struct{}
+	if conn != nil {
+		released = handoff.released[addr]
+	}
+	delete(handoff.released, addr)
+	handoff.mu.Unlock()
+
+	if conn == nil {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	handoff.mu.Lock()
+	if handoff.activeUDP == nil {
+		handoff.activeUDP = make(map[string]*net.UDPConn)
+	}
+	handoff.activeUDP[addr] = conn
+	if handoff.release == nil {
+		handoff.release = make(map[*net.UDPConn][]*os.File)
+	}
+	handoff.release[conn] = nil // open, with nothing to release yet
+	handoff.mu.Unlock()
+	return &handoffPacketConn{UDPConn: conn, addr: addr, released: released}, nil
+}
+
+// filer is implemented by sockets that can be duplicated into a file
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Handoff starts cmd, usually a new build of this program, with a copy of
+// every TCP listener and QUIC socket this process serves on. Once cmd adopts
+// them with InheritListeners, both processes accept on the same TCP
+// listeners, so this one can drain without refusing a single connection. A
+// QUIC socket carries the packets of every connection on it and can't be
+// shared that way, so cmd only starts reading each QUIC socket once this
+// process has closed it, after the QUIC connections on it have ended. The
+// socket stays bound meanwhile, and new QUIC connections complete their
+// handshakes then.
+//
+// Handoff returns once a role of cmd has started on the listeners, so this
+// process can go on to drain. If cmd exits first, or ctx ends first, which
+// kills cmd, Handoff waits for cmd and fails; this process should carry on
+// serving then. Otherwise the caller waits for cmd.
+func Handoff(ctx context.Context, cmd *exec.Cmd) error {
+	handoff.mu.Lock()
+	var pairs []string
+	var files []*os.File
+	add := func(name string, socket filer) error {
+		file, err := socket.File()
+		if err != nil {
+			return fmt.Errorf("failed to hand off %s: %v", name, err)
+		}
+		// Extra files start at descriptor 3 in the new process
+		fd := 3 + len(cmd.ExtraFiles) + len(files)
+		pairs = append(pairs, name+"="+strconv.Itoa(fd))
+		files = append(files, file)
+		return nil
+	}
+	for addr, listener := range handoff.active {
+		if err := add(addr, listener); err != nil {
+			handoff.mu.Unlock()
+			closeFiles(files)
+			return err
+		}
+	}
+	sockets := make(map[string]*net.UDPConn, len(handoff.activeUDP))
+	for addr, conn := range handoff.activeUDP {
+		if err := add(handoffUDPPrefix+addr, conn); err != nil {
+			handoff.mu.Unlock()
+			closeFiles(files)
+			return err
+		}
+		sockets[addr] = conn
+	}
+	handoff.mu.Unlock()
+	defer closeFiles(files)
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+	cmd.Env = append(cmd.Env, handoffEnv+"="+strings.Join(pairs, ","))
+
+	// Only cmd holds the other ends of the pipes once it has started, so
+	// they end when cmd does
+	var ends []*os.File
+	defer func() { closeFiles(ends) }()
+
+	ready, report, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	cmd.Env = append(cmd.Env, readyEnv+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, report)
+	ends = append(ends, report)
+
+	// cmd starts reading each QUIC socket once its release pipe is closed,
+	// right away when the handoff fails
+	release := make(map[*net.UDPConn]*os.File, len(sockets))
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			for _, file := range release {
+				file.Close()
+			}
+		}
+	}()
+	var released []string
+	for addr, conn := range sockets {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		release[conn] = w
+		released = append(released, addr+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		ends = append(ends, r)
+	}
+	if len(released) > 0 {
+		cmd.Env = append(cmd.Env, releasedEnv+"="+strings.Join(released, ","))
+	}
+
+	err = cmd.Start()
+	closeFiles(ends)
+	ends = nil
+	if err != nil {
+		return err
+	}
+
+	reported := make(chan bool, 1)
+	go func() {
+		n, _ := ready.Read(make([]byte, 1))
+		reported <- n == 1
+	}()
+	select {
+	case ok := <-reported:
+		if ok {
+			handedOff = true
+			releaseOnClose(release)
+			return nil
+		}
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return fmt.Errorf("new process stopped before it was ready: %v", err)
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process wasn't ready in time: %v", ctx.Err())
+	}
+}
+
+// releaseOnClose closes the release pipe of each QUIC socket once this
+// process closes the socket, right away if it already has
+func releaseOnClose(release map[*net.UDPConn]*os.File) {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+	for conn, file := range release {
+		if _, open := handoff.release[conn]; open {
+			handoff.release[conn] = append(handoff.release[conn], file)
+		} else {
+			file.Close()
+		}
+	}
+}
+
+// reportReady tells the process that handed its listeners off to this one
+// that a role has started on them, once. The inherited listeners and QUIC
+// sockets the role didn't take over are closed then, as nothing else will.
+func reportReady() {
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+	for addr, listener := range handoff.inherited {
+		log.Printf("Closing the inherited listener for %s, which nothing listens on", addr)
+		listener.Close()
+	}
+	for addr, conn := range handoff.inheritedUDP {
+		log.Printf("Closing the inherited QUIC socket for %s, which nothing listens on", addr)
+		conn.Close()
+	}
+	handoff.inherited, handoff.inheritedUDP = nil, nil
+
+	if handoff.ready != nil {
+		handoff.ready.Write([]byte{1})
+		handoff.ready.Close()
+		handoff.ready = nil
+	}
+}
+
+// InheritListeners adopts the listeners handed off by the process this one
+// replaces. Listening on one of their addresses later takes the inherited
+// listener over, and the first role to start tells the old process it can
+// drain. Inherited listeners no role has taken over by then are closed. It
+// does nothing in a process started any other way.
+func InheritListeners() error {
+	value, fd, releases := os.Getenv(handoffEnv), os.Getenv(readyEnv), os.Getenv(releasedEnv)
+	os.Unsetenv(handoffEnv)
+	os.Unsetenv(readyEnv)
+	os.Unsetenv(releasedEnv)
+
+	handoff.mu.Lock()
+	defer handoff.mu.Unlock()
+	if fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return fmt.Errorf("malformed ready descriptor %q", fd)
+		}
+		handoff.ready = os.NewFile(uintptr(n), "ready")
+	}
+	if releases != "" {
+		if handoff.released == nil {
+			handoff.released = make(map[string]chan struct{})
+		}
+		for _, pair := range strings.Split(releases, ",") {
+			i := strings.LastIndex(pair, "=")
+			n, err := strconv.Atoi(pair[i+1:])
+			if i < 0 || err != nil {
+				return fmt.Errorf("malformed release descriptor %q", pair)
+			}
+			// The old process closes its end once it has let go of the
+			// socket, or exits
+			pipe, released := os.NewFile(uintptr(n), "released"), make(chan struct{})
+			go func() {
+				pipe.Read(make([]byte, 1))
+				pipe.Close()
+				close(released)
+			}()
+			handoff.released[pair[:i]] = released
+		}
+	}
+	if value == "" {
+		return nil
+	}
+
+	if handoff.inherited == nil {
+		handoff.inherited = make(map[string]*net.TCPListener)
+	}
+	if handoff.inheritedUDP == nil {
+		handoff.inheritedUDP = make(map[string]*net.UDPConn)
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("malformed inherited listener %q", pair)
+		}
+		addr := pair[:i]
+		fd, err := strconv.Atoi(pair[i+1:])
+		if err != nil {
+			return fmt.Errorf("malformed inherited listener %q", pair)
+		}
+
+		file := os.NewFile(uintptr(fd), addr)
+		if udpAddr, ok := strings.CutPrefix(addr, handoffUDPPrefix); ok {
+			conn, err := net.FilePacketConn(file)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("failed to inherit QUIC socket for %s: %v", udpAddr, err)
+			}
+			udp, ok := conn.(*net.UDPConn)
+			if !ok {
+				conn.Close()
+				return fmt.Errorf("inherited QUIC socket for %s isn't UDP", udpAddr)
+			}
+			handoff.inheritedUDP[udpAddr] = udp
+			continue
+		}
+
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to inherit listener for %s: %v", addr, err)
+		}
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			listener.Close()
+			return fmt.Errorf("inherited listener for %s isn't TCP", addr)
+		}
+		handoff.inherited[addr] = tcp
+	}
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,288 @@
+//go:build unix
+
+package pivot
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handoffHelperEnv makes the test binary act as the process taking over
+const handoffHelperEnv = "PIVOT_HANDOFF_HELPER"
+
+// TestHandoffHelper is the new process of TestHandoff. It takes the
+// listener over and answers one connection.
+func TestHandoffHelper(t *testing.T) {
+	addr := os.Getenv(handoffHelperEnv)
+	if addr == "" {
+		t.Skip("only runs as the new process of TestHandoff")
+	}
+	if err := InheritListeners(); err != nil {
+		t.Fatalf("InheritListeners failed: %v", err)
+	}
+
+	handoff.mu.Lock()
+	inherited := handoff.inherited[addr] != nil
+	handoff.mu.Unlock()
+	if !inherited {
+		t.Fatalf("Nothing inherited for %s", addr)
+	}
+
+	listener, err := listenTCP(addr)
+	if err != nil {
+		t.Fatalf("listenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	reportReady()
+
+	// The listener nothing took over is closed once the role is ready
+	handoff.mu.Lock()
+	left := len(handoff.inherited)
+	handoff.mu.Unlock()
+	if left != 0 {
+		t.Errorf("Expected unused inherited listeners to be closed, %d left", left)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "successor")
+}
+
+func TestHandoff(t *testing.T) {
+	// Bound to a fixed port, so the address alone names the listener
+	h := newHarness(t)
+	addr := "127.0.0.1:" + h.freePort()
+	listener, err := listenTCP(addr)
+	if err != nil {
+		t.Fatalf("listenTCP failed: %v", err)
+	}
+	defer listener.Close()
+	// One the new process doesn't listen on
+	unused, err := listenTCP("127.0.0.1:" + h.freePort())
+	if err != nil {
+		t.Fatalf("listenTCP failed: %v", err)
+	}
+	defer unused.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffHelper$", "-test.count=1")
+	cmd.Env = append(os.Environ(), handoffHelperEnv+"="+addr)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := Handoff(context.Background(), cmd); err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Once this process lets go, the address is still served, and the
+	// unused one isn't held open by the new process
+	listener.Close()
+	unused.Close()
+	if conn, err := net.Dial("tcp", unused.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("Expected the unused listener to be closed in the new process")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial after the handoff failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reply, _ := io.ReadAll(conn)
+	if string(reply) != "successor" {
+		t.Errorf("Expected the new process to answer, got %q", reply)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("New process failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Error("New process didn't exit")
+	}
+}
+
+// handoffQUICHelperEnv makes the test binary act as the process taking over
+// in TestHandoffQUIC. It names the directory of the certificate.
+const handoffQUICHelperEnv = "PIVOT_HANDOFF_QUIC_HELPER"
+
+// TestHandoffQUICHelper is the new process of TestHandoffQUIC. It takes the
+// QUIC socket over and answers one stream.
+func TestHandoffQUICHelper(t *testing.T) {
+	dir := os.Getenv(handoffQUICHelperEnv)
+	if dir == "" {
+		t.Skip("only runs as the new process of TestHandoffQUIC")
+	}
+	if err := InheritListeners(); err != nil {
+		t.Fatalf("InheritListeners failed: %v", err)
+	}
+
+	addr := os.Getenv(handoffHelperEnv)
+	handoff.mu.Lock()
+	inherited := handoff.inheritedUDP[addr] != nil
+	handoff.mu.Unlock()
+	if !inherited {
+		t.Fatalf("No QUIC socket inherited for %s", addr)
+	}
+
+	listener, err := quicTestTransport(dir).Listen("quic://" + addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	reportReady()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer conn.Close()
+	io.ReadFull(conn, make([]byte, 1))
+	io.WriteString(conn, "successor")
+}
+
+func quicTestTransport(dir string) *Transport {
+	return &Transport{TLS: &TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}}
+}
+
+func TestHandoffQUIC(t *testing.T) {
+	dir := t.TempDir()
+	port := newHarness(t).freePort()
+	addr := "127.0.0.1:" + port
+	listener, err := quicTestTransport(dir).Listen("quic://" + addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		// Echo on the connection the old process drains
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	pin, err := ParseCertificatePin(filepath.Join(dir, "server.crt"))
+	if err != nil {
+		t.Fatalf("Failed to read the certificate: %v", err)
+	}
+	dial := func(timeout time.Duration) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		// A transport of its own, so nothing reuses an older connection
+		return (&Transport{TLS: &TLSOptions{Pin: pin}}).Dial(ctx, "quic://"+addr)
+	}
+	old, err := dial(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer old.Close()
+	old.SetDeadline(time.Now().Add(10 * time.Second))
+	echo := func() error {
+		if _, err := old.Write([]byte("x")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(old, make([]byte, 1))
+		return err
+	}
+	if err := echo(); err != nil {
+		t.Fatalf("Echo failed: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffQUICHelper$", "-test.count=1")
+	cmd.Env = append(os.Environ(), handoffQUICHelperEnv+"="+dir, handoffHelperEnv+"="+addr)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := Handoff(context.Background(), cmd); err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// While the old connection drains, its process alone reads the socket
+	listener.Close()
+	for i := 0; i < 10; i++ {
+		if err := echo(); err != nil {
+			t.Fatalf("Echo while draining failed: %v", err)
+		}
+	}
+	if conn, err := dial(500 * time.Millisecond); err == nil {
+		conn.Close()
+		t.Fatal("New process served QUIC before the old one let go of the socket")
+	}
+
+	// Once the old connection ends, the new process takes new ones
+	old.(*quicStreamConn).conn.CloseWithError(0, "")
+	conn, err := dial(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Dial after the drain failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("x"))
+	reply, _ := io.ReadAll(conn)
+	if string(reply) != "successor" {
+		t.Errorf("Expected the new process to answer, got %q", reply)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("New process failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Error("New process didn't exit")
+	}
+}
+
+func TestHandoffNotReady(t *testing.T) {
+	// A new process that exits without starting a role
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err := Handoff(context.Background(), cmd)
+	if err == nil || !strings.Contains(err.Error(), "before it was ready") {
+		t.Errorf("Expected the handoff to fail, got %v", err)
+	}
+
+	// One that never gets there
+	cmd = exec.Command("sleep", "60")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := Handoff(ctx, cmd); err == nil || !strings.Contains(err.Error(), "in time") {
+		t.Errorf("Expected the handoff to time out, got %v", err)
+	}
+	if cmd.ProcessState == nil {
+		t.Error("Expected the new process to be killed and waited for")
+	}
+}
+
+func TestInheritListenersMalformed(t *testing.T) {
+	t.Setenv(handoffEnv, ":1080")
+	if err := InheritListeners(); err == nil {
+		t.Error("Expected a pair without a descriptor to be refused")
+	}
+	if os.Getenv(handoffEnv) != "" {
+		t.Error("Expected the variable to be cleared")
+	}
+	t.Setenv(releasedEnv, "127.0.0.1:4433")
+	if err := InheritListeners(); err == nil {
+		t.Error("Expected a release pipe without a descriptor to be refused")
+	}
+}
@@ -0,0 +1,152 @@
+package pivot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default heartbeat settings for session links
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultHeartbeatMisses   = 3
+)
+
+var errHeartbeatTimeout = errors.New("peer stopped answering heartbeats")
+
+// deadPeers counts sessions torn down for missing heartbeats
+var deadPeers atomic.Int64
+
+// DeadPeers returns the number of sessions closed because the peer stopped
+// answering heartbeats
+func DeadPeers() int64 {
+	return deadPeers.Load()
+}
+
+// HeartbeatConfig controls the liveness checks on session links. Each side
+// pings on its own schedule and always answers the peer's pings, so both
+// ends notice a dead link even when only one of them is sending data.
+type HeartbeatConfig struct {
+	Interval time.Duration // time between pings, 0 disables them
+	Misses   int           // unanswered pings in a row before the peer is dead
+}
+
+// DefaultHeartbeat returns the default heartbeat settings
+func DefaultHeartbeat() HeartbeatConfig {
+	return HeartbeatConfig{
+		Interval: defaultHeartbeatInterval,
+		Misses:   defaultHeartbeatMisses,
+	}
+}
+
+// Validate checks the settings
+func (c HeartbeatConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("heartbeat interval can't be negative")
+	}
+	if c.Interval > 0 && c.Misses < 1 {
+		return fmt.Errorf("heartbeat misses must be at least 1")
+	}
+	return nil
+}
+
+// heartbeat pings the peer of a session and measures the round-trip time.
+// The session provides the ping transport and the teardown.
+type heartbeat struct {
+	config HeartbeatConfig
+	ping   func(nonce uint64) error
+	dead   func()
+	start  time.Time
+
+	mu      sync.Mutex
+	rtt     time.Duration
+	pending bool // last ping still unanswered
+	missed  int
+}
+
+func newHeartbeat(config HeartbeatConfig, ping func(uint64) error, dead func()) *heartbeat {
+	return &heartbeat{
+		config: config,
+		ping:   ping,
+		dead:   dead,
+		start:  time.Now(),
+	}
+}
+
+// run sends pings until done is closed or the peer is declared dead. Pings
+// are written in the background, so one stuck behind a blocked link still
+// counts as unanswered and the peer is declared dead on schedule.
+func (h *heartbeat) run(done <-chan struct{}, peer string) {
+	if h.config.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	sent := make(chan error, 1)
+	sending := false
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-sent:
+			if err != nil {
+				return
+			}
+			sending = false
+			continue
+		case <-ticker.C:
+		}
+
+		h.mu.Lock()
+		if h.pending {
+			h.missed++
+		}
+		missed := h.missed
+		h.pending = true
+		h.mu.Unlock()
+
+		if h.config.Misses > 0 && missed >= h.config.Misses {
+			total := deadPeers.Add(1)
+			log.Printf("Peer %s missed %d heartbeats, closing session (%d dead peers so far)", peer, missed, total)
+			h.dead()
+			return
+		}
+
+		// Only one ping is written at a time, a ping still being written
+		// is left pending and so counts as a miss on the next tick
+		if sending {
+			continue
+		}
+		sending = true
+		// The nonce is the send time, so the pong alone gives the RTT
+		nonce := uint64(time.Since(h.start))
+		go func() { sent <- h.ping(nonce) }()
+	}
+}
+
+// pong records the answer to one of our pings
+func (h *heartbeat) pong(nonce uint64) {
+	sent := time.Duration(nonce)
+	now := time.Since(h.start)
+	if sent > now {
+		return
+	}
+
+	h.mu.Lock()
+	h.rtt = now - sent
+	h.pending = false
+	h.missed = 0
+	h.mu.Unlock()
+}
+
+// RTT returns the last measured round-trip time, 0 before the first pong
+func (h *heartbeat) RTT() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
@@ -0,0 +1,75 @@
+package pivot
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var fastHeartbeat = HeartbeatConfig{Interval: 10 * time.Millisecond, Misses: 3}
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := newMuxSession(c1, true, fastHeartbeat)
+	server := newMuxSession(c2, false, HeartbeatConfig{})
+	defer client.Close()
+	defer server.Close()
+
+	// The server sends no pings of its own but still answers the client's
+	deadline := time.Now().Add(5 * time.Second)
+	for client.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("No round-trip time measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-client.Done():
+		t.Error("Session closed although the peer answers heartbeats")
+	case <-time.After(10 * fastHeartbeat.Interval):
+	}
+}
+
+func TestHeartbeatDetectsDeadPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	// The peer drains the link but never answers, like a silently dropped
+	// NAT mapping on a link that still accepts writes
+	go io.Copy(io.Discard, c2)
+	defer c2.Close()
+
+	before := DeadPeers()
+	session := newMuxSession(c1, true, fastHeartbeat)
+
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dead peer not detected")
+	}
+
+	if err := session.closeErr(); err != errHeartbeatTimeout {
+		t.Errorf("Expected heartbeat timeout, got: %v", err)
+	}
+	if DeadPeers() != before+1 {
+		t.Errorf("Expected the dead peer to be counted")
+	}
+}
+
+func TestHeartbeatDetectsBlockedLink(t *testing.T) {
+	c1, c2 := net.Pipe()
+	// Nothing reads the link, so the first ping write never returns
+	defer c2.Close()
+
+	session := newMuxSession(c1, true, fastHeartbeat)
+
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Blocked link not detected")
+	}
+
+	if err := session.closeErr(); err != errHeartbeatTimeout {
+		t.Errorf("Expected heartbeat timeout, got: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package pivot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multi-hop routing. A pivot that dials an agent or an upstream server
+// announces its name right after the handshake. Clients choose a chain of
+// those names with a route preamble sent ahead of the SOCKS5 greeting, and
+// every hop strips its own entry and forwards the stream to the next one.
+
+const (
+	// routeMarker opens a route preamble. It can't be mistaken for the
+	// SOCKS5 version byte that otherwise starts a stream.
+	routeMarker = 0xF0
+
+	// routeSeparator joins hop names in a route such as "dmz/db"
+	routeSeparator = "/"
+
+	maxHopName  = 64
+	maxRouteLen = 255
+)
+
+// ParseRoute splits a route such as "hop1/hop2" into hop names
+func ParseRoute(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if len(s) > maxRouteLen {
+		return nil, fmt.Errorf("route is longer than %d bytes", maxRouteLen)
+	}
+
+	route := strings.Split(s, routeSeparator)
+	for _, name := range route {
+		if err := checkHopName(name); err != nil {
+			return nil, err
+		}
+	}
+	return route, nil
+}
+
+// checkHopName validates a name announced with -name or used in a route
+func checkHopName(name string) error {
+	if name == "" {
+		return errors.New("empty hop name")
+	}
+	if len(name) > maxHopName {
+		return fmt.Errorf("hop name %q is longer than %d bytes", name, maxHopName)
+	}
+	if strings.ContainsAny(name, routeSeparator+" \t\r\n") {
+		return fmt.Errorf("hop name %q contains a separator or whitespace", name)
+	}
+	return nil
+}
+
+// writeRoute sends the route preamble. An empty route sends nothing, so the
+// stream starts with SOCKS5 as before.
+func writeRoute(w io.Writer, route []string) error {
+	if len(route) == 0 {
+		return nil
+	}
+
+	joined := strings.Join(route, routeSeparator)
+	buf := append([]byte{routeMarker, byte(len(joined))}, joined...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRoute strips a route preamble from the start of conn, if there is one.
+// The returned connection must be used for the rest of the stream.
+func readRoute(conn net.Conn) (net.Conn, []string, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	buffered := wrapBuffered(conn, br)
+	if first[0] != routeMarker {
+		return buffered, nil, nil
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, err
+	}
+	joined := make([]byte, header[1])
+	if _, err := io.ReadFull(br, joined); err != nil {
+		return nil, nil, err
+	}
+
+	route, err := ParseRoute(string(joined))
+	if err != nil {
+		return nil, nil, err
+	}
+	return buffered, route, nil
+}
+
+// writeHopHello announces the dialing pivot's name, which may be empty
+func writeHopHello(w io.Writer, name string) error {
+	_, err := w.Write(append([]byte{byte(len(name))}, name...))
+	return err
+}
+
+// readHopHello reads the name announced by a pivot that dialed in
+func readHopHello(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	name := make([]byte, size[0])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return "", err
+	}
+
+	if len(name) > 0 {
+		if err := checkHopName(string(name)); err != nil {
+			return "", err
+		}
+	}
+	return string(name), nil
+}
+
+// acceptHopSession completes the link of a pivot that dialed in: the tunnel
+// cipher, the optional handshake and its name announcement
+func acceptHopSession(conn net.Conn, cipher, key string, auth *Authenticator, hb HeartbeatConfig) (string, Session, error) {
+	rc4Conn, err := wrapCipher(conn, cipher, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create encrypted connection: %v", err)
+	}
+
+	if auth.enabled() {
+		peer, err := auth.Accept(rc4Conn)
+		if err != nil {
+			return "", nil, fmt.Errorf("handshake with %s failed: %v", peer, err)
+		}
+		log.Printf("Authenticated pivot %s as %s", conn.RemoteAddr(), peer)
+	}
+
+	name, err := readHopHello(rc4Conn)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read pivot name: %v", err)
+	}
+
+	return name, NewSession(conn, rc4Conn, false, hb), nil
+}
+
+// hopTable tracks the sessions of pivots that dialed in, by announced name.
+// The most recent session is the default for streams without a route.
+type hopTable struct {
+	mu   sync.Mutex
+	hops map[string]Session
+	last Session
+}
+
+// add registers a session, replacing an older one with the same name
+func (t *hopTable) add(name string, session Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.hops == nil {
+		t.hops = make(map[string]Session)
+	}
+	t.hops[name] = session
+	t.last = session
+}
+
+// remove drops a session unless a newer one took its place
+func (t *hopTable) remove(name string, session Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.hops[name] == session {
+		delete(t.hops, name)
+	}
+	if t.last == session {
+		t.last = nil
+		for _, other := range t.hops {
+			t.last = other
+			break
+		}
+	}
+}
+
+// get returns the session of the named pivot, or the default one for an
+// empty name. A default session whose pivot is going away gives way to any
+// other that isn't.
+func (t *hopTable) get(name string) Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if name != "" {
+		return t.hops[name]
+	}
+	if t.last != nil && goneAway(t.last) {
+		for _, other := range t.hops {
+			if !goneAway(other) {
+				return other
+			}
+		}
+	}
+	return t.last
+}
+
+// openRoute opens a stream to the first hop of route within timeout and
+// passes the rest of the route along, giving up early if ctx ends. An empty
+// first hop selects the default session.
+func openRoute(ctx context.Context, hops *hopTable, route []string, timeout time.Duration) (net.Conn, error) {
+	session := hops.get(route[0])
+	if session == nil {
+		if route[0] == "" {
+			return nil, errors.New("no pivot connected")
+		}
+		return nil, fmt.Errorf("unknown hop %q", route[0])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := session.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRoute(stream, route[1:]); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
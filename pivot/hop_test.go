@@ -0,0 +1,94 @@
+package pivot
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRoute(t *testing.T) {
+	route, err := ParseRoute("dmz/db")
+	if err != nil {
+		t.Fatalf("ParseRoute failed: %v", err)
+	}
+	if !reflect.DeepEqual(route, []string{"dmz", "db"}) {
+		t.Errorf("Unexpected route: %v", route)
+	}
+
+	for _, bad := range []string{"dmz//db", "/db", "dmz/", "d b"} {
+		if _, err := ParseRoute(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestReadRoute(t *testing.T) {
+	for _, route := range [][]string{nil, {"dmz", "db"}} {
+		c1, c2 := net.Pipe()
+		go func() {
+			writeRoute(c1, route)
+			c1.Write([]byte{SOCKS5_VERSION})
+			c1.Close()
+		}()
+
+		conn, got, err := readRoute(c2)
+		if err != nil {
+			t.Fatalf("readRoute failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, route) {
+			t.Errorf("Expected route %v, got %v", route, got)
+		}
+
+		// Whatever follows the preamble is left on the connection
+		rest, _ := io.ReadAll(conn)
+		if len(rest) != 1 || rest[0] != SOCKS5_VERSION {
+			t.Errorf("Expected the SOCKS5 version byte after the route, got %v", rest)
+		}
+	}
+}
+
+func TestRouteThroughHop(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The downstream pivot "db" dialed in to the upstream server
+	upstream := newServer("test-key", "")
+	downstream := newServer("test-key", "")
+	h1, h2 := net.Pipe()
+	hopSession := newMuxSession(h1, false, DefaultHeartbeat())
+	defer hopSession.Close()
+	upstream.hops.add("db", hopSession)
+	go downstream.serveSession(newTestRun(t, ctx), newMuxSession(h2, true, DefaultHeartbeat()))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go upstream.handleTunnel(ctx, serverConn, 1, nil)
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeRoute(clientConn, []string{"db"}); err != nil {
+		t.Fatalf("writeRoute failed: %v", err)
+	}
+	if err := NewSOCKS5Client("").handshake(clientConn, target.Addr().String()); err != nil {
+		t.Fatalf("SOCKS5 handshake through the hop failed: %v", err)
+	}
+	clientConn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("Expected echoed ping, got %q: %v", reply, err)
+	}
+
+	// Routes to unknown hops are dropped
+	upstream.hops.remove("db", hopSession)
+	if _, err := openRoute(context.Background(), &upstream.hops, []string{"db"}, time.Second); err == nil {
+		t.Error("Expected a route to a removed hop to fail")
+	}
+}
@@ -0,0 +1,374 @@
+package pivot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	handshakeVersion = 0x01
+	handshakeTimeout = 10 * time.Second
+
+	handshakeAccepted = 0x00
+	handshakeDenied   = 0x01
+)
+
+// ErrNotAuthorized is returned when the peer identity is rejected
+var ErrNotAuthorized = errors.New("peer key not authorized")
+
+// Authenticator performs the public-key handshake that runs inside the
+// encrypted tunnel before any SOCKS traffic
+type Authenticator struct {
+	identity   ed25519.PrivateKey
+	authorized *AuthorizedKeys // nil accepts any peer identity
+	pin        string          // expected remote fingerprint, empty accepts any
+}
+
+// NewAuthenticator creates an authenticator for the given identity
+func NewAuthenticator(identity ed25519.PrivateKey, authorized *AuthorizedKeys, pin string) *Authenticator {
+	return &Authenticator{
+		identity:   identity,
+		authorized: authorized,
+		pin:        pin,
+	}
+}
+
+// LoadIdentity reads an ed25519 identity written by keygen
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := readSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseIdentity(data)
+}
+
+// ParsePin normalizes a -pin value, which may be a fingerprint, a public key
+// line or the path of a .pub file
+func ParsePin(value string) (string, error) {
+	if value == "" || strings.HasPrefix(value, "SHA256:") {
+		return value, nil
+	}
+
+	line := value
+	if !strings.HasPrefix(value, publicKeyPrefix) {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", fmt.Errorf("pin is neither a fingerprint nor a readable key file: %v", err)
+		}
+		line = string(data)
+	}
+
+	pub, _, err := ParsePublicKey(line)
+	if err != nil {
+		return "", err
+	}
+	return PublicKeyFingerprint(pub), nil
+}
+
+// enabled reports whether handshakes should be performed
+func (a *Authenticator) enabled() bool {
+	return a != nil && a.identity != nil
+}
+
+// Fingerprint returns the fingerprint of the local identity
+func (a *Authenticator) Fingerprint() string {
+	return PublicKeyFingerprint(a.identity.Public().(ed25519.PublicKey))
+}
+
+// Accept runs the server side of the handshake and returns a description of
+// the authenticated peer
+func (a *Authenticator) Accept(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Client hello: version + ephemeral key
+	hello := make([]byte, 1+32)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return "", err
+	}
+	if hello[0] != handshakeVersion {
+		return "", fmt.Errorf("unsupported handshake version: %d", hello[0])
+	}
+
+	curve := ecdh.X25519()
+	peerEph, err := curve.NewPublicKey(hello[1:])
+	if err != nil {
+		return "", err
+	}
+	eph, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	// Server proof: identity + ephemeral key + signature over the transcript
+	idPub := a.identity.Public().(ed25519.PublicKey)
+	proof := append(append([]byte{}, idPub...), eph.PublicKey().Bytes()...)
+	sig := ed25519.Sign(a.identity, handshakeDigest("server", hello, proof))
+	serverMsg := append(proof, sig...)
+	if _, err := conn.Write(serverMsg); err != nil {
+		return "", err
+	}
+
+	// Client proof: identity + signature over the transcript
+	clientMsg := make([]byte, ed25519.PublicKeySize+ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, clientMsg); err != nil {
+		return "", err
+	}
+	peerID := ed25519.PublicKey(clientMsg[:ed25519.PublicKeySize])
+	peerSig := clientMsg[ed25519.PublicKeySize:]
+	peer := PublicKeyFingerprint(peerID)
+
+	if !ed25519.Verify(peerID, handshakeDigest("client", hello, serverMsg, peerID), peerSig) {
+		conn.Write([]byte{handshakeDenied})
+		return peer, errors.New("invalid client signature")
+	}
+
+	if a.authorized != nil {
+		comment, ok := a.authorized.Lookup(peerID)
+		if !ok {
+			conn.Write([]byte{handshakeDenied})
+			return peer, ErrNotAuthorized
+		}
+		if comment != "" {
+			peer += " (" + comment + ")"
+		}
+	}
+
+	if _, err := conn.Write([]byte{handshakeAccepted}); err != nil {
+		return peer, err
+	}
+
+	shared, err := eph.ECDH(peerEph)
+	if err != nil {
+		return peer, err
+	}
+	return peer, rekeyConn(conn, shared, hello, serverMsg, clientMsg, false)
+}
+
+// Dial runs the client side of the handshake and returns the fingerprint of
+// the authenticated server
+func (a *Authenticator) Dial(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	curve := ecdh.X25519()
+	eph, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	hello := append([]byte{handshakeVersion}, eph.PublicKey().Bytes()...)
+	if _, err := conn.Write(hello); err != nil {
+		return "", err
+	}
+
+	serverMsg := make([]byte, ed25519.PublicKeySize+32+ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, serverMsg); err != nil {
+		return "", err
+	}
+	serverID := ed25519.PublicKey(serverMsg[:ed25519.PublicKeySize])
+	proof := serverMsg[:ed25519.PublicKeySize+32]
+	serverSig := serverMsg[ed25519.PublicKeySize+32:]
+	peer := PublicKeyFingerprint(serverID)
+
+	if !ed25519.Verify(serverID, handshakeDigest("server", hello, proof), serverSig) {
+		return peer, errors.New("invalid server signature")
+	}
+	if a.pin != "" && a.pin != peer {
+		return peer, fmt.Errorf("server key %s does not match pinned key %s", peer, a.pin)
+	}
+
+	peerEph, err := curve.NewPublicKey(proof[ed25519.PublicKeySize:])
+	if err != nil {
+		return peer, err
+	}
+
+	idPub := a.identity.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(a.identity, handshakeDigest("client", hello, serverMsg, idPub))
+	clientMsg := append(append([]byte{}, idPub...), sig...)
+	if _, err := conn.Write(clientMsg); err != nil {
+		return peer, err
+	}
+
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return peer, err
+	}
+	if status[0] != handshakeAccepted {
+		return peer, ErrNotAuthorized
+	}
+
+	shared, err := eph.ECDH(peerEph)
+	if err != nil {
+		return peer, err
+	}
+	return peer, rekeyConn(conn, shared, hello, serverMsg, clientMsg, true)
+}
+
+// handshakeDigest hashes a labelled transcript for signing
+func handshakeDigest(label string, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("pivot-handshake " + label))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// rekeyer is implemented by tunnel ciphers that can switch to session keys
+type rekeyer interface {
+	Rekey(sendKey, recvKey []byte) error
+}
+
+// rekeyConn derives per-direction session keys from the handshake so that
+// holders of the shared tunnel key cannot read or inject into the stream
+func rekeyConn(conn net.Conn, shared []byte, hello, serverMsg, clientMsg []byte, isClient bool) error {
+	rk, ok := conn.(rekeyer)
+	if !ok {
+		return nil
+	}
+
+	transcript := sha256.Sum256(bytes.Join([][]byte{hello, serverMsg, clientMsg}, nil))
+	c2s, err := hkdf.Key(sha256.New, shared, transcript[:], "pivot client to server", 32)
+	if err != nil {
+		return err
+	}
+	s2c, err := hkdf.Key(sha256.New, shared, transcript[:], "pivot server to client", 32)
+	if err != nil {
+		return err
+	}
+
+	if isClient {
+		return rk.Rekey(c2s, s2c)
+	}
+	return rk.Rekey(s2c, c2s)
+}
+
+// AuthorizedKeys is an authorized_keys style list of peer public keys.
+// The file is re-read whenever it changes so removing a line revokes access
+// for new connections immediately.
+type AuthorizedKeys struct {
+	path    string
+	mu      sync.RWMutex
+	modTime time.Time
+	keys    map[string]string // raw public key -> comment
+}
+
+// LoadAuthorizedKeys reads an authorized keys file
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	ak := &AuthorizedKeys{path: path}
+	if err := ak.Reload(); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// Reload re-reads the authorized keys file
+func (ak *AuthorizedKeys) Reload() error {
+	info, err := os.Stat(ak.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(ak.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pub, comment, err := ParsePublicKey(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", ak.path, lineNum, err)
+		}
+		keys[string(pub)] = comment
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ak.mu.Lock()
+	ak.keys = keys
+	ak.modTime = info.ModTime()
+	ak.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of authorized keys
+func (ak *AuthorizedKeys) Len() int {
+	ak.mu.RLock()
+	defer ak.mu.RUnlock()
+	return len(ak.keys)
+}
+
+// entries lists the authorized keys by fingerprint and comment, sorted
+func (ak *AuthorizedKeys) entries() []string {
+	ak.mu.RLock()
+	defer ak.mu.RUnlock()
+	entries := make([]string, 0, len(ak.keys))
+	for pub, comment := range ak.keys {
+		entry := PublicKeyFingerprint(ed25519.PublicKey(pub))
+		if comment != "" {
+			entry += " (" + comment + ")"
+		}
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// Lookup reports whether pub is authorized and returns its comment
+func (ak *AuthorizedKeys) Lookup(pub ed25519.PublicKey) (string, bool) {
+	ak.refresh()
+
+	ak.mu.RLock()
+	defer ak.mu.RUnlock()
+	comment, ok := ak.keys[string(pub)]
+	return comment, ok
+}
+
+// refresh reloads the file when its modification time has changed
+func (ak *AuthorizedKeys) refresh() {
+	info, err := os.Stat(ak.path)
+	if err != nil {
+		log.Printf("Authorized keys file %s unavailable, keeping %d cached keys: %v", ak.path, ak.Len(), err)
+		return
+	}
+
+	ak.mu.RLock()
+	unchanged := info.ModTime().Equal(ak.modTime)
+	ak.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	if err := ak.Reload(); err != nil {
+		log.Printf("Failed to reload authorized keys, keeping previous list: %v", err)
+		return
+	}
+	log.Printf("Reloaded %d authorized keys from %s", ak.Len(), ak.path)
+}
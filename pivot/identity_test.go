@@ -0,0 +1,133 @@
+package pivot
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	priv, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	return priv
+}
+
+func writeAuthorizedKeys(t *testing.T, path string, keys ...ed25519.PrivateKey) {
+	t.Helper()
+	var data []byte
+	for i, k := range keys {
+		line := MarshalPublicKey(k.Public().(ed25519.PublicKey), "operator"+string(rune('a'+i)))
+		data = append(data, line+"\n"...)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write authorized keys: %v", err)
+	}
+}
+
+// runHandshake performs both sides of the handshake over RC4 wrapped pipes
+func runHandshake(t *testing.T, server, client *Authenticator) (serverConn, clientConn *RC4Conn, serverErr, clientErr error) {
+	t.Helper()
+	p1, p2 := net.Pipe()
+	t.Cleanup(func() { p1.Close(); p2.Close() })
+
+	serverConn, _ = NewRC4Conn(p1, "testkey")
+	clientConn, _ = NewRC4Conn(p2, "testkey")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Accept(serverConn)
+		if err != nil {
+			p1.Close()
+		}
+		done <- err
+	}()
+	_, clientErr = client.Dial(clientConn)
+	if clientErr != nil {
+		p2.Close()
+	}
+	serverErr = <-done
+	return
+}
+
+func TestHandshakeRekeysConnection(t *testing.T) {
+	serverID, clientID := newTestIdentity(t), newTestIdentity(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	writeAuthorizedKeys(t, path, clientID)
+	authorized, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("Failed to load authorized keys: %v", err)
+	}
+
+	pin := PublicKeyFingerprint(serverID.Public().(ed25519.PublicKey))
+	server := NewAuthenticator(serverID, authorized, "")
+	client := NewAuthenticator(clientID, nil, pin)
+
+	serverConn, clientConn, serverErr, clientErr := runHandshake(t, server, client)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("Handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+
+	// Both directions must decrypt with the derived session keys
+	msg := []byte("after handshake")
+	go clientConn.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(serverConn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("Client to server mismatch. Got: %q", buf)
+	}
+
+	go serverConn.Write(msg)
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("Server to client mismatch. Got: %q", buf)
+	}
+}
+
+func TestHandshakeRejectsUnauthorizedClient(t *testing.T) {
+	serverID, clientID, otherID := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	writeAuthorizedKeys(t, path, otherID)
+	authorized, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("Failed to load authorized keys: %v", err)
+	}
+
+	server := NewAuthenticator(serverID, authorized, "")
+	client := NewAuthenticator(clientID, nil, "")
+
+	_, _, serverErr, clientErr := runHandshake(t, server, client)
+	if !errors.Is(serverErr, ErrNotAuthorized) {
+		t.Errorf("Expected server to reject client, got: %v", serverErr)
+	}
+	if !errors.Is(clientErr, ErrNotAuthorized) {
+		t.Errorf("Expected client to see rejection, got: %v", clientErr)
+	}
+}
+
+func TestHandshakeRejectsPinMismatch(t *testing.T) {
+	serverID, clientID, otherID := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+
+	server := NewAuthenticator(serverID, nil, "")
+	client := NewAuthenticator(clientID, nil, PublicKeyFingerprint(otherID.Public().(ed25519.PublicKey)))
+
+	_, _, serverErr, clientErr := runHandshake(t, server, client)
+	if clientErr == nil {
+		t.Error("Expected client to reject unpinned server key")
+	}
+	if serverErr == nil {
+		t.Error("Expected server handshake to fail after client aborted")
+	}
+}
@@ -0,0 +1,273 @@
+package pivot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// harness runs servers, agents and clients on loopback ports inside the test
+// process, next to an echo target they can reach
+type harness struct {
+	t      *testing.T
+	ctx    context.Context
+	key    string
+	target string // address of the echo target
+}
+
+func newHarness(t *testing.T) *harness {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	startEcho(t, target)
+
+	return &harness{t: t, ctx: ctx, key: "integration-key", target: target.Addr().String()}
+}
+
+// freePort returns a loopback port that nothing listens on right now
+func (h *harness) freePort() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// waitFor polls ready until it holds or the test gives up
+func (h *harness) waitFor(what string, ready func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitListening waits until something accepts connections on addr
+func (h *harness) waitListening(addr string) {
+	h.t.Helper()
+	h.waitFor(addr+" to listen", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+}
+
+// shutdownOnCleanup shuts a role down at the end of the test unless the test
+// did it already
+func (h *harness) shutdownOnCleanup(shutdown func(context.Context) error) func() error {
+	var once sync.Once
+	var err error
+	stop := func() error {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = shutdown(ctx)
+		})
+		return err
+	}
+	h.t.Cleanup(func() { stop() })
+	return stop
+}
+
+// startServer starts a server in listen mode and returns its tunnel address
+// and a function shutting it down. configure adjusts the server before it
+// starts, as do the hooks of the other roles.
+func (h *harness) startServer(configure ...func(*Server)) (string, func() error) {
+	port := h.freePort()
+	server := newServer(h.key, ":"+port)
+	for _, f := range configure {
+		f(server)
+	}
+	go server.Start(h.ctx)
+
+	addr := "127.0.0.1:" + port
+	h.waitListening(addr)
+	return addr, h.shutdownOnCleanup(server.Shutdown)
+}
+
+// startAgent starts an agent and returns it with its client and internal
+// addresses
+func (h *harness) startAgent(configure ...func(*Agent)) (*Agent, string, string) {
+	clientAddr := "127.0.0.1:" + h.freePort()
+	internalAddr := "127.0.0.1:" + h.freePort()
+	agent := newAgent(h.key, clientAddr, internalAddr)
+	for _, f := range configure {
+		f(agent)
+	}
+	go agent.Start(h.ctx)
+
+	h.waitListening(clientAddr)
+	h.shutdownOnCleanup(agent.Shutdown)
+	return agent, clientAddr, internalAddr
+}
+
+// startVictim starts a server dialing the agent and waits for its session
+func (h *harness) startVictim(agent *Agent, internalAddr string, configure ...func(*Server)) func() error {
+	server := newServer(h.key, internalAddr)
+	for _, f := range configure {
+		f(server)
+	}
+	go server.Start(h.ctx)
+
+	h.waitFor("the victim session", func() bool { return agent.victims.get("") != nil })
+	return h.shutdownOnCleanup(server.Shutdown)
+}
+
+// startClient starts a client forwarding to remote and returns its local
+// SOCKS5 address
+func (h *harness) startClient(remote string, configure ...func(*Client)) (string, func() error) {
+	localAddr := "127.0.0.1:" + h.freePort()
+	client := newClient(h.key, remote, localAddr)
+	for _, f := range configure {
+		f(client)
+	}
+	go client.Start(h.ctx)
+
+	h.waitListening(localAddr)
+	return localAddr, h.shutdownOnCleanup(client.Shutdown)
+}
+
+// socks opens a stream to target through the SOCKS5 proxy at proxyAddr
+func (h *harness) socks(proxyAddr, target string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := NewSOCKS5Client("").handshake(conn, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// echo sends size random bytes through conn and checks they come back intact
+func (h *harness) echo(conn net.Conn, size int) {
+	h.t.Helper()
+	sent := make([]byte, size)
+	rand.Read(sent)
+
+	go conn.Write(sent)
+	received := make([]byte, size)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		h.t.Fatalf("Echo failed: %v", err)
+	}
+	if !bytes.Equal(sent, received) {
+		h.t.Fatal("Echoed bytes differ from the ones sent")
+	}
+}
+
+func TestIntegrationDirect(t *testing.T) {
+	h := newHarness(t)
+	serverAddr, _ := h.startServer()
+	proxy, _ := h.startClient(serverAddr)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 1<<20)
+
+	// A half-close still gets everything in flight back
+	conn.Write([]byte("last words"))
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(conn)
+	if err != nil || string(rest) != "last words" {
+		t.Errorf("Expected the echo after half-closing, got %q, %v", rest, err)
+	}
+}
+
+func TestIntegrationAgent(t *testing.T) {
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent()
+	h.startVictim(agent, internalAddr)
+	proxy, _ := h.startClient(clientAddr)
+
+	// Concurrent streams share the victim's session
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := h.socks(proxy, h.target)
+			if err != nil {
+				t.Errorf("SOCKS5 connect through the agent failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			h.echo(conn, 256<<10)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIntegrationErrorReplies(t *testing.T) {
+	h := newHarness(t)
+	serverAddr, _ := h.startServer()
+	proxy, _ := h.startClient(serverAddr)
+
+	// Nothing listens on the target, so the server answers with a failure
+	closed := "127.0.0.1:" + h.freePort()
+	if _, err := h.socks(proxy, closed); err == nil || !strings.Contains(err.Error(), "code: 1") {
+		t.Errorf("Expected a general failure reply for a closed port, got %v", err)
+	}
+
+	// An agent without a victim can't serve the stream
+	_, agentAddr, _ := h.startAgent()
+	lonely, _ := h.startClient(agentAddr)
+	if conn, err := h.socks(lonely, h.target); err == nil {
+		conn.Close()
+		t.Error("Expected a stream through an agent without a victim to fail")
+	}
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent()
+	stopVictim := h.startVictim(agent, internalAddr)
+	proxy, stopClient := h.startClient(clientAddr)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 1024)
+
+	// Stopping the victim ends its session and the streams over it
+	if err := stopVictim(); err != nil {
+		t.Errorf("Victim shutdown failed: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the stream to end with the victim's session")
+	}
+	h.waitFor("the agent to drop the victim", func() bool { return agent.victims.get("") == nil })
+
+	// A stopped client no longer accepts connections
+	if err := stopClient(); err != nil {
+		t.Errorf("Client shutdown failed: %v", err)
+	}
+	if conn, err := net.Dial("tcp", proxy); err == nil {
+		conn.Close()
+		t.Error("Expected the client's SOCKS5 port to be closed after shutdown")
+	}
+}
@@ -0,0 +1,207 @@
+package pivot
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const (
+	// symmetricKeySize is the number of random bytes in a generated tunnel key
+	symmetricKeySize = 32
+
+	// publicKeyPrefix marks an ed25519 identity public key line
+	publicKeyPrefix = "pivot-ed25519"
+)
+
+// GenerateSymmetricKey returns a new hex-encoded random tunnel key
+func GenerateSymmetricKey() (string, error) {
+	buf := make([]byte, symmetricKeySize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of a symmetric key
+func KeyFingerprint(key string) string {
+	return fingerprint([]byte(key))
+}
+
+// PublicKeyFingerprint returns the SHA256 fingerprint of an identity public key
+func PublicKeyFingerprint(pub ed25519.PublicKey) string {
+	return fingerprint(pub)
+}
+
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// LoadKey resolves the tunnel key, given either directly or as a file to
+// read it from
+func LoadKey(key, keyFile string) (string, error) {
+	if key != "" && keyFile != "" {
+		return "", errors.New("a key and a key file are mutually exclusive")
+	}
+	if keyFile == "" {
+		return key, nil
+	}
+
+	data, err := readSecretFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	key = strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("key file %s is empty", keyFile)
+	}
+	return key, nil
+}
+
+// readSecretFile reads a file holding secret material, warning when it is
+// readable by other users
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		log.Printf("Warning: %s is accessible by other users (mode %04o)", path, info.Mode().Perm())
+	}
+	return os.ReadFile(path)
+}
+
+// WriteKeyFile writes data to path with owner-only permissions, refusing to
+// replace an existing file unless force is set
+func WriteKeyFile(path string, data []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil && runtime.GOOS != "windows" {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// GenerateIdentity creates a new ed25519 identity keypair
+func GenerateIdentity() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, err
+}
+
+// MarshalIdentity encodes an identity private key as PKCS#8 PEM
+func MarshalIdentity(priv ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParseIdentity decodes a PEM encoded ed25519 identity private key
+func ParseIdentity(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return priv, nil
+}
+
+// MarshalPublicKey encodes an identity public key as a single
+// "pivot-ed25519 <base64> [comment]" line
+func MarshalPublicKey(pub ed25519.PublicKey, comment string) string {
+	line := publicKeyPrefix + " " + base64.StdEncoding.EncodeToString(pub)
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// ParsePublicKey decodes a public key line produced by MarshalPublicKey and
+// returns the key and its comment
+func ParsePublicKey(line string) (ed25519.PublicKey, string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != publicKeyPrefix {
+		return nil, "", fmt.Errorf("expected %q public key", publicKeyPrefix)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid public key encoding: %v", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, "", fmt.Errorf("invalid public key length: %d", len(raw))
+	}
+
+	return ed25519.PublicKey(raw), strings.Join(fields[2:], " "), nil
+}
+
+// DescribeKeyFile returns the fingerprint of any file produced by keygen
+func DescribeKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(text, "-----BEGIN CERTIFICATE"):
+		pin, err := ParseCertificatePin(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (TLS certificate public key)", pin), nil
+	case strings.HasPrefix(text, "-----BEGIN"):
+		priv, err := ParseIdentity(data)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (ed25519 identity)", PublicKeyFingerprint(priv.Public().(ed25519.PublicKey))), nil
+	case strings.HasPrefix(text, publicKeyPrefix):
+		pub, comment, err := ParsePublicKey(text)
+		if err != nil {
+			return "", err
+		}
+		if comment != "" {
+			return fmt.Sprintf("%s %s (ed25519 public key)", PublicKeyFingerprint(pub), comment), nil
+		}
+		return fmt.Sprintf("%s (ed25519 public key)", PublicKeyFingerprint(pub)), nil
+	case text != "":
+		return fmt.Sprintf("%s (symmetric key)", KeyFingerprint(text)), nil
+	default:
+		return "", fmt.Errorf("%s is empty", path)
+	}
+}
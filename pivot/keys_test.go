@@ -0,0 +1,78 @@
+package pivot
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyFromKeygenFile(t *testing.T) {
+	key, err := GenerateSymmetricKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if len(key) != symmetricKeySize*2 {
+		t.Errorf("Unexpected key length: %d", len(key))
+	}
+
+	path := filepath.Join(t.TempDir(), "pivot.key")
+	if err := WriteKeyFile(path, []byte(key+"\n"), 0o600, false); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	// Existing files are not replaced without force
+	if err := WriteKeyFile(path, []byte("other"), 0o600, false); !os.IsExist(err) {
+		t.Errorf("Expected file exists error, got: %v", err)
+	}
+
+	loaded, err := LoadKey("", path)
+	if err != nil {
+		t.Fatalf("Failed to load key: %v", err)
+	}
+	if loaded != key {
+		t.Errorf("Loaded key mismatch. Got: %s, Expected: %s", loaded, key)
+	}
+
+	if _, err := LoadKey("secret", path); err == nil {
+		t.Error("Expected error when both -key and -keyfile are set")
+	}
+}
+
+func TestIdentityRoundTrip(t *testing.T) {
+	priv, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	privPEM, err := MarshalIdentity(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal identity: %v", err)
+	}
+
+	parsed, err := ParseIdentity(privPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	if !parsed.Equal(priv) {
+		t.Error("Parsed identity doesn't match original")
+	}
+
+	pub := priv.Public().(ed25519.PublicKey)
+	line := MarshalPublicKey(pub, "operator one")
+
+	parsedPub, comment, err := ParsePublicKey(line)
+	if err != nil {
+		t.Fatalf("Failed to parse public key: %v", err)
+	}
+	if !parsedPub.Equal(pub) {
+		t.Error("Parsed public key doesn't match original")
+	}
+	if comment != "operator one" {
+		t.Errorf("Unexpected comment: %q", comment)
+	}
+
+	if _, _, err := ParsePublicKey("ssh-ed25519 AAAA"); err == nil {
+		t.Error("Expected error for foreign key type")
+	}
+}
@@ -0,0 +1,252 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var errAlreadyStarted = errors.New("already started")
+
+// lifecycle runs a server, agent or client between Start and Shutdown. Each
+// Start gets a fresh run, so a component can be started again once the
+// previous run is over.
+type lifecycle struct {
+	mu  sync.Mutex
+	run *run // nil when stopped
+}
+
+// run is one Start of a component. serving ends when the component stops
+// taking new work, on Shutdown, Drain or when Start's context ends. ctx ends
+// when the work in flight is over or abandoned: right away with Start's
+// context, once Shutdown runs out of time to let it finish, or once it is
+// done.
+type run struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	serving  context.Context
+	stop     context.CancelFunc
+	draining atomic.Bool
+
+	wg   sync.WaitGroup // goroutines doing the work of the run
+	held sync.WaitGroup // goroutines holding sessions for that work
+	done chan struct{}  // closed when Start returns
+}
+
+// begin starts a run under parent, unless one is going already
+func (l *lifecycle) begin(parent context.Context) (*run, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.run != nil {
+		return nil, errAlreadyStarted
+	}
+	r := &run{done: make(chan struct{})}
+	r.ctx, r.cancel = context.WithCancel(parent)
+	r.serving, r.stop = context.WithCancel(r.ctx)
+	l.run = r
+	return r, nil
+}
+
+// finish ends r once Start is done with it. It lets the work of the run wind
+// down, which it does once ctx ends unless it finishes by itself, and then
+// releases the sessions held for it.
+func (l *lifecycle) finish(r *run) {
+	// Stopping under the lock keeps within from adding work past this point
+	l.mu.Lock()
+	r.stop()
+	l.mu.Unlock()
+	r.wg.Wait()
+	r.cancel()
+	r.held.Wait()
+
+	l.mu.Lock()
+	l.run = nil
+	l.mu.Unlock()
+	close(r.done)
+}
+
+// current returns the run going on, if any
+func (l *lifecycle) current() *run {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.run
+}
+
+// within runs f as work of the current run, if one is still serving, and
+// reports whether it did. The run doesn't wind down until f returns, so f can
+// start more work on it.
+func (l *lifecycle) within(f func(r *run) error) (bool, error) {
+	l.mu.Lock()
+	r := l.run
+	if r == nil || r.serving.Err() != nil {
+		l.mu.Unlock()
+		return false, nil
+	}
+	r.wg.Add(1)
+	l.mu.Unlock()
+
+	defer r.wg.Done()
+	return true, f(r)
+}
+
+// shutdown stops the current run from taking new work and gives the work in
+// flight until ctx ends to finish before cancelling it. It returns once
+// Start has returned, and does nothing when the component isn't running.
+func (l *lifecycle) shutdown(ctx context.Context) error {
+	r := l.current()
+	if r == nil {
+		return nil
+	}
+
+	r.stop()
+	drained := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	r.cancel()
+	<-r.done
+	return err
+}
+
+// drain stops the current run from taking new work and asks the peers of
+// its sessions to open new streams elsewhere. The work in flight goes on
+// until it is done, however long that takes. drain waits for that until ctx
+// ends, and does nothing when the component isn't running.
+func (l *lifecycle) drain(ctx context.Context) error {
+	r := l.current()
+	if r == nil {
+		return nil
+	}
+
+	r.draining.Store(true)
+	r.stop()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// spawn runs f in a goroutine the run waits for
+func (r *run) spawn(f func()) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+// handle runs f for conn in a goroutine of the run. Cancelling the run
+// resets conn, which cuts short whatever f is blocked on, relays included.
+func (r *run) handle(conn net.Conn, f func(net.Conn)) {
+	r.spawn(func() {
+		stop := context.AfterFunc(r.ctx, func() { resetConn(conn) })
+		defer stop()
+		f(conn)
+	})
+}
+
+// hold runs f for conn, which carries a session, like handle does. The run
+// doesn't wait for f before its work is done, since that work may need the
+// session until the end.
+func (r *run) hold(conn net.Conn, f func(net.Conn)) {
+	r.held.Add(1)
+	go func() {
+		defer r.held.Done()
+		stop := context.AfterFunc(r.ctx, func() { conn.Close() })
+		defer stop()
+		f(conn)
+	}()
+}
+
+// keep waits until session ends or the run stops serving, and reports
+// whether the session ended. A draining run asks the peer to go elsewhere
+// and keeps the session until the run is over instead.
+func (r *run) keep(session Session) bool {
+	select {
+	case <-session.Done():
+		return true
+	case <-r.serving.Done():
+	}
+	if !r.draining.Load() {
+		return false
+	}
+
+	session.GoAway()
+	select {
+	case <-session.Done():
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// acceptor is a listener served by an accept loop of a run
+type acceptor struct {
+	listener net.Listener
+	cancel   context.CancelFunc
+	done     chan struct{} // closed once the loop has returned
+}
+
+// Addr returns the address the listener is bound to
+func (a *acceptor) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+// stop closes the listener and waits for its loop, which leaves the
+// connections already accepted be
+func (a *acceptor) stop() {
+	a.cancel()
+	<-a.done
+}
+
+// acceptLoop hands the connections listener accepts to handle, in a
+// goroutine of the run, until the run stops serving or the acceptor is
+// stopped, then closes listener. what names the connections in logs.
+func (r *run) acceptLoop(listener net.Listener, what string, handle func(net.Conn)) *acceptor {
+	return r.accept(listener, what, func(conn net.Conn) { r.handle(conn, handle) })
+}
+
+// acceptSessions is acceptLoop for connections carrying sessions, which
+// are handed to r.hold
+func (r *run) acceptSessions(listener net.Listener, what string, handle func(net.Conn)) *acceptor {
+	return r.accept(listener, what, func(conn net.Conn) { r.hold(conn, handle) })
+}
+
+func (r *run) accept(listener net.Listener, what string, serve func(net.Conn)) *acceptor {
+	ctx, cancel := context.WithCancel(r.serving)
+	a := &acceptor{listener: listener, cancel: cancel, done: make(chan struct{})}
+
+	r.spawn(func() {
+		defer close(a.done)
+		stop := context.AfterFunc(ctx, func() { listener.Close() })
+		defer stop()
+		defer listener.Close()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("Error accepting %s: %v", what, err)
+				continue
+			}
+			serve(conn)
+		}
+	})
+	return a
+}
@@ -0,0 +1,295 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestRun starts a run under ctx for code tested outside of Start. The
+// run is cancelled and waited for at the end of the test.
+func newTestRun(t *testing.T, ctx context.Context) *run {
+	var life lifecycle
+	r, err := life.begin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to begin a run: %v", err)
+	}
+	t.Cleanup(func() {
+		r.cancel()
+		life.finish(r)
+	})
+	return r
+}
+
+// startRole runs start in the background and returns the channel its
+// result arrives on
+func startRole(ctx context.Context, start func(context.Context) error) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- start(ctx) }()
+	return result
+}
+
+// waitStopped waits for the result of a role's Start
+func waitStopped(t *testing.T, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return")
+		return nil
+	}
+}
+
+func TestShutdownIdempotent(t *testing.T) {
+	h := newHarness(t)
+	server := newServer(h.key, ":"+h.freePort())
+	agent := newAgent(h.key, "127.0.0.1:"+h.freePort(), "127.0.0.1:"+h.freePort())
+	client := newClient(h.key, "127.0.0.1:1", "127.0.0.1:"+h.freePort())
+
+	// Shutting down what never started does nothing
+	for _, shutdown := range []func(context.Context) error{server.Shutdown, agent.Shutdown, client.Shutdown} {
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown before Start failed: %v", err)
+		}
+	}
+
+	result := startRole(h.ctx, agent.Start)
+	h.waitListening(agent.clientAddr)
+	if err := agent.Start(h.ctx); !errors.Is(err, errAlreadyStarted) {
+		t.Errorf("Expected a second Start to be refused, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := agent.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown #%d failed: %v", i+1, err)
+		}
+	}
+	if err := waitStopped(t, result); err != nil {
+		t.Errorf("Expected Start to return cleanly after Shutdown, got %v", err)
+	}
+}
+
+func TestStartCancel(t *testing.T) {
+	h := newHarness(t)
+	port := h.freePort()
+	addr := "127.0.0.1:" + port
+	server := newServer(h.key, ":"+port)
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+	result := startRole(ctx, server.Start)
+	h.waitListening(addr)
+
+	proxy, _ := h.startClient(addr)
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 1024)
+
+	// Cancelling Start's context tears the relay down without waiting for it
+	cancel()
+	if err := waitStopped(t, result); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Start to return the cancellation, got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the relay to end with the server")
+	}
+}
+
+func TestShutdownTimeoutCutsRelays(t *testing.T) {
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent()
+	h.startVictim(agent, internalAddr)
+
+	client := newClient(h.key, clientAddr, "127.0.0.1:"+h.freePort())
+	result := startRole(h.ctx, client.Start)
+	h.waitListening(client.localAddr)
+
+	conn, err := h.socks(client.localAddr, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+	h.echo(conn, 1024)
+
+	// The relay stays open, so the client gives up waiting and cuts it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the shutdown to time out, got %v", err)
+	}
+	if err := waitStopped(t, result); err != nil {
+		t.Errorf("Expected Start to return cleanly after Shutdown, got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the relay to be cut")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	h := newHarness(t)
+	clientAddr := "127.0.0.1:" + h.freePort()
+	internalAddr := "127.0.0.1:" + h.freePort()
+	localAddr := "127.0.0.1:" + h.freePort()
+
+	agent := newAgent(h.key, clientAddr, internalAddr)
+	server := newServer(h.key, internalAddr)
+	server.backoff = &Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}
+	client := newClient(h.key, clientAddr, localAddr)
+
+	// The same instances come back up on the same addresses
+	for i := 0; i < 2; i++ {
+		agentDone := startRole(h.ctx, agent.Start)
+		h.waitListening(clientAddr)
+		serverDone := startRole(h.ctx, server.Start)
+		h.waitFor("the victim session", func() bool { return agent.victims.get("") != nil })
+		clientDone := startRole(h.ctx, client.Start)
+		h.waitListening(localAddr)
+
+		conn, err := h.socks(localAddr, h.target)
+		if err != nil {
+			t.Fatalf("Run %d: SOCKS5 connect failed: %v", i+1, err)
+		}
+		h.echo(conn, 1024)
+		conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for _, shutdown := range []func(context.Context) error{client.Shutdown, server.Shutdown, agent.Shutdown} {
+			if err := shutdown(ctx); err != nil {
+				t.Errorf("Run %d: shutdown failed: %v", i+1, err)
+			}
+		}
+		cancel()
+		for _, done := range []<-chan error{clientDone, serverDone, agentDone} {
+			if err := waitStopped(t, done); err != nil {
+				t.Errorf("Run %d: Start failed: %v", i+1, err)
+			}
+		}
+		if agent.victims.get("") != nil {
+			t.Errorf("Run %d: expected the agent to drop the victim", i+1)
+		}
+	}
+}
+
+func TestDrainServer(t *testing.T) {
+	h := newHarness(t)
+	port := h.freePort()
+	addr := "127.0.0.1:" + port
+	server := newServer(h.key, ":"+port)
+	result := startRole(h.ctx, server.Start)
+	h.waitListening(addr)
+
+	proxy, _ := h.startClient(addr)
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Draining waits for the open relay however long it takes
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the drain to outlast its context, got %v", err)
+	}
+	if conn, err := h.socks(proxy, h.target); err == nil {
+		conn.Close()
+		t.Error("Expected a draining server to refuse new tunnels")
+	}
+	h.echo(conn, 1024)
+
+	conn.Close()
+	if err := waitStopped(t, result); err != nil {
+		t.Errorf("Expected Start to return cleanly once drained, got %v", err)
+	}
+}
+
+func TestDrainVictim(t *testing.T) {
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent()
+	h.startVictim(agent, internalAddr, func(s *Server) { s.name = "standby" })
+	standby := agent.victims.get("standby")
+
+	// The victim that connected last takes the streams
+	victim := newServer(h.key, internalAddr)
+	result := startRole(h.ctx, victim.Start)
+	h.waitFor("the second victim", func() bool { return agent.victims.get("") != standby })
+	proxy, _ := h.startClient(clientAddr)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	drained := make(chan error, 1)
+	go func() { drained <- victim.Drain(context.Background()) }()
+
+	// The agent moves new streams to the other victim once told
+	h.waitFor("the agent to pass over the draining victim", func() bool { return agent.victims.get("") == standby })
+	other, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect during the drain failed: %v", err)
+	}
+	h.echo(other, 1024)
+	other.Close()
+	h.echo(conn, 1024)
+
+	conn.Close()
+	if err := waitStopped(t, result); err != nil {
+		t.Errorf("Expected Start to return cleanly once drained, got %v", err)
+	}
+	if err := waitStopped(t, drained); err != nil {
+		t.Errorf("Drain failed: %v", err)
+	}
+}
+
+func TestDrainAgent(t *testing.T) {
+	h := newHarness(t)
+	clientAddr := "127.0.0.1:" + h.freePort()
+	internalAddr := "127.0.0.1:" + h.freePort()
+	agent := newAgent(h.key, clientAddr, internalAddr)
+	result := startRole(h.ctx, agent.Start)
+	h.waitListening(clientAddr)
+	h.startVictim(agent, internalAddr, func(s *Server) {
+		s.backoff = &Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}
+	})
+	proxy, _ := h.startClient(clientAddr)
+
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	// A new agent takes the addresses over while the old one drains, and
+	// the victim follows it without dropping the open relay
+	go agent.Drain(context.Background())
+	h.waitFor("the old agent to close its listeners", func() bool {
+		conn, err := net.Dial("tcp", clientAddr)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+	successor := newAgent(h.key, clientAddr, internalAddr)
+	go successor.Start(h.ctx)
+	h.shutdownOnCleanup(successor.Shutdown)
+	h.waitFor("the victim to reach the new agent", func() bool { return successor.victims.get("") != nil })
+
+	other, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect through the new agent failed: %v", err)
+	}
+	h.echo(other, 1024)
+	other.Close()
+	h.echo(conn, 1024)
+
+	conn.Close()
+	if err := waitStopped(t, result); err != nil {
+		t.Errorf("Expected Start to return cleanly once drained, got %v", err)
+	}
+}
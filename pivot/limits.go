@@ -0,0 +1,313 @@
+package pivot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errStreamLimit = errors.New("too many concurrent streams")
+	errStreamRate  = errors.New("new stream rate exceeded")
+)
+
+// Limits bounds the streams and bandwidth of each client and session, so one
+// aggressive scan can't take the whole uplink or run the pivot out of file
+// descriptors. Zero values mean no limit.
+type Limits struct {
+	ClientStreams  int     // concurrent streams per client address
+	SessionStreams int     // concurrent streams per session
+	StreamRate     float64 // new streams per second per client or session
+	Bandwidth      int64   // bytes per second per client or session, both directions together
+}
+
+// Validate checks the settings
+func (l Limits) Validate() error {
+	if l.ClientStreams < 0 || l.SessionStreams < 0 {
+		return fmt.Errorf("stream limits can't be negative")
+	}
+	if l.StreamRate < 0 || math.IsInf(l.StreamRate, 0) || math.IsNaN(l.StreamRate) {
+		return fmt.Errorf("stream rate must be a positive number")
+	}
+	if l.Bandwidth < 0 {
+		return fmt.Errorf("bandwidth can't be negative")
+	}
+	return nil
+}
+
+// unlimited reports whether a client or session allowed maxStreams
+// concurrent streams has no limits at all
+func (l Limits) unlimited(maxStreams int) bool {
+	return maxStreams == 0 && l.StreamRate == 0 && l.Bandwidth == 0
+}
+
+// newGroup returns the limits for one client or session allowed maxStreams
+// concurrent streams, or nil if nothing is limited
+func (l Limits) newGroup(maxStreams int) *limitGroup {
+	if l.unlimited(maxStreams) {
+		return nil
+	}
+
+	g := &limitGroup{maxStreams: maxStreams}
+	if l.StreamRate > 0 {
+		g.rate = newTokenBucket(l.StreamRate, math.Max(1, math.Ceil(l.StreamRate)))
+	}
+	if l.Bandwidth > 0 {
+		g.bandwidth = newTokenBucket(float64(l.Bandwidth), float64(l.Bandwidth))
+	}
+	return g
+}
+
+// limitGroup tracks the streams of one client or session. A nil group is
+// unlimited.
+type limitGroup struct {
+	maxStreams int
+	rate       *tokenBucket // new streams
+	bandwidth  *tokenBucket // bytes relayed by all of the group's streams
+
+	mu     sync.Mutex
+	active int
+}
+
+// acquire admits a new stream, which must be released when it ends
+func (g *limitGroup) acquire() error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.maxStreams > 0 && g.active >= g.maxStreams {
+		return errStreamLimit
+	}
+	if g.rate != nil && !g.rate.allow() {
+		return errStreamRate
+	}
+	g.active++
+	return nil
+}
+
+func (g *limitGroup) release() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+}
+
+// shaper returns the group's bandwidth bucket, nil if unlimited
+func (g *limitGroup) shaper() *tokenBucket {
+	if g == nil {
+		return nil
+	}
+	return g.bandwidth
+}
+
+// idle reports whether forgetting the group would lose nothing: no active
+// streams and nothing owed to its buckets
+func (g *limitGroup) idle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active == 0 && g.rate.full() && g.bandwidth.full()
+}
+
+// limiter hands out a limit group per client address and per session
+type limiter struct {
+	Limits // guarded by mu while serving
+
+	mu      sync.Mutex
+	clients map[string]*limitGroup
+}
+
+// current returns the limits in force
+func (l *limiter) current() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Limits
+}
+
+// set replaces the limits. Clients get a group under the new limits for
+// their next stream, while the streams already admitted finish in the old
+// one.
+func (l *limiter) set(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Limits = limits
+	l.clients = nil
+}
+
+// session returns a new limit group for a session, nil if unlimited
+func (l *limiter) session() *limitGroup {
+	limits := l.current()
+	return limits.newGroup(limits.SessionStreams)
+}
+
+// group returns the limit group of the client at addr, nil if unlimited
+func (l *limiter) group(addr net.Addr) *limitGroup {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.unlimited(l.ClientStreams) {
+		return nil
+	}
+	if g, ok := l.clients[host]; ok {
+		return g
+	}
+
+	// Forget clients that are gone before tracking a new one
+	for key, g := range l.clients {
+		if g.idle() {
+			delete(l.clients, key)
+		}
+	}
+	if l.clients == nil {
+		l.clients = make(map[string]*limitGroup)
+	}
+	g := l.newGroup(l.ClientStreams)
+	l.clients[host] = g
+	return g
+}
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait takes n tokens, sleeping until the bucket has refilled enough to cover
+// them or done is closed, and reports whether it slept the whole way.
+// Concurrent callers queue up behind each other's debt.
+func (b *tokenBucket) wait(n int, done <-chan struct{}) bool {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// full reports whether the bucket is back at its burst size. A nil bucket is
+// always full.
+func (b *tokenBucket) full() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// shapedReader holds reads back to the rate of a bandwidth bucket
+type shapedReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+	done   <-chan struct{} // cuts a wait for the bucket short
+}
+
+// shapeReader limits r to the bandwidth of bucket, nil for unlimited. Reads
+// stop waiting for the bucket and fail once done is closed.
+func shapeReader(r io.Reader, bucket *tokenBucket, done <-chan struct{}) io.Reader {
+	if bucket == nil {
+		return r
+	}
+	return &shapedReader{r: r, bucket: bucket, done: done}
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	// Reads no larger than the burst keep the flow smooth at low rates
+	if burst := int(s.bucket.burst); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := s.r.Read(p)
+	if n > 0 && !s.bucket.wait(n, s.done) {
+		return n, errRelayStopped
+	}
+	return n, err
+}
+
+// ParseByteRate parses a bandwidth such as 512k or 10M in bytes per second.
+// The suffixes k, m and g are powers of 1024.
+func ParseByteRate(s string) (int64, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+
+	digits, multiplier := s, int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		digits = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,165 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := map[string]int64{"": 0, "1000": 1000, "512k": 512 << 10, "10M": 10 << 20, "1g": 1 << 30}
+	for input, want := range tests {
+		got, err := ParseByteRate(input)
+		if err != nil || got != want {
+			t.Errorf("ParseByteRate(%q) = %d, %v; expected %d", input, got, err, want)
+		}
+	}
+	for _, bad := range []string{"k", "-1", "1.5m", "10x"} {
+		if _, err := ParseByteRate(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLimitGroup(t *testing.T) {
+	if g := (Limits{}).newGroup(0); g != nil {
+		t.Fatal("Expected no group without limits")
+	}
+
+	g := Limits{StreamRate: 0.001}.newGroup(2)
+	if err := g.acquire(); err != nil {
+		t.Fatalf("First stream refused: %v", err)
+	}
+	if err := g.acquire(); err != errStreamRate {
+		t.Errorf("Expected the stream rate to run out after the burst, got %v", err)
+	}
+
+	g = Limits{}.newGroup(2)
+	g.acquire()
+	g.acquire()
+	if err := g.acquire(); err != errStreamLimit {
+		t.Errorf("Expected the third concurrent stream to be refused, got %v", err)
+	}
+	g.release()
+	if err := g.acquire(); err != nil {
+		t.Errorf("Expected a released slot to be reused, got %v", err)
+	}
+}
+
+func TestLimiterGroupsByHost(t *testing.T) {
+	l := &limiter{Limits: Limits{ClientStreams: 1}}
+	a1 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	a2 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	b := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	if l.group(a1) != l.group(a2) {
+		t.Error("Expected connections from one host to share a group")
+	}
+	if l.group(a1) == l.group(b) {
+		t.Error("Expected different hosts to get their own groups")
+	}
+}
+
+func TestRelayShaped(t *testing.T) {
+	const size = 100 << 10
+	bucket := newTokenBucket(200<<10, 20<<10)
+
+	local, client := net.Pipe()
+	remote, target := net.Pipe()
+	go func() {
+		relayWith(client, remote, relayOptions{bandwidth: bucket})
+		client.Close()
+	}()
+	go func() {
+		target.Write(make([]byte, size))
+		target.Close()
+	}()
+
+	start := time.Now()
+	n, _ := io.Copy(io.Discard, local)
+	elapsed := time.Since(start)
+
+	if n != size {
+		t.Fatalf("Expected %d bytes, got %d", size, n)
+	}
+	// The burst goes out at once and the remaining 80k at 200k/s
+	if elapsed < 300*time.Millisecond {
+		t.Errorf("Expected shaping to take about 400ms, took %v", elapsed)
+	}
+}
+
+func TestRelayShapedStops(t *testing.T) {
+	// After the burst, the next read owes the bucket about 17 minutes
+	bucket := newTokenBucket(1, 1<<10)
+
+	local, client := net.Pipe()
+	remote, target := net.Pipe()
+	defer local.Close()
+	defer target.Close()
+	go io.Copy(io.Discard, local)
+	go target.Write(make([]byte, 4<<10))
+
+	done := make(chan struct{})
+	result := make(chan relayResult, 1)
+	go func() { result <- relayWith(client, remote, relayOptions{bandwidth: bucket, done: done}) }()
+
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	select {
+	case r := <-result:
+		if !errors.Is(r.reason, errRelayStopped) {
+			t.Errorf("Expected the relay to be stopped, got %v", r.reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the relay to stop without paying its debt")
+	}
+}
+
+func TestServerRefusesOverLimit(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, target)
+
+	remoteAddr, _ := startTunnelServer(t, "test-key", func(s *Server) {
+		s.limits.Limits = Limits{ClientStreams: 1}
+	})
+	client := newClient("test-key", remoteAddr, "127.0.0.1:0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connect := func() (net.Conn, error) {
+		conn, err := client.dialRemote(ctx, 1, client.remotes)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, NewSOCKS5Client("").handshake(conn, target.Addr().String())
+	}
+
+	first, err := connect()
+	if err != nil {
+		t.Fatalf("First stream failed: %v", err)
+	}
+
+	second, err := connect()
+	second.Close()
+	if err == nil || !strings.Contains(err.Error(), "code: 2") {
+		t.Errorf("Expected the second concurrent stream to be refused, got %v", err)
+	}
+
+	// The slot frees up once the first stream ends
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	third, err := connect()
+	if err != nil {
+		t.Errorf("Expected a stream after the first one ended, got %v", err)
+	}
+	third.Close()
+}
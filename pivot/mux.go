@@ -0,0 +1,638 @@
+package pivot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mux frame types
+const (
+	muxFrameOpen   = 0x01 // open a new stream
+	muxFrameData   = 0x02 // stream payload
+	muxFrameWindow = 0x03 // grant more receive window to the sender
+	muxFrameFin    = 0x04 // sender finished writing
+	muxFrameReset  = 0x05 // abort the stream
+	muxFramePing   = 0x06 // heartbeat, answered with a pong carrying the same nonce
+	muxFramePong   = 0x07 // heartbeat answer
+	muxFrameGoAway = 0x08 // open no more streams on this session
+)
+
+const (
+	// muxHeaderSize is type (1) + stream ID (4) + payload length (2)
+	muxHeaderSize = 7
+
+	// muxMaxPayload is the largest data frame payload
+	muxMaxPayload = 32 * 1024
+
+	// muxWindowSize is the per-stream receive buffer
+	muxWindowSize = 256 * 1024
+
+	// muxAcceptBacklog is the number of opened streams waiting for AcceptStream
+	muxAcceptBacklog = 256
+)
+
+var (
+	errMuxClosed      = errors.New("mux: session closed")
+	errMuxStreamReset = errors.New("mux: stream reset by peer")
+)
+
+// muxSession multiplexes streams over a single connection with per-stream
+// flow control, so one slow stream cannot stall the others
+type muxSession struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+
+	accept chan *muxStream
+	done   chan struct{}
+	once   sync.Once
+
+	goneAway     chan struct{}
+	goneAwayOnce sync.Once
+
+	heartbeat *heartbeat
+	replies   *replyQueue
+}
+
+func newMuxSession(conn net.Conn, isClient bool, hb HeartbeatConfig) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		streams:  make(map[uint32]*muxStream),
+		nextID:   2,
+		accept:   make(chan *muxStream, muxAcceptBacklog),
+		done:     make(chan struct{}),
+		goneAway: make(chan struct{}),
+		replies:  newReplyQueue(),
+	}
+	// Clients open odd stream IDs, servers even ones
+	if isClient {
+		s.nextID = 1
+	}
+
+	s.heartbeat = newHeartbeat(hb, func(nonce uint64) error {
+		return s.writeFrame(muxFramePing, 0, binary.BigEndian.AppendUint64(nil, nonce))
+	}, func() {
+		s.closeWithError(errHeartbeatTimeout)
+	})
+
+	go s.readLoop()
+	go s.heartbeat.run(s.done, conn.RemoteAddr().String())
+	go s.replies.run(s.done, func(nonce uint64) error {
+		return s.writeFrame(muxFramePong, 0, binary.BigEndian.AppendUint64(nil, nonce))
+	}, func(id uint32) error {
+		return s.writeFrame(muxFrameReset, id, nil)
+	})
+	return s
+}
+
+// OpenStream starts a new stream to the peer
+func (s *muxSession) OpenStream(ctx context.Context) (net.Conn, error) {
+	if goneAway(s) {
+		return nil, errGoneAway
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newMuxStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxFrameOpen, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream
+func (s *muxSession) AcceptStream(ctx context.Context) (net.Conn, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close tears down the session and all of its streams
+func (s *muxSession) Close() error {
+	s.closeWithError(errMuxClosed)
+	return nil
+}
+
+// Done is closed once the session has ended
+func (s *muxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// GoAway asks the peer to open no more streams on this session
+func (s *muxSession) GoAway() error {
+	return s.writeFrame(muxFrameGoAway, 0, nil)
+}
+
+// GoneAway is closed once the peer sent a go-away frame
+func (s *muxSession) GoneAway() <-chan struct{} {
+	return s.goneAway
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (s *muxSession) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *muxSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// RTT returns the heartbeat round-trip time
+func (s *muxSession) RTT() time.Duration {
+	return s.heartbeat.RTT()
+}
+
+func (s *muxSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *muxSession) closeWithError(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*muxStream)
+		s.mu.Unlock()
+
+		s.conn.Close()
+		close(s.done)
+
+		// Streams cut off with the session didn't finish, even when the
+		// session itself ended cleanly, so they must not read a plain EOF
+		if err == io.EOF {
+			err = errMuxClosed
+		}
+		for _, stream := range streams {
+			stream.abort(err)
+		}
+	})
+}
+
+// ours reports whether id is one of the stream IDs this side opens. The
+// caller holds mu.
+func (s *muxSession) ours(id uint32) bool {
+	return id%2 == s.nextID%2
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) writeFrame(frameType byte, id uint32, payload []byte) error {
+	header := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint16(header[5:7], uint16(len(payload)))
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+	}
+
+	// A single write keeps the frame intact on ciphers that encrypt per call.
+	// The frame is ours, so the cipher may encrypt it in place.
+	write := s.conn.Write
+	if w, ok := s.conn.(inPlaceWriter); ok {
+		write = w.writeInPlace
+	}
+	if _, err := write(append(header, payload...)); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			s.closeWithError(err)
+			return
+		}
+
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint16(header[5:7])
+		if length > muxMaxPayload {
+			s.closeWithError(fmt.Errorf("mux: frame of %d bytes exceeds limit", length))
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		if err := s.handleFrame(frameType, id, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handleFrame(frameType byte, id uint32, payload []byte) error {
+	switch frameType {
+	case muxFramePing, muxFramePong:
+		if len(payload) != 8 {
+			return errors.New("mux: malformed heartbeat")
+		}
+		if frameType == muxFramePing {
+			// Answer off the read loop so a blocked write can't stall reads
+			s.replies.pongLater(binary.BigEndian.Uint64(payload))
+		} else {
+			s.heartbeat.pong(binary.BigEndian.Uint64(payload))
+		}
+		return nil
+	}
+
+	if frameType == muxFrameGoAway {
+		s.goneAwayOnce.Do(func() { close(s.goneAway) })
+		return nil
+	}
+
+	if frameType == muxFrameOpen {
+		s.mu.Lock()
+		if s.ours(id) {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: peer opened stream %d, which is ours to open", id)
+		}
+		if _, exists := s.streams[id]; exists {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: duplicate stream %d", id)
+		}
+		stream := newMuxStream(s, id)
+		s.streams[id] = stream
+		s.mu.Unlock()
+
+		select {
+		case s.accept <- stream:
+		default:
+			log.Printf("Mux accept backlog full, resetting stream %d", id)
+			s.removeStream(id)
+			s.replies.resetLater(id)
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	stream := s.streams[id]
+	unopened := stream == nil && s.ours(id) && id >= s.nextID
+	s.mu.Unlock()
+
+	if unopened {
+		return fmt.Errorf("mux: frame for stream %d, which was never opened", id)
+	}
+	if stream == nil {
+		// Tell the sender to stop writing to a stream we no longer track
+		if frameType == muxFrameData {
+			s.replies.resetLater(id)
+		}
+		return nil
+	}
+
+	switch frameType {
+	case muxFrameData:
+		return stream.receive(payload)
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return errors.New("mux: malformed window update")
+		}
+		stream.grant(binary.BigEndian.Uint32(payload))
+	case muxFrameFin:
+		stream.remoteFinished()
+	case muxFrameReset:
+		stream.abort(errMuxStreamReset)
+		s.removeStream(id)
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", frameType)
+	}
+	return nil
+}
+
+// muxStream is one tunneled stream inside a muxSession
+type muxStream struct {
+	session *muxSession
+	id      uint32
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	sendWindow    uint32
+	unacked       uint32 // bytes read by the application but not yet granted back
+	remoteFin     bool
+	localFin      bool
+	closed        bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newMuxStream(session *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:    session,
+		id:         id,
+		sendWindow: muxWindowSize,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// receive buffers payload from the peer
+func (st *muxStream) receive(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return nil
+	}
+	if st.buf.Len()+len(payload) > muxWindowSize {
+		return fmt.Errorf("mux: stream %d exceeded its receive window", st.id)
+	}
+	st.buf.Write(payload)
+	notify(st.readReady)
+	return nil
+}
+
+// grant adds send window after the peer consumed data
+func (st *muxStream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+func (st *muxStream) remoteFinished() {
+	st.mu.Lock()
+	st.remoteFin = true
+	done := st.localFin
+	st.mu.Unlock()
+	notify(st.readReady)
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+// abort fails pending and future reads and writes
+func (st *muxStream) abort(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+// wait blocks until ch is signalled, the deadline passes or the session ends
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.done:
+		return nil
+	}
+}
+
+// Read reads data sent by the peer
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.unacked += uint32(n)
+			var grant uint32
+			if st.unacked >= muxWindowSize/2 && !st.remoteFin {
+				grant = st.unacked
+				st.unacked = 0
+			}
+			st.mu.Unlock()
+
+			if grant > 0 {
+				update := make([]byte, 4)
+				binary.BigEndian.PutUint32(update, grant)
+				st.session.writeFrame(muxFrameWindow, st.id, update)
+			}
+			return n, nil
+		}
+		if st.remoteFin {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.err != nil || st.closed {
+			err := st.err
+			if err == nil {
+				err = net.ErrClosed
+			}
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+		if st.session.closeErr() != nil {
+			st.abort(st.session.closeErr())
+		}
+	}
+}
+
+// Write sends p to the peer, blocking while the peer's window is full
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.err != nil || st.closed || st.localFin {
+			err := st.err
+			if err == nil {
+				err = net.ErrClosed
+			}
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeReady, deadline); err != nil {
+				return written, err
+			}
+			if err := st.session.closeErr(); err != nil {
+				st.abort(err)
+			}
+			continue
+		}
+
+		n := len(p) - written
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxFrameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data will be sent
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localFin || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFin = true
+	done := st.remoteFin
+	st.mu.Unlock()
+
+	err := st.session.writeFrame(muxFrameFin, st.id, nil)
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// reset aborts the stream, so the peer reads an error rather than the end
+// of the data
+func (st *muxStream) reset() error {
+	st.mu.Lock()
+	live := !st.closed && st.err == nil
+	if live {
+		st.err = net.ErrClosed
+	}
+	st.mu.Unlock()
+
+	if live {
+		st.session.writeFrame(muxFrameReset, st.id, nil)
+	}
+	return st.Close()
+}
+
+// Close finishes the stream. Data still arriving from the peer is discarded
+// and answered with a reset.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFin := !st.localFin && st.err == nil
+	st.localFin = true
+	st.buf.Reset()
+	st.mu.Unlock()
+
+	notify(st.readReady)
+	notify(st.writeReady)
+	st.session.removeStream(st.id)
+
+	if sendFin {
+		return st.session.writeFrame(muxFrameFin, st.id, nil)
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the session
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return nil
+}
@@ -0,0 +1,241 @@
+package pivot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// muxPair returns both ends of a mux session over an in-memory pipe
+func muxPair(t *testing.T) (client, server Session) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client = newMuxSession(c1, true, DefaultHeartbeat())
+	server = newMuxSession(c2, false, DefaultHeartbeat())
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// serveEchoStreams echoes every stream the session accepts
+func serveEchoStreams(session Session) {
+	go func() {
+		for {
+			stream, err := session.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func(stream net.Conn) {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}(stream)
+		}
+	}()
+}
+
+// echoStream writes payload on a new stream and checks it comes back intact
+func echoStream(t *testing.T, session Session, size int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := session.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	payload := make([]byte, size)
+	rand.Read(payload)
+	go stream.Write(payload)
+
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(stream, echoed); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Error("Echoed payload doesn't match")
+	}
+}
+
+func TestMuxStreamsBothDirections(t *testing.T) {
+	client, server := muxPair(t)
+	serveEchoStreams(client)
+	serveEchoStreams(server)
+
+	// More than the receive window, so flow control has to kick in
+	echoStream(t, client, 4*muxWindowSize)
+	echoStream(t, server, 4*muxWindowSize)
+}
+
+func TestMuxSlowStreamDoesNotBlockOthers(t *testing.T) {
+	client, server := muxPair(t)
+
+	ctx := context.Background()
+	slow, err := client.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	// Fill the slow stream's window without anyone reading it
+	if _, err := slow.Write(make([]byte, muxWindowSize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := server.AcceptStream(ctx); err != nil {
+		t.Fatalf("AcceptStream failed: %v", err)
+	}
+
+	serveEchoStreams(server)
+	echoStream(t, client, 64*1024)
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	client, server := muxPair(t)
+	serveEchoStreams(server)
+
+	stream, err := client.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	stream.Write([]byte("hello"))
+	if err := stream.(*muxStream).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+
+	// The echo side sees EOF, finishes its copy and closes its end
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(reply) != "hello" {
+		t.Errorf("Expected reply %q, got %q", "hello", reply)
+	}
+}
+
+func TestMuxSessionClose(t *testing.T) {
+	client, server := muxPair(t)
+
+	stream, err := client.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	server.Close()
+
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client session didn't notice the closed link")
+	}
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected read on a dead session to fail")
+	}
+	if _, err := client.OpenStream(context.Background()); err == nil {
+		t.Error("Expected OpenStream on a dead session to fail")
+	}
+}
+
+func TestMuxGoAway(t *testing.T) {
+	client, server := muxPair(t)
+	serveEchoStreams(server)
+
+	stream, err := client.OpenStream(context.Background())
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer stream.Close()
+
+	if err := server.GoAway(); err != nil {
+		t.Fatalf("GoAway failed: %v", err)
+	}
+	select {
+	case <-client.GoneAway():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client never heard the server going away")
+	}
+	if _, err := client.OpenStream(context.Background()); !errors.Is(err, errGoneAway) {
+		t.Errorf("Expected OpenStream to be refused, got %v", err)
+	}
+
+	// The stream opened before carries on, and so does the other direction
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	stream.Write([]byte("still here"))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "still here" {
+		t.Errorf("Expected the open stream to keep working, got %q: %v", reply, err)
+	}
+	serveEchoStreams(client)
+	echoStream(t, server, 1024)
+}
+
+// muxFrame encodes a raw frame as a peer would send it
+func muxFrame(frameType byte, id uint32, payload []byte) []byte {
+	frame := []byte{frameType}
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestMuxFloodStaysBounded(t *testing.T) {
+	local, peer := net.Pipe()
+	session := newMuxSession(local, false, HeartbeatConfig{})
+	defer session.Close()
+	defer peer.Close()
+	before := runtime.NumGoroutine()
+
+	// A peer that never reads pings and writes to streams that don't exist,
+	// each owed an answer that can't be sent
+	ping := muxFrame(muxFramePing, 0, make([]byte, 8))
+	peer.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	for i := uint32(0); i < 5000; i++ {
+		if _, err := peer.Write(ping); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if _, err := peer.Write(muxFrame(muxFrameData, 2*i+1, []byte("x"))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	if grown := runtime.NumGoroutine() - before; grown > 10 {
+		t.Errorf("Expected the answers to wait in a bounded queue, %d goroutines were started", grown)
+	}
+	session.replies.mu.Lock()
+	pending := len(session.replies.resets)
+	session.replies.mu.Unlock()
+	if pending > maxPendingResets {
+		t.Errorf("Expected at most %d pending resets, got %d", maxPendingResets, pending)
+	}
+}
+
+func TestMuxRejectsOpenWithOurParity(t *testing.T) {
+	local, peer := net.Pipe()
+	session := newMuxSession(local, false, HeartbeatConfig{})
+	defer session.Close()
+	defer peer.Close()
+
+	// Even IDs are the server's to open
+	go peer.Write(muxFrame(muxFrameOpen, 2, nil))
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the session to end on a stream opened with its own parity")
+	}
+	if err := session.closeErr(); err == nil || !strings.Contains(err.Error(), "ours to open") {
+		t.Errorf("Expected a parity error, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package pivot
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+var errKeyRequired = errors.New("key is required unless the cipher is none")
+
+// ServerOptions configures a Server. Zero fields take their defaults.
+type ServerOptions struct {
+	Key string // tunnel key, may only be empty with CipherNone
+
+	// Addr is the tunnel address to listen on, such as ":1080" or
+	// "quic://:443". An address with a host makes the server dial an agent
+	// there instead, trying Fallbacks in order when it can't be reached.
+	Addr      string
+	Fallbacks []string
+	Stdio     bool // serve a single tunnel over stdin/stdout, ignoring Addr
+
+	Name    string   // announced when dialing an agent, used in client routes
+	HopAddr string   // where downstream servers of multi-hop routes dial in
+	Domains []string // internal domains reported to clients for PAC files
+
+	Cipher    string         // CipherRC4 if empty
+	Auth      *Authenticator // public-key handshake, nil for none
+	Transport *Transport
+	Backoff   *Backoff         // reconnect policy for dialing agents
+	Heartbeat *HeartbeatConfig // DefaultHeartbeat if nil
+	Timeouts  *Timeouts        // DefaultTimeouts if nil
+	Limits    Limits
+}
+
+// NewServer creates a server from opts. It is started with Start and
+// stopped with Shutdown.
+func NewServer(opts ServerOptions) (*Server, error) {
+	s := newServer(opts.Key, opts.Addr)
+	s.stdio = opts.Stdio
+	s.name = opts.Name
+	s.hopAddr = opts.HopAddr
+	s.fallbacks = opts.Fallbacks
+	s.auth = opts.Auth
+	s.limits.Limits = opts.Limits
+
+	common, err := resolveCommon(opts.Key, opts.Cipher, opts.Transport, opts.Heartbeat, opts.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+	s.cipher, s.transport, s.heartbeat, s.timeouts = common.cipher, common.transport, common.heartbeat, common.timeouts
+
+	if s.stdio {
+		err = checkLinkCipher(s.cipher)
+	} else {
+		err = CheckCipher(s.cipher, append([]string{s.listenAddr}, s.fallbacks...)...)
+	}
+	if err == nil && s.hopAddr != "" {
+		err = CheckCipher(s.cipher, s.hopAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.name != "" {
+		if err := checkHopName(s.name); err != nil {
+			return nil, err
+		}
+	}
+	for _, domain := range opts.Domains {
+		domain = normalizeDomain(domain)
+		if err := checkDomain(domain); err != nil {
+			return nil, err
+		}
+		s.domains = append(s.domains, domain)
+	}
+
+	if opts.Backoff != nil {
+		if err := opts.Backoff.Validate(); err != nil {
+			return nil, err
+		}
+		s.backoff = opts.Backoff
+	}
+	if err := opts.Limits.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AgentOptions configures an Agent. Zero fields take their defaults.
+type AgentOptions struct {
+	Key          string // tunnel key, may only be empty with CipherNone
+	ClientAddr   string // where clients connect
+	InternalAddr string // where victim servers connect
+
+	Cipher    string         // CipherRC4 if empty
+	Auth      *Authenticator // public-key handshake, nil for none
+	Transport *Transport
+	Heartbeat *HeartbeatConfig // DefaultHeartbeat if nil
+	Timeouts  *Timeouts        // DefaultTimeouts if nil
+	Limits    Limits           // per client address, SessionStreams is unused
+}
+
+// NewAgent creates an agent from opts. It is started with Start and stopped
+// with Shutdown.
+func NewAgent(opts AgentOptions) (*Agent, error) {
+	a := newAgent(opts.Key, opts.ClientAddr, opts.InternalAddr)
+	a.auth = opts.Auth
+	a.limits.Limits = opts.Limits
+
+	common, err := resolveCommon(opts.Key, opts.Cipher, opts.Transport, opts.Heartbeat, opts.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+	a.cipher, a.transport, a.heartbeat, a.timeouts = common.cipher, common.transport, common.heartbeat, common.timeouts
+	if err := CheckCipher(a.cipher, a.clientAddr, a.internalAddr); err != nil {
+		return nil, err
+	}
+	if err := opts.Limits.Validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ClientOptions configures a Client. Zero fields take their defaults.
+type ClientOptions struct {
+	Key string // tunnel key, may only be empty with CipherNone
+
+	// Remotes are the servers or agents to connect to. With more than one,
+	// Strategy picks among them and health checks run every HealthInterval,
+	// or DefaultHealthInterval if it is 0. A negative interval disables them.
+	Remotes        []string
+	Strategy       string // StrategyFailover if empty
+	HealthInterval time.Duration
+
+	// Link replaces Remotes with a single session over the connection it
+	// returns, such as StdioLink or ExecLink. It is called again whenever
+	// the session ends. LinkName tells links apart, such as by the command
+	// of an ExecLink, so a reload can report one that changed.
+	Link     func() (net.Conn, error)
+	LinkName string
+
+	Route []string // named pivots to pass through behind the remote
+	Rules *RuleSet // per-destination routing, nil to send everything on
+
+	LocalAddr string // SOCKS5 address Start listens on
+	PACAddr   string // HTTP address Start serves the PAC file on, if set
+
+	Cipher    string         // CipherRC4 if empty
+	Auth      *Authenticator // public-key handshake, nil for none
+	Transport *Transport
+	Heartbeat *HeartbeatConfig // DefaultHeartbeat if nil
+	Timeouts  *Timeouts        // DefaultTimeouts if nil
+}
+
+// NewClient creates a client from opts. Start serves SOCKS5 on LocalAddr;
+// DialContext works without it.
+func NewClient(opts ClientOptions) (*Client, error) {
+	if opts.Link != nil && len(opts.Remotes) > 0 {
+		return nil, errors.New("remotes and a link are mutually exclusive")
+	}
+	if opts.Link == nil && len(opts.Remotes) == 0 {
+		return nil, errors.New("a remote or a link is required")
+	}
+
+	c := newClient(opts.Key, strings.Join(opts.Remotes, ","), opts.LocalAddr)
+	c.link, c.linkName = opts.Link, opts.LinkName
+	c.route = opts.Route
+	c.rules = opts.Rules
+	c.pacAddr = opts.PACAddr
+	c.auth = opts.Auth
+
+	common, err := resolveCommon(opts.Key, opts.Cipher, opts.Transport, opts.Heartbeat, opts.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+	c.cipher, c.transport, c.heartbeat, c.timeouts = common.cipher, common.transport, common.heartbeat, common.timeouts
+
+	if opts.Strategy != "" {
+		if err := checkStrategy(opts.Strategy); err != nil {
+			return nil, err
+		}
+		c.remotes.strategy = opts.Strategy
+	}
+	switch {
+	case opts.HealthInterval < 0:
+		c.remotes.interval = 0
+	case opts.HealthInterval > 0:
+		c.remotes.interval = opts.HealthInterval
+	}
+
+	if c.link != nil {
+		err = checkLinkCipher(c.cipher)
+	} else {
+		err = CheckCipher(c.cipher, opts.Remotes...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, hop := range c.route {
+		if err := checkHopName(hop); err != nil {
+			return nil, err
+		}
+	}
+	if c.rules != nil {
+		for _, addrs := range c.rules.Remotes() {
+			if err := CheckCipher(c.cipher, addrs...); err != nil {
+				return nil, err
+			}
+		}
+		c.setupRules()
+	}
+	return c, nil
+}
+
+// commonSettings are the settings every role shares
+type commonSettings struct {
+	cipher    string
+	transport *Transport
+	heartbeat HeartbeatConfig
+	timeouts  Timeouts
+}
+
+// resolveCommon checks the settings every role shares and fills in the
+// defaults of those left unset
+func resolveCommon(key, cipher string, transport *Transport, heartbeat *HeartbeatConfig, timeouts *Timeouts) (commonSettings, error) {
+	common := commonSettings{
+		cipher:    cipher,
+		transport: transport,
+		heartbeat: DefaultHeartbeat(),
+		timeouts:  DefaultTimeouts(),
+	}
+	if common.cipher == "" {
+		common.cipher = CipherRC4
+	}
+	if key == "" && common.cipher != CipherNone {
+		return common, errKeyRequired
+	}
+	if common.transport == nil {
+		common.transport = NewTransport()
+	}
+	if heartbeat != nil {
+		if err := heartbeat.Validate(); err != nil {
+			return common, err
+		}
+		common.heartbeat = *heartbeat
+	}
+	if timeouts != nil {
+		if err := timeouts.Validate(); err != nil {
+			return common, err
+		}
+		common.timeouts = *timeouts
+	}
+	return common, nil
+}
@@ -0,0 +1,159 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// The client plugs into x/net/proxy as a dialer
+var (
+	_ proxy.Dialer        = (*Client)(nil)
+	_ proxy.ContextDialer = (*Client)(nil)
+)
+
+func TestNewServerDefaults(t *testing.T) {
+	server, err := NewServer(ServerOptions{Key: "k", Addr: ":1080", Domains: []string{".Corp.Example."}})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if server.cipher != CipherRC4 || server.transport == nil || server.backoff == nil {
+		t.Errorf("Expected the defaults, got cipher %q, transport %v, backoff %v", server.cipher, server.transport, server.backoff)
+	}
+	if server.heartbeat != DefaultHeartbeat() || server.timeouts != DefaultTimeouts() {
+		t.Errorf("Expected the default heartbeat and timeouts, got %+v and %+v", server.heartbeat, server.timeouts)
+	}
+	if len(server.domains) != 1 || server.domains[0] != "corp.example" {
+		t.Errorf("Expected the domain to be normalized, got %q", server.domains)
+	}
+
+	// Set sub-configurations replace the defaults, even when zero
+	server, err = NewServer(ServerOptions{Key: "k", Addr: ":1080", Heartbeat: &HeartbeatConfig{}})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if server.heartbeat.Interval != 0 {
+		t.Errorf("Expected heartbeats to be disabled, got %+v", server.heartbeat)
+	}
+}
+
+func TestNewServerInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ServerOptions
+	}{
+		{"no key", ServerOptions{Addr: ":1080"}},
+		{"unknown cipher", ServerOptions{Key: "k", Addr: ":1080", Cipher: "aes"}},
+		{"none over plain tcp", ServerOptions{Addr: ":1080", Cipher: CipherNone}},
+		{"none over stdio", ServerOptions{Stdio: true, Cipher: CipherNone}},
+		{"plain fallback", ServerOptions{Addr: "tls://agent:443", Fallbacks: []string{"agent:80"}, Cipher: CipherNone}},
+		{"bad name", ServerOptions{Key: "k", Addr: "agent:8000", Name: "a/b"}},
+		{"bad domain", ServerOptions{Key: "k", Addr: ":1080", Domains: []string{"bad domain"}}},
+		{"bad backoff", ServerOptions{Key: "k", Addr: "agent:8000", Backoff: &Backoff{}}},
+		{"bad heartbeat", ServerOptions{Key: "k", Addr: ":1080", Heartbeat: &HeartbeatConfig{Interval: time.Second}}},
+		{"bad timeouts", ServerOptions{Key: "k", Addr: ":1080", Timeouts: &Timeouts{}}},
+		{"bad limits", ServerOptions{Key: "k", Addr: ":1080", Limits: Limits{ClientStreams: -1}}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewServer(tt.opts); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestNewAgentInvalid(t *testing.T) {
+	if _, err := NewAgent(AgentOptions{ClientAddr: ":1080", InternalAddr: ":8000"}); !errors.Is(err, errKeyRequired) {
+		t.Errorf("Expected a missing key error, got %v", err)
+	}
+	if _, err := NewAgent(AgentOptions{ClientAddr: "tls://:1080", InternalAddr: ":8000", Cipher: CipherNone}); err == nil {
+		t.Error("Expected the none cipher to be refused on a plain internal address")
+	}
+	if _, err := NewAgent(AgentOptions{ClientAddr: "tls://:1080", InternalAddr: "quic://:8000", Cipher: CipherNone}); err != nil {
+		t.Errorf("Expected the none cipher over encrypted transports to be fine, got %v", err)
+	}
+}
+
+func TestNewClientOptions(t *testing.T) {
+	link := func() (net.Conn, error) { return nil, errors.New("unused") }
+	invalid := []ClientOptions{
+		{Key: "k"},
+		{Key: "k", Remotes: []string{"a:1"}, Link: link},
+		{Key: "k", Remotes: []string{"a:1"}, Strategy: "random"},
+		{Key: "k", Link: link, Cipher: CipherNone},
+		{Key: "k", Remotes: []string{"a:1"}, Route: []string{"dmz", ""}},
+	}
+	for _, opts := range invalid {
+		if _, err := NewClient(opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+
+	client, err := NewClient(ClientOptions{Key: "k", Remotes: []string{"a:1", "b:1"}, HealthInterval: -1})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if client.remotes.strategy != StrategyFailover || client.remotes.interval != 0 {
+		t.Errorf("Expected failover without health checks, got %s every %v", client.remotes.strategy, client.remotes.interval)
+	}
+}
+
+func TestClientDialContext(t *testing.T) {
+	h := newHarness(t)
+	serverAddr, _ := h.startServer()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through the tunnel")
+	}))
+	defer web.Close()
+
+	rules, err := ParseRules(strings.NewReader("10.0.0.0/8 reject\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+
+	// The client is never started, it only dials
+	client, err := NewClient(ClientOptions{Key: h.key, Remotes: []string{serverAddr}, Rules: rules})
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: client.DialContext}}
+	defer httpClient.CloseIdleConnections()
+
+	resp, err := httpClient.Get(web.URL)
+	if err != nil {
+		t.Fatalf("GET through the client failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "through the tunnel" {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	if _, err := client.Dial("tcp", "10.1.2.3:80"); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("Expected the rules to reject the destination, got %v", err)
+	}
+	if _, err := client.Dial("udp", web.Listener.Addr().String()); err == nil {
+		t.Error("Expected UDP to be refused")
+	}
+
+	// A closed target gets the server's failure reply as an error
+	if _, err := client.Dial("tcp", "127.0.0.1:"+h.freePort()); err == nil {
+		t.Error("Expected dialing a closed port to fail")
+	}
+
+	// Cancelling the context stops a dial
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.DialContext(ctx, "tcp", web.Listener.Addr().String()); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled dial, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy auto-config. The client serves a PAC file over HTTP that mirrors its
+// routing rules, so a browser only sends the hosts the rules tunnel or reject
+// to the local SOCKS5 port. Domains reported by the server are tunneled too,
+// ahead of any catch-all rule.
+
+const (
+	// pacRefresh is how long the server's domains are reused before asking
+	// again
+	pacRefresh = 5 * time.Minute
+
+	pacQueryTimeout = 10 * time.Second
+)
+
+// pacPortFunc extracts the destination port from the URL a browser passes to
+// FindProxyForURL
+const pacPortFunc = `function pacPort(url) {
+	var m = url.match(/^([a-z]+):\/\/(?:[^\/@]*@)?(?:\[[^\]]*\]|[^\/:]*)(?::(\d+))?/i);
+	if (m && m[2]) return parseInt(m[2], 10);
+	return m && (m[1] == "https" || m[1] == "wss") ? 443 : 80;
+}
+`
+
+// GeneratePAC builds a PAC file sending hosts to proxy, a PAC proxy string
+// such as "SOCKS5 127.0.0.1:1081", or direct as the rules say. Without a
+// matching rule hosts take the default action and go to the proxy.
+func GeneratePAC(rules *RuleSet, domains []string, proxy string) string {
+	var b strings.Builder
+	b.WriteString("// Generated by pivot-internal\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "\tvar proxy = %s;\n", strconv.Quote(proxy))
+	b.WriteString("\tvar port = pacPort(url);\n")
+	b.WriteString("\tvar ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+
+	writeDomains := func() {
+		if len(domains) == 0 {
+			return
+		}
+		b.WriteString("\n\t// Internal domains reported by the server\n")
+		for _, domain := range domains {
+			fmt.Fprintf(&b, "\tif (%s) return proxy;\n", pacDomain(domain))
+		}
+		domains = nil
+	}
+
+	var ruleList []*Rule
+	if rules != nil {
+		ruleList = rules.rules
+	}
+	for _, rule := range ruleList {
+		if rule.any && len(rule.ports) == 0 {
+			writeDomains()
+		}
+
+		fmt.Fprintf(&b, "\n\t// %s\n", rule)
+		cond, ok := pacCondition(rule)
+		if !ok {
+			b.WriteString("\t// IPv6 networks can't be matched in a PAC file\n")
+			continue
+		}
+		result := "proxy"
+		if rule.Action == ActionDirect {
+			result = `"DIRECT"`
+		}
+		fmt.Fprintf(&b, "\tif (%s) return %s;\n", cond, result)
+	}
+	writeDomains()
+
+	b.WriteString("\n\treturn proxy;\n}\n\n")
+	b.WriteString(pacPortFunc)
+	return b.String()
+}
+
+// pacDomain matches a domain and its subdomains
+func pacDomain(domain string) string {
+	return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(domain), strconv.Quote("."+domain))
+}
+
+// pacCondition translates a rule's match into JavaScript. Hosts are never
+// resolved, so networks only match IPv4 literals like on the client.
+func pacCondition(rule *Rule) (string, bool) {
+	var conds []string
+
+	switch {
+	case rule.any:
+	case rule.prefix.IsValid():
+		if !rule.prefix.Addr().Is4() {
+			return "", false
+		}
+		mask := net.CIDRMask(rule.prefix.Bits(), 32)
+		conds = append(conds, fmt.Sprintf("ip && isInNet(host, %q, %q)",
+			rule.prefix.Addr().String(), netip.AddrFrom4([4]byte(mask)).String()))
+	default:
+		conds = append(conds, "("+pacDomain(rule.domain)+")")
+	}
+
+	if len(rule.ports) > 0 {
+		var ports []string
+		for _, pr := range rule.ports {
+			if pr.low == pr.high {
+				ports = append(ports, fmt.Sprintf("port == %d", pr.low))
+			} else {
+				ports = append(ports, fmt.Sprintf("(port >= %d && port <= %d)", pr.low, pr.high))
+			}
+		}
+		conds = append(conds, "("+strings.Join(ports, " || ")+")")
+	}
+
+	if len(conds) == 0 {
+		return "true", true
+	}
+	return strings.Join(conds, " && "), true
+}
+
+// startPAC serves the PAC file on addr until r stops serving or the
+// acceptor is stopped
+func (c *Client) startPAC(r *run, addr string) (*acceptor, error) {
+	listener, err := listenTCP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for PAC requests on %s: %v", addr, err)
+	}
+	pacServer := &http.Server{
+		Handler:           http.HandlerFunc(c.handlePAC),
+		ReadHeaderTimeout: handshakeTimeout,
+	}
+
+	ctx, cancel := context.WithCancel(r.serving)
+	a := &acceptor{listener: listener, cancel: cancel, done: make(chan struct{})}
+	stop := context.AfterFunc(ctx, func() { pacServer.Close() })
+	r.spawn(func() {
+		defer close(a.done)
+		defer stop()
+		if err := pacServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("PAC server on %s stopped: %v", listener.Addr(), err)
+		}
+	})
+
+	log.Printf("Serving PAC file at http://%s/proxy.pac", listener.Addr())
+	return a, nil
+}
+
+func (c *Client) handlePAC(w http.ResponseWriter, r *http.Request) {
+	domains := c.serverDomains(r.Context())
+	pac := GeneratePAC(c.settings().rules, domains, "SOCKS5 "+c.pacProxyAddr(r))
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(pac))
+	log.Printf("Served PAC file to %s with %d server domains", r.RemoteAddr, len(domains))
+}
+
+// pacProxyAddr returns the SOCKS5 address browsers should use. A wildcard
+// listen address is replaced with the host the PAC file was fetched from.
+func (c *Client) pacProxyAddr(r *http.Request) string {
+	c.mu.Lock()
+	addr := c.local.Addr().(*net.TCPAddr)
+	c.mu.Unlock()
+	if !addr.IP.IsUnspecified() {
+		return addr.String()
+	}
+
+	host := "127.0.0.1"
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	} else if r.Host != "" {
+		host = r.Host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(addr.Port))
+}
+
+// serverDomains returns the internal domains reported by the server behind
+// the default remote and route. A failed query keeps the last known list.
+func (c *Client) serverDomains(ctx context.Context) []string {
+	c.pacMu.Lock()
+	defer c.pacMu.Unlock()
+
+	if time.Since(c.pacFetched) < pacRefresh {
+		return c.pacDomains
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pacQueryTimeout)
+	defer cancel()
+
+	connID := atomic.AddInt32(&c.connCount, 1)
+	cfg := c.settings()
+	remote, err := c.openRemote(ctx, connID, cfg.remotes)
+	if err != nil {
+		log.Printf("Connection #%d: Failed to query server domains: %v", connID, err)
+		return c.pacDomains
+	}
+	defer remote.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		remote.SetDeadline(deadline)
+	}
+
+	var domains []string
+	err = writeRoute(remote, cfg.route)
+	if err == nil {
+		domains, err = queryDomains(remote)
+	}
+	if err != nil {
+		log.Printf("Connection #%d: Failed to query server domains: %v", connID, err)
+		return c.pacDomains
+	}
+
+	c.pacDomains = domains
+	c.pacFetched = time.Now()
+	return domains
+}
@@ -0,0 +1,77 @@
+package pivot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(
+		"10.0.0.0/8 default\n[fd00::/8] default\n*.corp.example:80,8000-8999 default\n*:25 reject\n* direct\n"))
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+
+	pac := GeneratePAC(rules, []string{"ad.internal"}, "SOCKS5 127.0.0.1:1081")
+
+	for _, want := range []string{
+		`var proxy = "SOCKS5 127.0.0.1:1081";`,
+		`if (ip && isInNet(host, "10.0.0.0", "255.0.0.0")) return proxy;`,
+		`// IPv6 networks can't be matched in a PAC file`,
+		`if ((host == "corp.example" || dnsDomainIs(host, ".corp.example")) && (port == 80 || (port >= 8000 && port <= 8999))) return proxy;`,
+		`if ((port == 25)) return proxy;`,
+		`if (true) return "DIRECT";`,
+		`function pacPort(url)`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC file is missing %q:\n%s", want, pac)
+		}
+	}
+
+	// Reported domains go ahead of the catch-all rule
+	domain := strings.Index(pac, `dnsDomainIs(host, ".ad.internal")`)
+	catchAll := strings.Index(pac, `return "DIRECT"`)
+	if domain < 0 || domain > catchAll {
+		t.Errorf("Expected the reported domain before the catch-all rule:\n%s", pac)
+	}
+
+	// Without rules everything goes to the proxy
+	if pac := GeneratePAC(nil, nil, "SOCKS5 127.0.0.1:1081"); strings.Contains(pac, "DIRECT") {
+		t.Errorf("Expected no direct hosts without rules:\n%s", pac)
+	}
+}
+
+func TestLocalDomains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	os.WriteFile(path, []byte("nameserver 10.0.0.53\ndomain Corp.Example.\nsearch corp.example lab.internal\n"), 0600)
+
+	saved := resolvConf
+	resolvConf = path
+	defer func() { resolvConf = saved }()
+
+	got := mergeDomains([]string{"extra.internal"}, localDomains())
+	want := []string{"extra.internal", "corp.example", "lab.internal"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestClientQueriesServerDomains(t *testing.T) {
+	remoteAddr, _ := startTunnelServer(t, "test-key", func(s *Server) {
+		s.domains = []string{"corp.example"}
+	})
+
+	client := newClient("test-key", remoteAddr, "127.0.0.1:0")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	domains := client.serverDomains(ctx)
+	if len(domains) == 0 || domains[0] != "corp.example" {
+		t.Errorf("Expected corp.example first, got %v", domains)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package pivot
 
 import (
 	"crypto/rc4"
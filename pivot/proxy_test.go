@@ -0,0 +1,140 @@
+package pivot
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startConnectProxy runs a minimal HTTP CONNECT proxy requiring the given
+// basic credentials
+func startConnectProxy(t *testing.T, auth string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				relay(wrapBuffered(conn, br), target)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestTransportThroughHTTPProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, target)
+
+	proxyAddr := startConnectProxy(t, "Basic dXNlcjpwYXNz") // user:pass
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxy, err := ParseProxyURL("http://user:pass@" + proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to parse proxy URL: %v", err)
+	}
+	transport := NewTransport()
+	transport.Proxy = proxy
+
+	conn, err := transport.Dial(ctx, target.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial through proxy failed: %v", err)
+	}
+	defer conn.Close()
+
+	go io.WriteString(conn, "through proxy")
+	buf := make([]byte, len("through proxy"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf) != "through proxy" {
+		t.Errorf("Unexpected echo: %q", buf)
+	}
+
+	// Wrong credentials are rejected by the proxy
+	transport.Proxy = &url.URL{Scheme: "http", Host: proxyAddr, User: url.UserPassword("user", "wrong")}
+	if _, err := transport.Dial(ctx, target.Addr().String()); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("Expected 407 error, got: %v", err)
+	}
+}
+
+func TestTransportThroughSOCKS5Proxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, target)
+
+	socks, err := NewSOCKS5Server("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start SOCKS5 server: %v", err)
+	}
+	defer socks.Close()
+	go socks.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, scheme := range []string{ProxySOCKS5, ProxySOCKS5H} {
+		// Credentials are offered but the server may pick no authentication
+		proxy, err := ParseProxyURL(scheme + "://user:pass@" + socks.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to parse proxy URL: %v", err)
+		}
+		transport := NewTransport()
+		transport.Proxy = proxy
+
+		_, port, _ := net.SplitHostPort(target.Addr().String())
+		conn, err := transport.Dial(ctx, net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatalf("%s: dial through proxy failed: %v", scheme, err)
+		}
+
+		go io.WriteString(conn, "socks")
+		buf := make([]byte, len("socks"))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%s: read failed: %v", scheme, err)
+		}
+		if string(buf) != "socks" {
+			t.Errorf("%s: unexpected echo: %q", scheme, buf)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,462 @@
+package pivot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicIdleTimeout     = 60 * time.Second
+	quicKeepAlivePeriod = 15 * time.Second
+	quicMaxStreams      = 1024
+
+	// quicSessionHello is written on a session's control stream, since QUIC
+	// only announces a stream to the peer once data is sent on it
+	quicSessionHello = 0x00
+
+	// Messages on the control stream: type followed by a 64-bit nonce,
+	// which is zero for go-away notices
+	quicControlPing   = 0x01
+	quicControlPong   = 0x02
+	quicControlGoAway = 0x03
+	quicControlSize   = 9
+)
+
+// quicNextProtos makes QUIC links negotiate like HTTP/3
+var quicNextProtos = []string{"h3"}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     quicIdleTimeout,
+		KeepAlivePeriod:    quicKeepAlivePeriod,
+		MaxIncomingStreams: quicMaxStreams,
+	}
+}
+
+// quicStreamConn adapts a QUIC stream to net.Conn
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// LocalAddr returns the local address of the QUIC connection
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the QUIC connection, which follows
+// the peer when it migrates to a new address
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// CloseWrite finishes the sending side of the stream
+func (c *quicStreamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// reset aborts both directions of the stream
+func (c *quicStreamConn) reset() error {
+	c.Stream.CancelWrite(0)
+	c.Stream.CancelRead(0)
+	return nil
+}
+
+// Close shuts down both directions of the stream
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// quicListener accepts QUIC connections and hands out their streams. In
+// session mode only the first stream of each connection is returned and the
+// rest are left for the Session built on top of it.
+type quicListener struct {
+	socket   *handoffPacketConn
+	sessions bool
+	conns    chan net.Conn
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// The connections accepted, which keep the socket open after Close
+	open      sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func listenQUIC(addr string, config *tls.Config, sessions bool) (*quicListener, error) {
+	config.NextProtos = quicNextProtos
+	socket, err := listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &quicListener{
+		socket:   socket,
+		sessions: sessions,
+		conns:    make(chan net.Conn),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	l.open.Add(1) // for the accept loop
+
+	if socket.released == nil {
+		listener, err := quic.Listen(socket, config, quicConfig())
+		if err != nil {
+			cancel()
+			socket.Close()
+			return nil, err
+		}
+		go l.acceptLoop(listener)
+		return l, nil
+	}
+
+	// The process that handed the socket over still reads it for its own
+	// connections. The kernel queues new packets until it lets go.
+	go func() {
+		select {
+		case <-socket.released:
+		case <-ctx.Done():
+			l.open.Done()
+			return
+		}
+		listener, err := quic.Listen(socket, config, quicConfig())
+		if err != nil {
+			log.Printf("Failed to listen for QUIC on %s: %v", addr, err)
+			cancel()
+			l.open.Done()
+			return
+		}
+		l.acceptLoop(listener)
+	}()
+	return l, nil
+}
+
+func (l *quicListener) acceptLoop(listener *quic.Listener) {
+	defer l.open.Done()
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept(l.ctx)
+		if err != nil {
+			l.cancel()
+			return
+		}
+		l.open.Add(1)
+		go func() {
+			<-conn.Context().Done()
+			l.open.Done()
+		}()
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+
+		streamConn := &quicStreamConn{Stream: stream, conn: conn}
+		if l.sessions {
+			streamConn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+			hello := make([]byte, 1)
+			if _, err := io.ReadFull(streamConn, hello); err != nil || hello[0] != quicSessionHello {
+				conn.CloseWithError(0, "")
+				return
+			}
+			streamConn.SetReadDeadline(time.Time{})
+		}
+
+		select {
+		case l.conns <- streamConn:
+		case <-l.ctx.Done():
+			streamConn.Close()
+			return
+		}
+
+		if l.sessions {
+			return
+		}
+	}
+}
+
+// Accept waits for the next stream
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener. The connections it accepted carry on, and the
+// socket closes once they have all ended.
+func (l *quicListener) Close() error {
+	l.cancel()
+	l.closeOnce.Do(func() {
+		l.socket.release()
+		go func() {
+			l.open.Wait()
+			l.socket.Close()
+		}()
+	})
+	return nil
+}
+
+// Addr returns the listener's UDP address
+func (l *quicListener) Addr() net.Addr {
+	return l.socket.LocalAddr()
+}
+
+// quicDialer keeps one QUIC connection per remote and opens a stream on it
+// for every dial
+type quicDialer struct {
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+}
+
+func (d *quicDialer) dialStream(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	if conn := d.cached(addr); conn != nil {
+		stream, err := d.openStream(ctx, addr, conn)
+		if err == nil || ctx.Err() != nil {
+			return stream, err
+		}
+		// The connection is gone, fall through and establish a new one
+	}
+
+	// Handshakes run unlocked, so a slow remote doesn't hold up dials to the
+	// others
+	conn, err := dialQUIC(ctx, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return d.openStream(ctx, addr, d.install(addr, conn))
+}
+
+// cached returns the connection to addr, if there is one
+func (d *quicDialer) cached(addr string) *quic.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conns[addr]
+}
+
+// install keeps conn as the connection to addr and returns it. When a dial
+// that raced this one got there first, conn is closed and the winner
+// returned instead.
+func (d *quicDialer) install(addr string, conn *quic.Conn) *quic.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if winner := d.conns[addr]; winner != nil && winner.Context().Err() == nil {
+		conn.CloseWithError(0, "")
+		return winner
+	}
+	if d.conns == nil {
+		d.conns = make(map[string]*quic.Conn)
+	}
+	d.conns[addr] = conn
+	return conn
+}
+
+// openStream opens a stream on conn, the connection to addr. A connection
+// that fails for any reason other than ctx is dropped.
+func (d *quicDialer) openStream(ctx context.Context, addr string, conn *quic.Conn) (net.Conn, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			d.mu.Lock()
+			if d.conns[addr] == conn {
+				delete(d.conns, addr)
+			}
+			d.mu.Unlock()
+			conn.CloseWithError(0, "")
+		}
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, conn: conn}, nil
+}
+
+// dialQUICSession establishes a dedicated QUIC connection and returns its
+// control stream
+func dialQUICSession(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := dialQUIC(ctx, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	if _, err := stream.Write([]byte{quicSessionHello}); err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, conn: conn}, nil
+}
+
+func dialQUIC(ctx context.Context, addr string, config *tls.Config) (*quic.Conn, error) {
+	config.NextProtos = quicNextProtos
+	return quic.DialAddr(ctx, addr, config, quicConfig())
+}
+
+// quicSession maps every tunneled stream to a native QUIC stream. The
+// control stream carries heartbeats and go-away notices.
+type quicSession struct {
+	conn         *quic.Conn
+	control      net.Conn
+	controlMu    sync.Mutex
+	done         chan struct{}
+	once         sync.Once
+	goneAway     chan struct{}
+	goneAwayOnce sync.Once
+	heartbeat    *heartbeat
+	replies      *replyQueue
+}
+
+func newQUICSession(conn *quic.Conn, control net.Conn, hb HeartbeatConfig) *quicSession {
+	s := &quicSession{
+		conn:     conn,
+		control:  control,
+		done:     make(chan struct{}),
+		goneAway: make(chan struct{}),
+		replies:  newReplyQueue(),
+	}
+	s.heartbeat = newHeartbeat(hb, func(nonce uint64) error {
+		return s.writeControl(quicControlPing, nonce)
+	}, func() {
+		s.Close()
+	})
+
+	go func() {
+		// The session ends with the connection or its control stream
+		closed := make(chan struct{})
+		go func() {
+			s.readControl()
+			close(closed)
+		}()
+
+		select {
+		case <-conn.Context().Done():
+		case <-closed:
+		}
+		s.Close()
+	}()
+	go s.heartbeat.run(s.done, conn.RemoteAddr().String())
+	// Resets are QUIC's own, so only pongs go through the queue
+	go s.replies.run(s.done, func(nonce uint64) error {
+		return s.writeControl(quicControlPong, nonce)
+	}, nil)
+
+	return s
+}
+
+// readControl handles heartbeats and go-away notices from the peer until the
+// control stream ends
+func (s *quicSession) readControl() {
+	msg := make([]byte, quicControlSize)
+	for {
+		if _, err := io.ReadFull(s.control, msg); err != nil {
+			return
+		}
+
+		nonce := binary.BigEndian.Uint64(msg[1:])
+		switch msg[0] {
+		case quicControlPing:
+			s.replies.pongLater(nonce)
+		case quicControlPong:
+			s.heartbeat.pong(nonce)
+		case quicControlGoAway:
+			s.goneAwayOnce.Do(func() { close(s.goneAway) })
+		default:
+			return
+		}
+	}
+}
+
+func (s *quicSession) writeControl(msgType byte, nonce uint64) error {
+	msg := binary.BigEndian.AppendUint64([]byte{msgType}, nonce)
+
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	_, err := s.control.Write(msg)
+	return err
+}
+
+// OpenStream starts a new QUIC stream to the peer
+func (s *quicSession) OpenStream(ctx context.Context) (net.Conn, error) {
+	if goneAway(s) {
+		return nil, errGoneAway
+	}
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, conn: s.conn}, nil
+}
+
+// AcceptStream waits for the peer to open a QUIC stream
+func (s *quicSession) AcceptStream(ctx context.Context) (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		s.Close()
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, conn: s.conn}, nil
+}
+
+// Close closes the control stream and the QUIC connection
+func (s *quicSession) Close() error {
+	s.once.Do(func() {
+		s.control.Close()
+		s.conn.CloseWithError(0, "")
+		close(s.done)
+	})
+	return nil
+}
+
+// Done is closed once the session has ended
+func (s *quicSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// GoAway asks the peer to open no more streams on this session
+func (s *quicSession) GoAway() error {
+	return s.writeControl(quicControlGoAway, 0)
+}
+
+// GoneAway is closed once the peer sent a go-away notice
+func (s *quicSession) GoneAway() <-chan struct{} {
+	return s.goneAway
+}
+
+// LocalAddr returns the local UDP address
+func (s *quicSession) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the peer's current UDP address
+func (s *quicSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// RTT returns the heartbeat round-trip time
+func (s *quicSession) RTT() time.Duration {
+	return s.heartbeat.RTT()
+}
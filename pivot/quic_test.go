@@ -0,0 +1,228 @@
+package pivot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQUICTransport(t *testing.T) {
+	dir := t.TempDir()
+	serverOpts := &TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	listener, err := (&Transport{TLS: serverOpts}).Listen("quic://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, listener)
+	addr := "quic://" + listener.Addr().String()
+
+	pin, err := ParseCertificatePin(serverOpts.CertFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated certificate: %v", err)
+	}
+
+	// Both dials share one QUIC connection
+	transport := &Transport{TLS: &TLSOptions{Pin: pin}}
+	for i := 0; i < 2; i++ {
+		if err := dialTLSEchoWith(t, transport, addr); err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+	}
+	if len(transport.quic.conns) != 1 {
+		t.Errorf("Expected 1 cached QUIC connection, got %d", len(transport.quic.conns))
+	}
+}
+
+func TestQUICDialUnblocked(t *testing.T) {
+	dir := t.TempDir()
+	serverOpts := &TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	listener, err := (&Transport{TLS: serverOpts}).Listen("quic://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, listener)
+
+	// A remote that never answers the handshake
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+
+	pin, err := ParseCertificatePin(serverOpts.CertFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated certificate: %v", err)
+	}
+	transport := &Transport{TLS: &TLSOptions{Pin: pin}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stalled := make(chan error, 1)
+	go func() {
+		_, err := transport.Dial(ctx, "quic://"+silent.LocalAddr().String())
+		stalled <- err
+	}()
+	defer func() {
+		cancel()
+		<-stalled
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The stalled handshake doesn't hold up a dial to a healthy remote
+	start := time.Now()
+	if err := dialTLSEchoWith(t, transport, "quic://"+listener.Addr().String()); err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the healthy dial to go through at once, took %v", elapsed)
+	}
+	if len(stalled) > 0 {
+		t.Error("Expected the dial to the silent remote to still be waiting")
+	}
+}
+
+func TestQUICCipherFinalChunk(t *testing.T) {
+	dir := t.TempDir()
+	serverOpts := &TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	listener, err := (&Transport{TLS: serverOpts}).Listen("quic://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	key := "test-key"
+	payload := []byte("response followed by FIN")
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rc4Conn, _ := NewRC4Conn(conn, key)
+		io.ReadFull(rc4Conn, make([]byte, 5))
+		rc4Conn.Write(payload)
+	}()
+
+	pin, err := ParseCertificatePin(serverOpts.CertFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated certificate: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := (&Transport{TLS: &TLSOptions{Pin: pin}}).Dial(ctx, "quic://"+listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	rc4Conn, _ := NewRC4Conn(conn, key)
+	rc4Conn.Write([]byte("hello"))
+
+	// QUIC may return the last bytes together with io.EOF
+	reply, err := io.ReadAll(rc4Conn)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(reply, payload) {
+		t.Errorf("Expected %q, got %q", payload, reply)
+	}
+}
+
+func TestQUICSession(t *testing.T) {
+	dir := t.TempDir()
+	serverOpts := &TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	listener, err := (&Transport{TLS: serverOpts}).ListenSession("quic://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	addr := "quic://" + listener.Addr().String()
+
+	pin, err := ParseCertificatePin(serverOpts.CertFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated certificate: %v", err)
+	}
+
+	accepted := make(chan Session, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- NewSession(conn, conn, false, fastHeartbeat)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := (&Transport{TLS: &TLSOptions{Pin: pin}}).DialSession(ctx, addr)
+	if err != nil {
+		t.Fatalf("DialSession failed: %v", err)
+	}
+	client := NewSession(conn, conn, true, DefaultHeartbeat())
+	defer client.Close()
+
+	var server Session
+	select {
+	case server = <-accepted:
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for the session")
+	}
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	// The listener side opens streams back to the dialer, like the agent does
+	serveEchoStreams(client)
+	echoStream(t, server, 256*1024)
+
+	// Heartbeats run over the control stream
+	deadline := time.Now().Add(5 * time.Second)
+	for server.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("No round-trip time measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A go-away notice stops new streams on the session, not the session
+	if err := client.GoAway(); err != nil {
+		t.Fatalf("GoAway failed: %v", err)
+	}
+	select {
+	case <-server.GoneAway():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server never heard the client going away")
+	}
+	if _, err := server.OpenStream(ctx); !errors.Is(err, errGoneAway) {
+		t.Errorf("Expected OpenStream to be refused, got %v", err)
+	}
+	serveEchoStreams(server)
+	echoStream(t, client, 1024)
+
+	client.Close()
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Server session didn't end with the client")
+	}
+}
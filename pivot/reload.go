@@ -0,0 +1,271 @@
+package pivot
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Reloading. A running server, agent or client takes new options through
+// Reload. Connections read the settings they use once, when they start, so
+// the ones in flight finish under the settings they started with. Listeners
+// that move open on their new address before the old one closes.
+
+// reloadDiff collects what a reload changes, for the log
+type reloadDiff struct {
+	changes []string
+	kept    []string // settings that only change on a restart
+}
+
+// compare records a change of the setting what from old to new
+func (d *reloadDiff) compare(what string, old, new any) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+	d.changes = append(d.changes, fmt.Sprintf("%s: %s -> %s", what, formatSetting(old), formatSetting(new)))
+}
+
+// compareList records the entries added to and removed from the list what.
+// A list whose entries only moved is reported as reordered.
+func (d *reloadDiff) compareList(what string, old, new []string) {
+	var added, removed []string
+	for _, entry := range new {
+		if !slices.Contains(old, entry) {
+			added = append(added, entry)
+		}
+	}
+	for _, entry := range old {
+		if !slices.Contains(new, entry) {
+			removed = append(removed, entry)
+		}
+	}
+	for _, entry := range removed {
+		d.changes = append(d.changes, fmt.Sprintf("%s: -%s", what, entry))
+	}
+	for _, entry := range added {
+		d.changes = append(d.changes, fmt.Sprintf("%s: +%s", what, entry))
+	}
+	if len(added) == 0 && len(removed) == 0 && !slices.Equal(old, new) {
+		d.changes = append(d.changes, what+": reordered")
+	}
+}
+
+// keep records that the setting what changed but takes a restart
+func (d *reloadDiff) keep(what string, changed bool) {
+	if changed {
+		d.kept = append(d.kept, what)
+	}
+}
+
+// compareKey records a change of the tunnel key by fingerprint
+func (d *reloadDiff) compareKey(old, new string) {
+	if old != new {
+		d.compare("key", keyDescription(old), keyDescription(new))
+	}
+}
+
+// compareAuth records the changes to the public-key handshake
+func (d *reloadDiff) compareAuth(old, new *Authenticator) {
+	d.compare("identity", identityDescription(old), identityDescription(new))
+	d.compare("pin", authPin(old), authPin(new))
+
+	oldKeys, newKeys := authorizedKeys(old), authorizedKeys(new)
+	if (oldKeys == nil) != (newKeys == nil) {
+		d.compare("authorized keys file", authorizedPath(oldKeys), authorizedPath(newKeys))
+	}
+	d.compareList("authorized keys", authorizedEntries(oldKeys), authorizedEntries(newKeys))
+}
+
+// log writes the changes, one line each
+func (d *reloadDiff) log(name string) {
+	if len(d.changes) == 0 && len(d.kept) == 0 {
+		log.Printf("%s reloaded, nothing changed", name)
+		return
+	}
+	for _, change := range d.changes {
+		log.Printf("%s reloaded %s", name, change)
+	}
+	for _, what := range d.kept {
+		log.Printf("%s keeps its %s until restarted", name, what)
+	}
+}
+
+// formatSetting prints a setting value for the log
+func formatSetting(v any) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return "none"
+		}
+		return v
+	case []string:
+		if len(v) == 0 {
+			return "none"
+		}
+		return strings.Join(v, ", ")
+	}
+	return fmt.Sprintf("%+v", v)
+}
+
+func keyDescription(key string) string {
+	if key == "" {
+		return ""
+	}
+	return KeyFingerprint(key)
+}
+
+func identityDescription(a *Authenticator) string {
+	if !a.enabled() {
+		return ""
+	}
+	return a.Fingerprint()
+}
+
+func authPin(a *Authenticator) string {
+	if a == nil {
+		return ""
+	}
+	return a.pin
+}
+
+func authorizedKeys(a *Authenticator) *AuthorizedKeys {
+	if a == nil {
+		return nil
+	}
+	return a.authorized
+}
+
+func authorizedPath(ak *AuthorizedKeys) string {
+	if ak == nil {
+		return ""
+	}
+	return ak.path
+}
+
+func authorizedEntries(ak *AuthorizedKeys) []string {
+	if ak == nil {
+		return nil
+	}
+	return ak.entries()
+}
+
+// ruleLines lists the rules of rs as written
+func ruleLines(rs *RuleSet) []string {
+	if rs == nil {
+		return nil
+	}
+	lines := make([]string, len(rs.rules))
+	for i, rule := range rs.rules {
+		lines[i] = rule.String()
+	}
+	return lines
+}
+
+// namedRemoteLines lists the named remotes of rs with their addresses,
+// sorted by name
+func namedRemoteLines(rs *RuleSet) []string {
+	if rs == nil {
+		return nil
+	}
+	var lines []string
+	for name, addrs := range rs.Remotes() {
+		lines = append(lines, name+" "+strings.Join(addrs, ","))
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// samePolicy reports whether two remote pools pick and check their remotes
+// alike
+func samePolicy(a, b *remotePool) bool {
+	return a.strategy == b.strategy && a.interval == b.interval
+}
+
+// sameTransport reports whether two transports are set up alike
+func sameTransport(a, b *Transport) bool {
+	return transportSettings(a) == transportSettings(b)
+}
+
+// transportSettings returns what a transport was set up with
+func transportSettings(t *Transport) [7]string {
+	var settings [7]string
+	if t.TLS != nil {
+		o := t.TLS
+		settings = [7]string{o.CertFile, o.KeyFile, o.Pin, o.CAFile, o.ClientCAFile, o.ServerName}
+	}
+	if t.Proxy != nil {
+		settings[6] = t.Proxy.String()
+	}
+	return settings
+}
+
+// sameBackoff reports whether two reconnect policies are set up alike
+func sameBackoff(a, b *Backoff) bool {
+	return a.Initial == b.Initial && a.Max == b.Max && a.Jitter == b.Jitter && a.MaxAttempts == b.MaxAttempts
+}
+
+// listenSlot is a listener of the current run that a reload can move to
+// another address
+type listenSlot struct {
+	addr      string
+	*acceptor // nil when not listening
+}
+
+// listenerMoves are the listeners a reload opens. They all open before any
+// old one closes, so a failure leaves every listener where it was.
+type listenerMoves []listenerMove
+
+type listenerMove struct {
+	slot *listenSlot
+	addr string
+	next *acceptor // nil to stop listening
+}
+
+// open listens on addr for slot with listen, unless slot listens there
+// already. An empty addr moves the slot nowhere.
+func (m *listenerMoves) open(slot *listenSlot, addr string, listen func(addr string) (*acceptor, error)) error {
+	if addr == slot.addr {
+		return nil
+	}
+	move := listenerMove{slot: slot, addr: addr}
+	if addr != "" {
+		next, err := listen(addr)
+		if err != nil {
+			return err
+		}
+		move.next = next
+	}
+	*m = append(*m, move)
+	return nil
+}
+
+// abort closes the listeners opened
+func (m listenerMoves) abort() {
+	for _, move := range m {
+		if move.next != nil {
+			move.next.stop()
+		}
+	}
+}
+
+// commit puts the listeners opened in their slots and returns the ones they
+// replace, which are left for the caller to stop
+func (m listenerMoves) commit() []*acceptor {
+	var replaced []*acceptor
+	for _, move := range m {
+		if move.slot.acceptor != nil {
+			replaced = append(replaced, move.slot.acceptor)
+		}
+		move.slot.addr, move.slot.acceptor = move.addr, move.next
+	}
+	return replaced
+}
+
+// stopAcceptors stops every acceptor and waits for them
+func stopAcceptors(acceptors []*acceptor) {
+	for _, a := range acceptors {
+		a.stop()
+	}
+}
@@ -0,0 +1,170 @@
+package pivot
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadServer(t *testing.T) {
+	h := newHarness(t)
+	port := h.freePort()
+	server, err := NewServer(ServerOptions{Key: h.key, Addr: ":" + port})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	result := startRole(h.ctx, server.Start)
+	addr := "127.0.0.1:" + port
+	h.waitListening(addr)
+
+	proxy, _ := h.startClient(addr)
+	conn, err := h.socks(proxy, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	// A new key and address leave the open relay alone
+	newPort := h.freePort()
+	if err := server.Reload(ServerOptions{Key: "rotated-key", Addr: ":" + newPort}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	h.echo(conn, 1024)
+
+	if old, err := net.Dial("tcp", addr); err == nil {
+		old.Close()
+		t.Error("Expected the old address to be closed")
+	}
+	rotated, _ := h.startClient("127.0.0.1:"+newPort, func(c *Client) { c.key = "rotated-key" })
+	other, err := h.socks(rotated, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect with the new key failed: %v", err)
+	}
+	h.echo(other, 1024)
+	other.Close()
+
+	if err := server.Reload(ServerOptions{Key: "rotated-key", Addr: ":" + newPort, Cipher: "bogus"}); err == nil {
+		t.Error("Expected invalid options to be refused")
+	}
+
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := waitStopped(t, result); err != nil {
+		t.Errorf("Start failed: %v", err)
+	}
+}
+
+func TestReloadClientRules(t *testing.T) {
+	h := newHarness(t)
+	serverAddr, _ := h.startServer()
+	rules := func(text string) *RuleSet {
+		rs, err := ParseRules(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("ParseRules failed: %v", err)
+		}
+		return rs
+	}
+
+	opts := ClientOptions{
+		Key:       h.key,
+		Remotes:   []string{serverAddr},
+		Rules:     rules("* default\n"),
+		LocalAddr: "127.0.0.1:" + h.freePort(),
+	}
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	go client.Start(h.ctx)
+	h.shutdownOnCleanup(client.Shutdown)
+	h.waitListening(opts.LocalAddr)
+
+	conn, err := h.socks(opts.LocalAddr, h.target)
+	if err != nil {
+		t.Fatalf("SOCKS5 connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	// The target is rejected from now on, on a new port, while the stream
+	// already open carries on
+	opts.Rules = rules("127.0.0.1 reject\n* default\n")
+	opts.LocalAddr = "127.0.0.1:" + h.freePort()
+	if err := client.Reload(opts); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	h.echo(conn, 1024)
+
+	if other, err := h.socks(opts.LocalAddr, h.target); err == nil {
+		other.Close()
+		t.Error("Expected the new rule to reject the target")
+	}
+	if _, err := client.DialContext(h.ctx, "tcp", h.target); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("Expected DialContext to follow the new rule, got %v", err)
+	}
+}
+
+func TestReloadListenerFailure(t *testing.T) {
+	h := newHarness(t)
+	agent, clientAddr, internalAddr := h.startAgent()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer taken.Close()
+
+	// The internal listener would move, but the client one can't, so
+	// nothing changes
+	newInternal := "127.0.0.1:" + h.freePort()
+	err = agent.Reload(AgentOptions{
+		Key:          "rotated-key",
+		ClientAddr:   taken.Addr().String(),
+		InternalAddr: newInternal,
+	})
+	if err == nil {
+		t.Fatal("Expected the reload to fail on an address in use")
+	}
+
+	if cfg := agent.settings(); cfg.key != h.key || cfg.clientAddr != clientAddr || cfg.internalAddr != internalAddr {
+		t.Errorf("Expected the settings to stay, got %+v", cfg)
+	}
+	h.waitListening(clientAddr)
+	h.waitListening(internalAddr)
+	if conn, err := net.Dial("tcp", newInternal); err == nil {
+		conn.Close()
+		t.Error("Expected the listener opened for the reload to be closed")
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	var diff reloadDiff
+	diff.compare("listen address", ":1080", ":1081")
+	diff.compare("timeouts", DefaultTimeouts(), DefaultTimeouts())
+	diff.compare("hop listen address", "", ":9000")
+	diff.compareList("rules", []string{"a reject", "b direct"}, []string{"b direct", "c reject"})
+	diff.compareList("domains", []string{"a", "b"}, []string{"b", "a"})
+	diff.compareKey("old-key", "old-key")
+	diff.keep("cipher", true)
+	diff.keep("heartbeat", false)
+
+	want := []string{
+		"listen address: :1080 -> :1081",
+		"hop listen address: none -> :9000",
+		"rules: -a reject",
+		"rules: +c reject",
+		"domains: reordered",
+	}
+	if !slices.Equal(diff.changes, want) {
+		t.Errorf("Expected changes %q, got %q", want, diff.changes)
+	}
+	if !slices.Equal(diff.kept, []string{"cipher"}) {
+		t.Errorf("Expected only the cipher to take a restart, got %q", diff.kept)
+	}
+}
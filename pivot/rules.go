@@ -0,0 +1,306 @@
+package pivot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Rule actions for destinations matched on the client
+const (
+	ActionDefault = "default" // the -r remote with the -route route
+	ActionDirect  = "direct"  // connect from the client machine itself
+	ActionReject  = "reject"  // refuse the SOCKS5 request
+	ActionRemote  = "remote"  // a named remote, optionally with a route behind it
+	ActionRoute   = "route"   // the -r remote with a different route
+)
+
+// portRange is an inclusive range of destination ports
+type portRange struct {
+	low, high int
+}
+
+// Rule sends destinations matching its host and ports to an action
+type Rule struct {
+	line   string // as written, for logs
+	any    bool
+	prefix netip.Prefix
+	domain string
+	ports  []portRange // empty matches every port
+
+	Action string
+	Remote string   // named remote for ActionRemote
+	Route  []string // route for ActionRemote and ActionRoute
+}
+
+func (r *Rule) String() string {
+	return r.line
+}
+
+// RuleSet is a client's routing table. The first matching rule wins, and
+// destinations no rule matches take the default action.
+type RuleSet struct {
+	rules   []*Rule
+	remotes map[string][]string // named remotes and their addresses
+}
+
+// LoadRules reads a rules file. Each line is either a rule
+//
+//	<host>[:<ports>] <action> [<target>]
+//
+// or the definition of a named remote
+//
+//	remote <name> <address>[,<address>...]
+//
+// Hosts are *, a CIDR or IP address, or a domain that also matches its
+// subdomains. IPv6 hosts with ports go in brackets. Ports are a comma-separated
+// list of ports and ranges such as 8000-8999. Blank lines and # comments are
+// ignored.
+func LoadRules(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// ParseRules parses rules in the format described at LoadRules
+func ParseRules(r io.Reader) (*RuleSet, error) {
+	rs := &RuleSet{remotes: make(map[string][]string)}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "remote" {
+			if err := rs.defineRemote(fields); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			continue
+		}
+
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		rs.rules = append(rs.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rs.rules {
+		if rule.Action == ActionRemote {
+			if _, ok := rs.remotes[rule.Remote]; !ok {
+				return nil, fmt.Errorf("rule %q uses undefined remote %s", rule, rule.Remote)
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (rs *RuleSet) defineRemote(fields []string) error {
+	if len(fields) != 3 {
+		return fmt.Errorf("expected: remote <name> <address>[,<address>...]")
+	}
+	name := fields[1]
+	if err := checkHopName(name); err != nil {
+		return err
+	}
+	if _, ok := rs.remotes[name]; ok {
+		return fmt.Errorf("remote %s is defined twice", name)
+	}
+
+	addrs := SplitList(fields[2])
+	if len(addrs) == 0 {
+		return fmt.Errorf("remote %s has no address", name)
+	}
+	for _, addr := range addrs {
+		if _, err := ParseEndpoint(addr); err != nil {
+			return err
+		}
+	}
+	rs.remotes[name] = addrs
+	return nil
+}
+
+func parseRule(fields []string) (*Rule, error) {
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected: <host>[:<ports>] <action> [<target>]")
+	}
+	rule := &Rule{line: strings.Join(fields, " "), Action: fields[1]}
+
+	host, ports := splitRuleHost(fields[0])
+	if err := rule.parseHost(host); err != nil {
+		return nil, err
+	}
+	if ports != "" {
+		var err error
+		if rule.ports, err = parsePorts(ports); err != nil {
+			return nil, err
+		}
+	}
+
+	target := ""
+	if len(fields) == 3 {
+		target = fields[2]
+	}
+	switch rule.Action {
+	case ActionDefault, ActionDirect, ActionReject:
+		if target != "" {
+			return nil, fmt.Errorf("action %s takes no target", rule.Action)
+		}
+	case ActionRemote:
+		if target == "" {
+			return nil, fmt.Errorf("action remote needs a remote name")
+		}
+		name, route, _ := strings.Cut(target, routeSeparator)
+		rule.Remote = name
+		var err error
+		if rule.Route, err = ParseRoute(route); err != nil {
+			return nil, err
+		}
+	case ActionRoute:
+		if target == "" {
+			return nil, fmt.Errorf("action route needs a route")
+		}
+		var err error
+		if rule.Route, err = ParseRoute(target); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown action: %s", rule.Action)
+	}
+	return rule, nil
+}
+
+// splitRuleHost separates the optional port list from a rule's host
+func splitRuleHost(s string) (host, ports string) {
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]"); end > 0 {
+			host, ports = s[1:end], strings.TrimPrefix(s[end+1:], ":")
+			return host, ports
+		}
+	}
+	// More than one colon is an IPv6 host without ports
+	if strings.Count(s, ":") == 1 {
+		host, ports, _ = strings.Cut(s, ":")
+		return host, ports
+	}
+	return s, ""
+}
+
+func (r *Rule) parseHost(host string) error {
+	switch {
+	case host == "*":
+		r.any = true
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: %v", host, err)
+		}
+		r.prefix = prefix.Masked()
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			r.prefix = netip.PrefixFrom(addr, addr.BitLen())
+			return nil
+		}
+		domain := strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+		if domain == "" {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		r.domain = strings.ToLower(domain)
+	}
+	return nil
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for _, part := range strings.Split(s, ",") {
+		lowStr, highStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			highStr = lowStr
+		}
+		low, err := strconv.Atoi(lowStr)
+		if err != nil || low < 0 || low > 65535 {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		high, err := strconv.Atoi(highStr)
+		if err != nil || high < low || high > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ports = append(ports, portRange{low, high})
+	}
+	return ports, nil
+}
+
+// matches reports whether the rule covers a destination. Domains are not
+// resolved, so CIDR rules only match destinations given as IP addresses.
+func (r *Rule) matches(host string, port int) bool {
+	if len(r.ports) > 0 {
+		inRange := false
+		for _, pr := range r.ports {
+			if port >= pr.low && port <= pr.high {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	switch {
+	case r.any:
+		return true
+	case r.prefix.IsValid():
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	default:
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	}
+}
+
+// Match returns the first rule covering a destination address such as
+// "example.com:443", or nil if none does
+func (rs *RuleSet) Match(target string) *Rule {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil
+	}
+
+	for _, rule := range rs.rules {
+		if rule.matches(host, port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Remotes returns the named remotes and their addresses
+func (rs *RuleSet) Remotes() map[string][]string {
+	return rs.remotes
+}
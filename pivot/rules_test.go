@@ -0,0 +1,182 @@
+package pivot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRules = `
+# Named remotes
+remote eng2 tls://203.0.113.9:443,203.0.113.10:1080
+
+10.10.0.0/16          remote eng2/db
+[fd00::/8]:22         route lab
+*.corp.example:80,443 default
+blocked.example       reject
+*:25                  reject
+*                     direct
+`
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+
+	if addrs := rules.Remotes()["eng2"]; len(addrs) != 2 {
+		t.Errorf("Expected eng2 to have two addresses, got %v", addrs)
+	}
+
+	tests := []struct {
+		target string
+		action string
+		route  []string
+	}{
+		{"10.10.3.4:445", ActionRemote, []string{"db"}},
+		{"[fd00::1]:22", ActionRoute, []string{"lab"}},
+		{"[fd00::1]:80", ActionDirect, nil},
+		{"intranet.corp.example:443", ActionDefault, nil},
+		{"intranet.corp.example:8080", ActionDirect, nil},
+		{"corp.example:80", ActionDefault, nil},
+		{"notcorp.example:80", ActionDirect, nil},
+		{"www.blocked.example:443", ActionReject, nil},
+		{"10.20.0.1:25", ActionReject, nil},
+		{"93.184.216.34:443", ActionDirect, nil},
+	}
+	for _, tt := range tests {
+		rule := rules.Match(tt.target)
+		if rule == nil {
+			t.Errorf("%s: no rule matched", tt.target)
+			continue
+		}
+		if rule.Action != tt.action || !reflect.DeepEqual(rule.Route, tt.route) {
+			t.Errorf("%s: expected %s %v, got %s %v (rule %q)", tt.target, tt.action, tt.route, rule.Action, rule.Route, rule)
+		}
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, bad := range []string{
+		"10.0.0.0/33 direct",
+		"* teleport",
+		"* direct now",
+		"*:70000 direct",
+		"*:90-80 direct",
+		"* remote",
+		"* remote nowhere",
+		"remote eng1",
+		"remote eng1 a:1\nremote eng1 b:1",
+	} {
+		if _, err := ParseRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// startTunnelServer runs a server's tunnel handling on a plain listener and
+// counts the connections it gets
+func startTunnelServer(t *testing.T, key string, configure ...func(*Server)) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := newServer(key, "")
+	for _, f := range configure {
+		f(server)
+	}
+	var count atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			id := count.Add(1)
+			rc4Conn, err := wrapCipher(conn, CipherRC4, key)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer rc4Conn.Close()
+				server.handleTunnel(context.Background(), rc4Conn, id, server.limits.group(conn.RemoteAddr()))
+			}()
+		}
+	}()
+	return listener.Addr().String(), &count
+}
+
+func TestClientRules(t *testing.T) {
+	direct, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, direct)
+	tunneled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, tunneled)
+
+	remoteAddr, remoteConns := startTunnelServer(t, "test-key")
+
+	_, directPort, _ := net.SplitHostPort(direct.Addr().String())
+	rules, err := ParseRules(strings.NewReader(fmt.Sprintf(
+		"127.0.0.1:%s direct\n*.blocked.test reject\n* default\n", directPort)))
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+
+	client := newClient("test-key", remoteAddr, "127.0.0.1:0")
+	client.server = &SOCKS5Server{}
+	client.rules = rules
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connect := func(target string) error {
+		local, conn := net.Pipe()
+		defer local.Close()
+		go client.handleLocalConnection(ctx, conn)
+
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := NewSOCKS5Client("").handshake(local, target); err != nil {
+			return err
+		}
+		local.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(local, reply); err != nil || string(reply) != "ping" {
+			return fmt.Errorf("expected echoed ping, got %q: %v", reply, err)
+		}
+		return nil
+	}
+
+	if err := connect(direct.Addr().String()); err != nil {
+		t.Errorf("Direct connection failed: %v", err)
+	}
+	if n := remoteConns.Load(); n != 0 {
+		t.Errorf("Direct connection went through the remote (%d connections)", n)
+	}
+
+	if err := connect(tunneled.Addr().String()); err != nil {
+		t.Errorf("Tunneled connection failed: %v", err)
+	}
+	if n := remoteConns.Load(); n != 1 {
+		t.Errorf("Expected one connection through the remote, got %d", n)
+	}
+
+	err = connect("www.blocked.test:80")
+	if err == nil || !strings.Contains(err.Error(), "code: 2") {
+		t.Errorf("Expected the blocked destination to be refused by the ruleset, got %v", err)
+	}
+}
@@ -0,0 +1,755 @@
+package pivot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// agentDialTimeout bounds a single attempt to reach an agent, so one address
+// that swallows packets can't hold up the fallbacks
+const agentDialTimeout = 15 * time.Second
+
+// Server represents the pivot server
+type Server struct {
+	serverSettings
+	mu sync.Mutex // guards serverSettings while serving
+
+	life      lifecycle
+	connCount int32
+	transport *Transport
+	cipher    string
+	stdio     bool // serve a single tunnel over stdin/stdout
+
+	// Multi-hop routing: the name announced when dialing an agent or
+	// upstream server, and the downstream pivots that dialed in here
+	name string
+	hops hopTable
+
+	// Reconnect policy for agent mode
+	backoff *Backoff
+
+	heartbeat HeartbeatConfig
+	limits    limiter
+
+	// dialTarget opens the connections SOCKS5 clients ask for, a plain TCP
+	// dial when nil
+	dialTarget func(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error)
+
+	// The listeners of the current run. reloadMu serializes Reload with
+	// itself and with Start opening them, so holding it also makes the
+	// settings safe to read without mu.
+	reloadMu    sync.Mutex
+	listener    listenSlot // listen mode only
+	hopListener listenSlot
+}
+
+// serverSettings are the settings of a server that Reload changes in place
+type serverSettings struct {
+	key        string
+	listenAddr string
+	auth       *Authenticator
+	timeouts   Timeouts
+
+	// Fallback agents are tried in order after the primary address in
+	// listenAddr, in agent mode
+	fallbacks []string
+
+	hopAddr string // where downstream pivots dial in
+
+	// Internal domains reported to clients for their PAC files, on top of
+	// the machine's DNS search domains
+	domains []string
+}
+
+// newServer creates a server with the default settings
+func newServer(key, listenAddr string) *Server {
+	return &Server{
+		serverSettings: serverSettings{
+			key:        key,
+			listenAddr: listenAddr,
+			timeouts:   DefaultTimeouts(),
+		},
+		transport: NewTransport(),
+		cipher:    CipherRC4,
+		backoff:   NewBackoff(),
+		heartbeat: DefaultHeartbeat(),
+	}
+}
+
+// settings returns the settings in force, for a connection to use until it
+// ends
+func (s *Server) settings() serverSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serverSettings
+}
+
+// Start starts the server and serves until ctx ends or Shutdown is called.
+// Ending ctx abandons the connections in flight, while Shutdown lets them
+// finish first. The server can be started again once Start has returned.
+func (s *Server) Start(ctx context.Context) error {
+	r, err := s.life.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.life.finish(r)
+
+	s.reloadMu.Lock()
+	s.listener, s.hopListener = listenSlot{}, listenSlot{}
+	var moves listenerMoves
+	err = moves.open(&s.hopListener, s.hopAddr, func(addr string) (*acceptor, error) {
+		return s.listenHops(r, addr)
+	})
+	if err == nil && s.listenMode() {
+		err = moves.open(&s.listener, s.listenAddr, func(addr string) (*acceptor, error) {
+			return s.listen(r, addr)
+		})
+	}
+	if err != nil {
+		moves.abort()
+		s.reloadMu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	moves.commit()
+	s.mu.Unlock()
+	s.reloadMu.Unlock()
+	reportReady()
+
+	if s.stdio {
+		return s.serveLink(r, newStdioConn())
+	}
+	if s.isAgentMode() {
+		return s.startAgentMode(ctx, r)
+	}
+
+	<-r.serving.Done()
+	return ctx.Err()
+}
+
+// listen accepts tunnel connections on addr in listen mode
+func (s *Server) listen(r *run, addr string) (*acceptor, error) {
+	listener, err := s.transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Server listening on %s", addr)
+
+	return r.acceptLoop(listener, "connection", func(conn net.Conn) {
+		s.handleClient(r.ctx, conn)
+	}), nil
+}
+
+// isAgentMode determines if server should connect to agent
+func (s *Server) isAgentMode() bool {
+	return isAgentAddr(s.settings().listenAddr)
+}
+
+// listenMode reports whether the server listens for tunnel connections,
+// rather than dialing an agent or serving stdio
+func (s *Server) listenMode() bool {
+	return !s.stdio && !s.isAgentMode()
+}
+
+// isAgentAddr reports whether a server address names an agent to dial
+func isAgentAddr(addr string) bool {
+	// If the address part doesn't start with ":", it's an agent address
+	ep, err := ParseEndpoint(addr)
+	return err == nil && ep.Addr != "" && ep.Addr[0] != ':'
+}
+
+// startAgentMode connects to the agent and serves the SOCKS5 streams the
+// agent opens over that session. Lost sessions are re-established, trying
+// the primary agent and then each fallback in order, with a growing delay
+// after every round in which none of them answered. An agent going away
+// gets a new session right away, while the old one finishes its streams.
+// Agent addresses changed by Reload are dialed from the next session on.
+func (s *Server) startAgentMode(ctx context.Context, r *run) error {
+	log.Printf("Server connecting to agent at %s", strings.Join(s.agentAddrs(), ", "))
+
+	// Keep the session to the agent alive
+	for {
+		agentAddrs := s.agentAddrs()
+		session, agentAddr, err := s.dialAgents(r.serving, agentAddrs)
+		if err != nil {
+			delay, retry := s.backoff.Next()
+			if !retry {
+				return fmt.Errorf("giving up after %d attempts to reach an agent", s.backoff.Attempts())
+			}
+			log.Printf("No agent reachable, retrying in %v...", delay.Round(time.Millisecond))
+
+			select {
+			case <-r.serving.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+				continue
+			}
+		}
+		if session == nil {
+			// Shut down while dialing
+			return ctx.Err()
+		}
+
+		s.backoff.Reset()
+		log.Printf("Established encrypted session to agent at %s", agentAddr)
+
+		served := make(chan struct{})
+		r.spawn(func() {
+			s.serveSession(r, session)
+			close(served)
+		})
+
+		select {
+		case <-served:
+		case <-session.GoneAway():
+			log.Printf("Agent at %s is going away, reconnecting...", agentAddr)
+			continue
+		}
+
+		select {
+		case <-r.serving.Done():
+			return ctx.Err()
+		default:
+			log.Printf("Session to agent at %s lost (last rtt %v), reconnecting...", agentAddr, session.RTT())
+		}
+	}
+}
+
+// agentAddrs returns the primary agent address followed by the fallbacks
+func (s *Server) agentAddrs() []string {
+	cfg := s.settings()
+	return append([]string{cfg.listenAddr}, cfg.fallbacks...)
+}
+
+// dialAgents makes one attempt over every agent address in order and
+// returns the first session established. It returns a nil session without
+// an error when ctx ends meanwhile.
+func (s *Server) dialAgents(ctx context.Context, agentAddrs []string) (Session, string, error) {
+	var lastErr error
+	for i, agentAddr := range agentAddrs {
+		if ctx.Err() != nil {
+			return nil, "", nil
+		}
+
+		log.Printf("Attempt %d: connecting to agent at %s (%d/%d)", s.backoff.Attempts()+1, agentAddr, i+1, len(agentAddrs))
+
+		dialCtx, cancel := context.WithTimeout(ctx, agentDialTimeout)
+		session, err := s.dialAgent(dialCtx, agentAddr)
+		cancel()
+		if err == nil {
+			return session, agentAddr, nil
+		}
+
+		log.Printf("Attempt %d: failed to connect to agent at %s: %v", s.backoff.Attempts()+1, agentAddr, err)
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
+// dialAgent connects to the agent and sets up the session carrying the
+// agent's SOCKS5 streams
+func (s *Server) dialAgent(ctx context.Context, agentAddr string) (Session, error) {
+	cfg := s.settings()
+	conn, err := s.transport.DialSession(ctx, agentAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create encrypted connection to agent
+	rc4Conn, err := wrapCipher(conn, s.cipher, cfg.key)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create encrypted connection: %v", err)
+	}
+
+	if cfg.auth.enabled() {
+		peer, err := cfg.auth.Dial(rc4Conn)
+		if err != nil {
+			rc4Conn.Close()
+			return nil, fmt.Errorf("handshake with agent %s failed: %v", peer, err)
+		}
+		log.Printf("Authenticated agent %s", peer)
+	}
+
+	if err := writeHopHello(rc4Conn, s.name); err != nil {
+		rc4Conn.Close()
+		return nil, fmt.Errorf("failed to announce name: %v", err)
+	}
+
+	return NewSession(conn, rc4Conn, true, s.heartbeat), nil
+}
+
+// serveLink serves a single tunnel link, such as stdio, that carries every
+// client connection as a stream of one session. It returns once the link
+// closes.
+func (s *Server) serveLink(r *run, conn net.Conn) error {
+	log.Printf("Serving tunnel over %s", conn.RemoteAddr())
+
+	cfg := s.settings()
+	rc4Conn, err := wrapCipher(conn, s.cipher, cfg.key)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create encrypted connection: %v", err)
+	}
+
+	if cfg.auth.enabled() {
+		peer, err := cfg.auth.Accept(rc4Conn)
+		if err != nil {
+			rc4Conn.Close()
+			return fmt.Errorf("handshake with %s failed: %v", peer, err)
+		}
+		log.Printf("Authenticated client %s", peer)
+	}
+
+	s.serveSession(r, NewSession(conn, rc4Conn, false, s.heartbeat))
+	log.Printf("Tunnel over %s closed", conn.RemoteAddr())
+	return nil
+}
+
+// serveSession handles every stream the peer opens until the session ends.
+// It stops at once when r stops serving, unless r drains, and lets the open
+// streams finish when either side is going away. It closes the session and
+// waits for the session's streams before returning, so nothing from a lost
+// session outlives a reconnect.
+func (s *Server) serveSession(r *run, session Session) {
+	accepting, stopAccepting := context.WithCancel(r.serving)
+	defer stopAccepting()
+	go func() {
+		select {
+		case <-accepting.Done():
+		case <-session.GoneAway():
+		}
+		if r.serving.Err() != nil {
+			if !r.draining.Load() {
+				session.Close()
+			} else {
+				session.GoAway()
+			}
+		}
+		stopAccepting()
+	}()
+
+	var streams sync.WaitGroup
+	var active int32
+	group := s.limits.session()
+	defer func() {
+		if n := atomic.LoadInt32(&active); n > 0 {
+			select {
+			case <-session.Done():
+				log.Printf("Session to %s ended, closing %d active streams", session.RemoteAddr(), n)
+			default:
+				log.Printf("Session to %s winding down, waiting for %d active streams", session.RemoteAddr(), n)
+			}
+		}
+		streams.Wait()
+		session.Close()
+	}()
+
+	for {
+		stream, err := session.AcceptStream(accepting)
+		if err != nil {
+			return
+		}
+
+		streams.Add(1)
+		atomic.AddInt32(&active, 1)
+		r.handle(stream, func(stream net.Conn) {
+			defer streams.Done()
+			defer atomic.AddInt32(&active, -1)
+			defer stream.Close()
+
+			connID := atomic.AddInt32(&s.connCount, 1)
+			log.Printf("SOCKS5 stream #%d from %s", connID, session.RemoteAddr())
+
+			// The session is already encrypted and authenticated
+			s.handleTunnel(r.ctx, stream, connID, group)
+		})
+	}
+}
+
+func (s *Server) handleClient(ctx context.Context, clientConn net.Conn) {
+	defer clientConn.Close()
+
+	connID := atomic.AddInt32(&s.connCount, 1)
+	cfg := s.settings()
+
+	// Wrap connection with the tunnel cipher
+	rc4Conn, err := wrapCipher(clientConn, s.cipher, cfg.key)
+	if err != nil {
+		log.Printf("Connection #%d: Failed to create encrypted connection: %v", connID, err)
+		return
+	}
+
+	if cfg.auth.enabled() {
+		peer, err := cfg.auth.Accept(rc4Conn)
+		if err != nil {
+			log.Printf("Connection #%d: Handshake with %s failed: %v", connID, peer, err)
+			return
+		}
+		log.Printf("Connection #%d: Authenticated client %s", connID, peer)
+	}
+
+	s.handleTunnel(ctx, rc4Conn, connID, s.limits.group(clientConn.RemoteAddr()))
+}
+
+// handleTunnel serves a tunneled connection. It carries either a SOCKS5
+// request for this server or a route to forward to downstream pivots.
+// Streams over the limits of group are refused with a SOCKS5 reply. Ending
+// ctx abandons the dial to the target or next hop.
+func (s *Server) handleTunnel(ctx context.Context, conn net.Conn, connID int32, group *limitGroup) {
+	cfg := s.settings()
+
+	// The deadline covers the route, the SOCKS5 negotiation and the request
+	conn.SetDeadline(cfg.timeouts.handshakeDeadline())
+
+	conn, route, err := readRoute(conn)
+	if err != nil {
+		log.Printf("Connection #%d: Failed to read route: %v", connID, err)
+		return
+	}
+
+	if len(route) == 0 {
+		var query bool
+		conn, query, err = readDomainsQuery(conn)
+		if err != nil {
+			log.Printf("Connection #%d: Failed to read request: %v", connID, err)
+			return
+		}
+		if query {
+			domains := mergeDomains(cfg.domains, localDomains())
+			if err := writeDomains(conn, domains); err != nil {
+				log.Printf("Connection #%d: Failed to report domains: %v", connID, err)
+				return
+			}
+			log.Printf("Connection #%d: Reported %d internal domains", connID, len(domains))
+			return
+		}
+	}
+
+	if err := group.acquire(); err != nil {
+		log.Printf("Connection #%d: Refused: %v", connID, err)
+		rejectSOCKS5(conn, SOCKS5_REPLY_NOT_ALLOWED)
+		return
+	}
+	defer group.release()
+
+	opts := relayOptions{bandwidth: group.shaper(), idle: cfg.timeouts.Idle, done: ctx.Done()}
+	if len(route) == 0 {
+		s.handleSOCKS5(ctx, conn, connID, cfg.timeouts.Dial, opts)
+		return
+	}
+
+	// The next hop negotiates SOCKS5 under its own deadline
+	conn.SetDeadline(time.Time{})
+	stream, err := openRoute(ctx, &s.hops, route, cfg.timeouts.Dial)
+	if err != nil {
+		log.Printf("Connection #%d: Failed to forward to %s: %v", connID, strings.Join(route, routeSeparator), err)
+		return
+	}
+	defer stream.Close()
+
+	log.Printf("Connection #%d: Forwarding to %s", connID, strings.Join(route, routeSeparator))
+	result := relayWith(conn, stream, opts)
+	log.Printf("Connection #%d: Closed (%v)", connID, result)
+}
+
+// listenHops accepts downstream pivots on addr, which dial in with -c and
+// are reached by routing through this server
+func (s *Server) listenHops(r *run, addr string) (*acceptor, error) {
+	listener, err := s.transport.ListenSession(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for hops on %s: %v", addr, err)
+	}
+
+	log.Printf("Server listening for downstream hops on %s", addr)
+
+	return r.acceptSessions(listener, "hop connection", func(conn net.Conn) {
+		s.handleHop(r, conn)
+	}), nil
+}
+
+// handleHop registers a downstream pivot for as long as r keeps its session
+func (s *Server) handleHop(r *run, conn net.Conn) {
+	defer conn.Close()
+
+	cfg := s.settings()
+	name, session, err := acceptHopSession(conn, s.cipher, cfg.key, cfg.auth, s.heartbeat)
+	if err != nil {
+		log.Printf("Downstream hop %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer session.Close()
+
+	if name == "" {
+		log.Printf("Downstream hop %s has no name, start it with -name", conn.RemoteAddr())
+		return
+	}
+
+	s.hops.add(name, session)
+	log.Printf("Downstream hop %q connected from %s", name, conn.RemoteAddr())
+
+	if r.keep(session) {
+		log.Printf("Downstream hop %q disconnected (last rtt %v)", name, session.RTT())
+	}
+
+	s.hops.remove(name, session)
+}
+
+func (s *Server) handleSOCKS5(ctx context.Context, conn net.Conn, connID int32, dialTimeout time.Duration, opts relayOptions) {
+	// Implement SOCKS5 protocol handling
+
+	// Step 1: Authentication negotiation
+	if err := s.handleSOCKS5Auth(conn); err != nil {
+		log.Printf("Connection #%d: SOCKS5 auth error: %v", connID, err)
+		return
+	}
+
+	// Step 2: Handle CONNECT request
+	targetConn, err := s.handleSOCKS5Connect(ctx, conn, dialTimeout)
+	if err != nil {
+		log.Printf("Connection #%d: SOCKS5 connect error: %v", connID, err)
+		return
+	}
+	defer targetConn.Close()
+
+	// Step 3: Relay data
+	result := relayWith(conn, targetConn, opts)
+	log.Printf("Connection #%d: Closed (%v)", connID, result)
+}
+
+func (s *Server) handleSOCKS5Auth(conn net.Conn) error {
+	// Read authentication methods
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	if buf[0] != SOCKS5_VERSION {
+		return fmt.Errorf("unsupported SOCKS version: %d", buf[0])
+	}
+
+	nMethods := buf[1]
+	methods := make([]byte, nMethods)
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	// Send no authentication required
+	response := []byte{SOCKS5_VERSION, 0x00}
+	_, err := conn.Write(response)
+	return err
+}
+
+func (s *Server) handleSOCKS5Connect(ctx context.Context, conn net.Conn, dialTimeout time.Duration) (net.Conn, error) {
+	// Read CONNECT request header
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	if buf[0] != SOCKS5_VERSION || buf[1] != SOCKS5_CONNECT {
+		return nil, fmt.Errorf("unsupported request")
+	}
+
+	// Parse target address based on address type
+	var targetAddr string
+	var err error
+
+	switch buf[3] {
+	case SOCKS5_IPV4:
+		targetAddr, err = s.parseIPv4(conn)
+	case SOCKS5_DOMAIN:
+		targetAddr, err = s.parseDomain(conn)
+	case SOCKS5_IPV6:
+		targetAddr, err = s.parseIPv6(conn)
+	default:
+		// Send error response
+		response := []byte{SOCKS5_VERSION, 0x08, 0x00, SOCKS5_IPV4, 0, 0, 0, 0, 0, 0}
+		conn.Write(response)
+		return nil, fmt.Errorf("unsupported address type: %d", buf[3])
+	}
+
+	if err != nil {
+		// Send error response
+		response := []byte{SOCKS5_VERSION, 0x01, 0x00, SOCKS5_IPV4, 0, 0, 0, 0, 0, 0}
+		conn.Write(response)
+		return nil, err
+	}
+
+	// The request is in, so the handshake deadline is done with. The dial
+	// has its own timeout.
+	conn.SetDeadline(time.Time{})
+
+	// Connect to target
+	dial := s.dialTarget
+	if dial == nil {
+		dial = dialTCPTimeout
+	}
+	targetConn, err := dial(ctx, targetAddr, dialTimeout)
+	if err != nil {
+		// Send error response
+		response := []byte{SOCKS5_VERSION, 0x01, 0x00, SOCKS5_IPV4, 0, 0, 0, 0, 0, 0}
+		conn.Write(response)
+		return nil, err
+	}
+
+	// Send success response
+	response := []byte{SOCKS5_VERSION, 0x00, 0x00, SOCKS5_IPV4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(response); err != nil {
+		targetConn.Close()
+		return nil, err
+	}
+
+	return targetConn, nil
+}
+
+// dialTCPTimeout is the dial servers use for SOCKS5 targets
+func dialTCPTimeout(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (s *Server) parseIPv4(conn net.Conn) (string, error) {
+	buf := make([]byte, 6) // 4 bytes IP + 2 bytes port
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	ip := net.IP(buf[:4])
+	port := uint16(buf[4])<<8 | uint16(buf[5])
+
+	return fmt.Sprintf("%s:%d", ip.String(), port), nil
+}
+
+func (s *Server) parseDomain(conn net.Conn) (string, error) {
+	// Read domain length
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	domainLen := buf[0]
+
+	// Read domain + port
+	buf = make([]byte, int(domainLen)+2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	domain := string(buf[:domainLen])
+	port := uint16(buf[domainLen])<<8 | uint16(buf[domainLen+1])
+
+	return fmt.Sprintf("%s:%d", domain, port), nil
+}
+
+func (s *Server) parseIPv6(conn net.Conn) (string, error) {
+	buf := make([]byte, 18) // 16 bytes IP + 2 bytes port
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	ip := net.IP(buf[:16])
+	port := uint16(buf[16])<<8 | uint16(buf[17])
+
+	return fmt.Sprintf("[%s]:%d", ip.String(), port), nil
+}
+
+// Reload applies opts to the server in place. The key, authentication,
+// timeouts, limits, internal domains and the listen, hop and agent addresses
+// change right away; the other settings are kept and logged as taking a
+// restart. Connections in flight carry on under the settings they started
+// with, and in agent mode new agent addresses are dialed for the next
+// session. Nothing changes when opts are invalid or a new listener fails.
+func (s *Server) Reload(opts ServerOptions) error {
+	next, err := NewServer(opts)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	cfg := next.serverSettings
+	var diff reloadDiff
+	diff.keep("cipher", next.cipher != s.cipher)
+	diff.keep("transport settings", !sameTransport(next.transport, s.transport))
+	diff.keep("heartbeat", next.heartbeat != s.heartbeat)
+	diff.keep("reconnect policy", !sameBackoff(next.backoff, s.backoff))
+	diff.keep("name", next.name != s.name)
+	switch {
+	case next.stdio != s.stdio || next.isAgentMode() != s.isAgentMode():
+		diff.keep("mode", true)
+		cfg.listenAddr, cfg.fallbacks = s.listenAddr, s.fallbacks
+	case s.stdio:
+		cfg.listenAddr, cfg.fallbacks = s.listenAddr, s.fallbacks
+	case s.isAgentMode():
+		diff.compare("agent addresses", s.agentAddrs(), next.agentAddrs())
+	default:
+		diff.compare("listen address", s.listenAddr, cfg.listenAddr)
+	}
+	diff.compare("hop listen address", s.hopAddr, cfg.hopAddr)
+	diff.compareKey(s.key, cfg.key)
+	diff.compareAuth(s.auth, cfg.auth)
+	diff.compare("timeouts", s.timeouts, cfg.timeouts)
+	diff.compare("limits", s.limits.current(), next.limits.Limits)
+	diff.compareList("domains", s.domains, cfg.domains)
+
+	var moves listenerMoves
+	_, err = s.life.within(func(r *run) error {
+		err := moves.open(&s.hopListener, cfg.hopAddr, func(addr string) (*acceptor, error) {
+			return s.listenHops(r, addr)
+		})
+		if err != nil || s.listener.acceptor == nil {
+			return err
+		}
+		return moves.open(&s.listener, cfg.listenAddr, func(addr string) (*acceptor, error) {
+			return s.listen(r, addr)
+		})
+	})
+	if err != nil {
+		moves.abort()
+		return err
+	}
+
+	s.mu.Lock()
+	replaced := moves.commit()
+	s.serverSettings = cfg
+	s.mu.Unlock()
+	stopAcceptors(replaced)
+	if limits := next.limits.Limits; limits != s.limits.current() {
+		s.limits.set(limits)
+	}
+
+	diff.log("Server")
+	return nil
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting and waits
+// for the connections in flight until ctx ends, then cuts them off. Calling
+// it on a server that isn't running does nothing.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.life.shutdown(ctx)
+	if err != nil {
+		log.Println("Shutdown timeout reached, forcing close")
+	} else {
+		log.Println("All connections closed")
+	}
+	return err
+}
+
+// Drain stops the server from accepting and asks its agent, downstream hops
+// and link client to open new streams elsewhere, while the streams in flight
+// carry on. Start returns once all of them are done. Drain waits for that
+// until ctx ends; Shutdown cuts off whatever is left.
+func (s *Server) Drain(ctx context.Context) error {
+	log.Println("Draining, waiting for active connections to finish")
+	return s.life.drain(ctx)
+}
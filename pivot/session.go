@@ -0,0 +1,133 @@
+package pivot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errGoneAway = errors.New("peer is going away")
+
+// goneAway tells whether the peer of session asked for no new streams
+func goneAway(session Session) bool {
+	select {
+	case <-session.GoneAway():
+		return true
+	default:
+		return false
+	}
+}
+
+// Session carries many tunneled streams over a single link. Either side may
+// open streams, which lets the agent reach back into the victim network over
+// the connection the victim dialed.
+type Session interface {
+	// OpenStream starts a new stream to the peer
+	OpenStream(ctx context.Context) (net.Conn, error)
+
+	// AcceptStream waits for the peer to open a stream
+	AcceptStream(ctx context.Context) (net.Conn, error)
+
+	// Close tears down the session and all of its streams
+	Close() error
+
+	// Done is closed once the session has ended
+	Done() <-chan struct{}
+
+	// GoAway asks the peer to open its next streams elsewhere, such as on a
+	// new session, while the streams already open carry on
+	GoAway() error
+
+	// GoneAway is closed once the peer asked for that. OpenStream fails
+	// from then on.
+	GoneAway() <-chan struct{}
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+
+	// RTT returns the round-trip time measured by heartbeats, 0 until the
+	// first one was answered
+	RTT() time.Duration
+}
+
+// NewSession builds a session on top of an established link. raw is the
+// connection returned by the transport and secured the same connection after
+// the cipher and handshake were applied. QUIC links use native streams of
+// the underlying connection, every other transport multiplexes streams over
+// the secured connection. Both kinds send heartbeats according to hb.
+func NewSession(raw, secured net.Conn, isClient bool, hb HeartbeatConfig) Session {
+	if stream, ok := raw.(*quicStreamConn); ok {
+		return newQUICSession(stream.conn, secured, hb)
+	}
+	return newMuxSession(secured, isClient, hb)
+}
+
+// maxPendingResets bounds the resets a session owes its peer. Past it, new
+// ones are dropped; the peer finds out the stream is gone on its next write.
+const maxPendingResets = 256
+
+// replyQueue holds the answers a session's read loop owes the peer until
+// one writer goroutine sends them. The read loop never blocks on a peer that
+// stops reading, and such a peer can't make the queue grow: pongs coalesce
+// to the latest nonce and resets are capped.
+type replyQueue struct {
+	mu     sync.Mutex
+	pong   bool
+	nonce  uint64
+	resets []uint32
+	ready  chan struct{}
+}
+
+func newReplyQueue() *replyQueue {
+	return &replyQueue{ready: make(chan struct{}, 1)}
+}
+
+// pongLater queues a pong, replacing one still waiting
+func (q *replyQueue) pongLater(nonce uint64) {
+	q.mu.Lock()
+	q.pong, q.nonce = true, nonce
+	q.mu.Unlock()
+	notify(q.ready)
+}
+
+// resetLater queues a reset of stream id, unless too many are waiting
+func (q *replyQueue) resetLater(id uint32) {
+	q.mu.Lock()
+	if len(q.resets) >= maxPendingResets {
+		q.mu.Unlock()
+		return
+	}
+	q.resets = append(q.resets, id)
+	q.mu.Unlock()
+	notify(q.ready)
+}
+
+// run sends queued replies with pong and reset until done is closed or a
+// write fails
+func (q *replyQueue) run(done <-chan struct{}, pong func(nonce uint64) error, reset func(id uint32) error) {
+	for {
+		select {
+		case <-q.ready:
+		case <-done:
+			return
+		}
+
+		q.mu.Lock()
+		sendPong, nonce, resets := q.pong, q.nonce, q.resets
+		q.pong, q.resets = false, nil
+		q.mu.Unlock()
+
+		if sendPong {
+			if err := pong(nonce); err != nil {
+				return
+			}
+		}
+		for _, id := range resets {
+			if err := reset(id); err != nil {
+				return
+			}
+		}
+	}
+}
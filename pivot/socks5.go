@@ -0,0 +1,684 @@
+package pivot
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SOCKS5_VERSION = 0x05
+	SOCKS5_CONNECT = 0x01
+	SOCKS5_IPV4    = 0x01
+	SOCKS5_DOMAIN  = 0x03
+	SOCKS5_IPV6    = 0x04
+
+	SOCKS5_AUTH_NONE     = 0x00
+	SOCKS5_AUTH_PASSWORD = 0x02
+
+	SOCKS5_REPLY_SUCCESS     = 0x00
+	SOCKS5_REPLY_FAILURE     = 0x01
+	SOCKS5_REPLY_NOT_ALLOWED = 0x02
+)
+
+// SOCKS5Server implements a SOCKS5 proxy server
+type SOCKS5Server struct {
+	listener net.Listener
+	timeouts Timeouts
+}
+
+// NewSOCKS5Server creates a new SOCKS5 server
+func NewSOCKS5Server(addr string) (*SOCKS5Server, error) {
+	listener, err := listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SOCKS5Server{listener: listener, timeouts: DefaultTimeouts()}, nil
+}
+
+// Start starts the SOCKS5 server
+func (s *SOCKS5Server) Start() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// Close closes the server
+func (s *SOCKS5Server) Close() error {
+	return s.listener.Close()
+}
+
+func (s *SOCKS5Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(s.timeouts.handshakeDeadline())
+
+	// Step 1: Authentication negotiation
+	if err := s.handleAuth(conn); err != nil {
+		return
+	}
+
+	// Step 2: Handle CONNECT request
+	targetConn, err := s.handleConnect(conn)
+	if err != nil {
+		return
+	}
+	defer targetConn.Close()
+
+	// Step 3: Relay data
+	relayWith(conn, targetConn, relayOptions{idle: s.timeouts.Idle})
+}
+
+func (s *SOCKS5Server) handleAuth(conn net.Conn) error {
+	// Read authentication methods
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+
+	if buf[0] != SOCKS5_VERSION {
+		return fmt.Errorf("unsupported SOCKS version: %d", buf[0])
+	}
+
+	nMethods := buf[1]
+	methods := make([]byte, nMethods)
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	// We support no authentication (0x00)
+	response := []byte{SOCKS5_VERSION, 0x00}
+	_, err := conn.Write(response)
+	return err
+}
+
+func (s *SOCKS5Server) handleConnect(conn net.Conn) (net.Conn, error) {
+	targetAddr, _, err := s.readRequest(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Connect to target
+	targetConn, err := net.DialTimeout("tcp", targetAddr, s.timeouts.Dial)
+	if err != nil {
+		// Send error response
+		s.writeReply(conn, SOCKS5_REPLY_FAILURE)
+		return nil, err
+	}
+
+	// Send success response
+	if err := s.writeReply(conn, SOCKS5_REPLY_SUCCESS); err != nil {
+		targetConn.Close()
+		return nil, err
+	}
+
+	return targetConn, nil
+}
+
+// readRequest reads a CONNECT request and returns the target address along
+// with the request as sent, so it can be passed on to another SOCKS5 server
+func (s *SOCKS5Server) readRequest(conn net.Conn) (string, []byte, error) {
+	// Read CONNECT request
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", nil, err
+	}
+
+	if buf[0] != SOCKS5_VERSION || buf[1] != SOCKS5_CONNECT {
+		return "", nil, fmt.Errorf("unsupported request")
+	}
+
+	// Parse target address, keeping a copy of the bytes read
+	var targetAddr string
+	var err error
+	recorded := &recordingReader{r: conn, buf: buf}
+
+	switch buf[3] {
+	case SOCKS5_IPV4:
+		targetAddr, err = s.parseIPv4Address(recorded)
+	case SOCKS5_DOMAIN:
+		targetAddr, err = s.parseDomainAddress(recorded)
+	case SOCKS5_IPV6:
+		targetAddr, err = s.parseIPv6Address(recorded)
+	default:
+		return "", nil, fmt.Errorf("unsupported address type: %d", buf[3])
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+	return targetAddr, recorded.buf, nil
+}
+
+// writeReply answers a CONNECT request without a bound address
+func (s *SOCKS5Server) writeReply(conn net.Conn, code byte) error {
+	response := []byte{SOCKS5_VERSION, code, 0x00, SOCKS5_IPV4, 0, 0, 0, 0, 0, 0}
+	_, err := conn.Write(response)
+	return err
+}
+
+// rejectSOCKS5 answers a SOCKS5 request with a refusal instead of
+// connecting, so the client sees why rather than a dropped connection
+func rejectSOCKS5(conn net.Conn, code byte) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var s SOCKS5Server
+	if err := s.handleAuth(conn); err != nil {
+		return err
+	}
+	if _, _, err := s.readRequest(conn); err != nil {
+		return err
+	}
+	return s.writeReply(conn, code)
+}
+
+// recordingReader appends everything read through it to buf
+type recordingReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+func (s *SOCKS5Server) parseIPv4Address(conn io.Reader) (string, error) {
+	buf := make([]byte, 6) // 4 bytes IP + 2 bytes port
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	ip := net.IP(buf[:4])
+	port := binary.BigEndian.Uint16(buf[4:6])
+
+	return fmt.Sprintf("%s:%d", ip.String(), port), nil
+}
+
+func (s *SOCKS5Server) parseDomainAddress(conn io.Reader) (string, error) {
+	// Read domain length
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	domainLen := buf[0]
+
+	// Read domain + port
+	buf = make([]byte, int(domainLen)+2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	domain := string(buf[:domainLen])
+	port := binary.BigEndian.Uint16(buf[domainLen:])
+
+	return fmt.Sprintf("%s:%d", domain, port), nil
+}
+
+func (s *SOCKS5Server) parseIPv6Address(conn io.Reader) (string, error) {
+	buf := make([]byte, 18) // 16 bytes IP + 2 bytes port
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+
+	ip := net.IP(buf[:16])
+	port := binary.BigEndian.Uint16(buf[16:18])
+
+	return fmt.Sprintf("[%s]:%d", ip.String(), port), nil
+}
+
+// SOCKS5Client provides client-side SOCKS5 functionality
+type SOCKS5Client struct {
+	proxyAddr string
+	username  string
+	password  string
+}
+
+// NewSOCKS5Client creates a new SOCKS5 client
+func NewSOCKS5Client(proxyAddr string) *SOCKS5Client {
+	return &SOCKS5Client{proxyAddr: proxyAddr}
+}
+
+// SetAuth enables username/password authentication (RFC 1929)
+func (c *SOCKS5Client) SetAuth(username, password string) {
+	c.username = username
+	c.password = password
+}
+
+// Connect connects to a target through the SOCKS5 proxy
+func (c *SOCKS5Client) Connect(targetAddr string) (net.Conn, error) {
+	// Connect to proxy
+	conn, err := net.Dial("tcp", c.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Perform SOCKS5 handshake
+	if err := c.handshake(conn, targetAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *SOCKS5Client) handshake(conn net.Conn, targetAddr string) error {
+	// Step 1: Authentication
+	if err := c.authenticate(conn); err != nil {
+		return err
+	}
+
+	// Step 2: Connect request
+	return c.connectRequest(conn, targetAddr)
+}
+
+func (c *SOCKS5Client) authenticate(conn net.Conn) error {
+	// Send authentication methods (no auth, plus username/password if set)
+	request := []byte{SOCKS5_VERSION, 0x01, SOCKS5_AUTH_NONE}
+	if c.username != "" {
+		request = []byte{SOCKS5_VERSION, 0x02, SOCKS5_AUTH_NONE, SOCKS5_AUTH_PASSWORD}
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Read response
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+
+	if response[0] != SOCKS5_VERSION {
+		return fmt.Errorf("authentication failed")
+	}
+
+	switch response[1] {
+	case SOCKS5_AUTH_NONE:
+		return nil
+	case SOCKS5_AUTH_PASSWORD:
+		if c.username != "" {
+			return c.passwordAuth(conn)
+		}
+	}
+
+	return fmt.Errorf("authentication failed")
+}
+
+// passwordAuth performs the username/password sub-negotiation
+func (c *SOCKS5Client) passwordAuth(conn net.Conn) error {
+	if len(c.username) > 255 || len(c.password) > 255 {
+		return fmt.Errorf("username or password too long")
+	}
+
+	request := []byte{0x01, byte(len(c.username))}
+	request = append(request, c.username...)
+	request = append(request, byte(len(c.password)))
+	request = append(request, c.password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+
+	if response[1] != 0x00 {
+		return fmt.Errorf("username/password authentication failed")
+	}
+
+	return nil
+}
+
+func (c *SOCKS5Client) connectRequest(conn net.Conn, targetAddr string) error {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	// Build connect request
+	request := []byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0x00}
+
+	// Add address
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			// IPv4
+			request = append(request, SOCKS5_IPV4)
+			request = append(request, ip4...)
+		} else {
+			// IPv6
+			request = append(request, SOCKS5_IPV6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		// Domain
+		request = append(request, SOCKS5_DOMAIN)
+		request = append(request, byte(len(host)))
+		request = append(request, []byte(host)...)
+	}
+
+	// Add port
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	request = append(request, portBytes...)
+
+	// Send request
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Read response
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+
+	if response[0] != SOCKS5_VERSION || response[1] != 0x00 {
+		return fmt.Errorf("connect failed, code: %d", response[1])
+	}
+
+	// Read remaining response based on address type
+	switch response[3] {
+	case SOCKS5_IPV4:
+		remaining := make([]byte, 6)
+		_, err = io.ReadFull(conn, remaining)
+	case SOCKS5_DOMAIN:
+		lenBuf := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lenBuf); err != nil {
+			return err
+		}
+		remaining := make([]byte, int(lenBuf[0])+2)
+		_, err = io.ReadFull(conn, remaining)
+	case SOCKS5_IPV6:
+		remaining := make([]byte, 18)
+		_, err = io.ReadFull(conn, remaining)
+	}
+
+	return err
+}
+
+// relay copies data between two connections, conn1 being the client's side
+// and conn2 the target's, and returns how it ended
+func relay(conn1, conn2 net.Conn) relayResult {
+	return relayWith(conn1, conn2, relayOptions{})
+}
+
+// relayOptions shape and time out a relay
+type relayOptions struct {
+	bandwidth *tokenBucket    // shared by both directions, nil for unlimited
+	idle      time.Duration   // close after no data either way for this long, 0 never
+	done      <-chan struct{} // aborts the relay when closed, nil never
+}
+
+// relayResult records the bytes copied from each side, the error that ended
+// copying from each side and why the relay ended as a whole
+type relayResult struct {
+	fromClient, fromTarget int64
+	clientErr, targetErr   error // nil when the side finished cleanly
+	reason                 error
+}
+
+// record notes how copying from one side ended. Errors after the relay
+// closed both connections are only the result of that and are dropped.
+func (r *relayResult) record(fromClient bool, n int64, err error, closed bool) {
+	if closed {
+		err = nil
+	}
+
+	side, reason := "target", errTargetClosed
+	if fromClient {
+		side, reason = "client", errClientClosed
+		r.fromClient, r.clientErr = n, err
+	} else {
+		r.fromTarget, r.targetErr = n, err
+	}
+
+	if r.reason != nil {
+		return
+	}
+	if err != nil {
+		reason = fmt.Errorf("relay from %s: %v", side, err)
+	}
+	r.reason = reason
+}
+
+func (r relayResult) String() string {
+	return fmt.Sprintf("%v, %d bytes from client, %d from target", r.reason, r.fromClient, r.fromTarget)
+}
+
+// resetter is implemented by connections that can abort, so the peer reads
+// an error rather than a clean end of data
+type resetter interface {
+	reset() error
+}
+
+// resetConn aborts and closes conn. Where the transport can't tell an abort
+// from a clean close, it is closed like any other connection.
+func resetConn(conn net.Conn) error {
+	switch c := conn.(type) {
+	case resetter:
+		return c.reset()
+	case *net.TCPConn:
+		c.SetLinger(0)
+	case *tls.Conn:
+		return resetConn(c.NetConn())
+	}
+	return conn.Close()
+}
+
+// closeWriter is implemented by connections that can finish their sending
+// side and keep reading, such as TCP, TLS, QUIC and mux streams
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes conn, reporting false if it can't be half-closed
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(closeWriter)
+	return ok && cw.CloseWrite() == nil
+}
+
+// relayWith copies data between two connections like relay. When one side
+// finishes sending, the other is half-closed and the relay goes on until both
+// directions are done, so a client that half-closes after its request still
+// gets the whole response. Idle timeouts and connections that can't be
+// half-closed close both connections at once. Errors reset both, so an abort
+// reaches the far ends as one rather than looking like the end of the data.
+func relayWith(conn1, conn2 net.Conn, opts relayOptions) relayResult {
+	type copied struct {
+		fromClient bool
+		n          int64
+		err        error
+		halfClosed bool
+	}
+
+	done := make(chan copied, 2)
+	stopped := make(chan struct{}) // closed with both connections
+	activity := &relayActivity{}
+	activity.touch()
+
+	pipe := func(dst, src net.Conn, fromClient bool) {
+		var n int64
+		var err error
+		if opts.bandwidth == nil && opts.idle <= 0 {
+			n, err = copyStream(dst, src)
+		} else {
+			n, err = copyBuffered(dst, shapeReader(activity.wrap(src), opts.bandwidth, stopped))
+		}
+		done <- copied{fromClient, n, err, err == nil && closeWrite(dst)}
+	}
+	go pipe(conn2, conn1, true)
+	go pipe(conn1, conn2, false)
+
+	var result relayResult
+	closed := false
+	closeBoth := func(abort bool) {
+		if closed {
+			return
+		}
+		closed = true
+		close(stopped)
+		if abort {
+			resetConn(conn1)
+			resetConn(conn2)
+		} else {
+			conn1.Close()
+			conn2.Close()
+		}
+	}
+
+	var timer *time.Timer
+	var idle <-chan time.Time
+	if opts.idle > 0 {
+		timer = time.NewTimer(opts.idle)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	for pending := 2; pending > 0; {
+		select {
+		case c := <-done:
+			pending--
+			result.record(c.fromClient, c.n, c.err, closed)
+			if !c.halfClosed {
+				closeBoth(c.err != nil)
+			}
+		case <-idle:
+			if quiet := activity.since(); quiet < opts.idle {
+				timer.Reset(opts.idle - quiet)
+				continue
+			}
+			result.reason = errIdleTimeout
+			closeBoth(false)
+		case <-opts.done:
+			// Both directions may be waiting on the bandwidth bucket
+			// rather than on a connection, so closing them isn't enough
+			opts.done = nil
+			if result.reason == nil {
+				result.reason = errRelayStopped
+			}
+			closeBoth(true)
+		}
+	}
+	return result
+}
+
+// relayBufferSize is the size of the buffers relays copy through
+const relayBufferSize = 32 << 10
+
+// relayBuffers recycles copy buffers across streams
+var relayBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// inPlaceWriter is implemented by connections that can transform the data
+// they are given in place, saving a copy when the caller won't use it again
+type inPlaceWriter interface {
+	writeInPlace(p []byte) (int, error)
+}
+
+// copyStream copies src to dst until EOF. Between two plain TCP sockets the
+// copy is handed to the runtime, which splices in the kernel on Linux where it
+// can, otherwise it goes through a pooled buffer. Only relays that don't
+// touch the data have two plain sockets: the client's direct rules and
+// SOCKS5Server. Tunnel legs are encrypted by RC4Conn or TLS in user space, so
+// relays on the server, on the agent and to a remote always copy through a
+// buffer.
+func copyStream(dst, src net.Conn) (int64, error) {
+	if tcpDst, ok := dst.(*net.TCPConn); ok {
+		if tcpSrc, ok := src.(*net.TCPConn); ok {
+			return tcpDst.ReadFrom(tcpSrc)
+		}
+	}
+	return copyBuffered(dst, src)
+}
+
+// copyBuffered copies src to dst through a pooled buffer. Unlike io.Copy it
+// never hands the copy to dst's ReadFrom, which would allocate a buffer of its
+// own for the wrapped readers the relay uses.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	bufp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bufp)
+	buf := *bufp
+
+	write := dst.Write
+	if w, ok := dst.(inPlaceWriter); ok {
+		write = w.writeInPlace
+	}
+
+	var written int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// relayActivity records when data last went through any of the readers it
+// wraps
+type relayActivity struct {
+	last atomic.Int64
+}
+
+func (a *relayActivity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// since returns how long ago data last went through
+func (a *relayActivity) since() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+func (a *relayActivity) wrap(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if n > 0 {
+			a.touch()
+		}
+		return n, err
+	})
+}
+
+// readerFunc adapts a function to io.Reader
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,258 @@
+package pivot
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	dialed, conn, err := dialPair(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// dialPair connects to listener and returns both ends
+func dialPair(listener net.Listener) (net.Conn, net.Conn, error) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := <-accepted
+	if conn == nil {
+		dialed.Close()
+		return nil, nil, fmt.Errorf("failed to accept")
+	}
+	return dialed, conn, nil
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	local, client := tcpPair(t)
+	remote, target := tcpPair(t)
+
+	// The tunnel side is encrypted, the half-close must get through the cipher
+	encLocal, _ := NewRC4Conn(local, "test-key")
+	encClient, _ := NewRC4Conn(client, "test-key")
+
+	result := make(chan relayResult, 1)
+	go func() { result <- relay(encClient, remote) }()
+
+	// A target that answers only once it has read the whole request
+	go func() {
+		request, _ := io.ReadAll(target)
+		target.Write(append([]byte("reply to "), request...))
+		target.Close()
+	}()
+
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	encLocal.Write([]byte("request"))
+	if err := encLocal.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+
+	reply, err := io.ReadAll(encLocal)
+	if err != nil || string(reply) != "reply to request" {
+		t.Fatalf("Expected the whole reply after half-closing, got %q, %v", reply, err)
+	}
+
+	select {
+	case r := <-result:
+		if r.reason != errClientClosed || r.clientErr != nil || r.targetErr != nil {
+			t.Errorf("Expected a clean close started by the client, got %v", r)
+		}
+		if r.fromClient != 7 || r.fromTarget != 16 {
+			t.Errorf("Expected 7 and 16 bytes relayed, got %v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay didn't end after both sides finished")
+	}
+}
+
+func TestRelayCopyPaths(t *testing.T) {
+	// The client's direct rules relay between a connection from its own
+	// listener and one it dialed itself, as here
+	listener, err := listenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// Plain sockets hand the copy to the runtime, the others go through
+	// the relay's buffers
+	tests := []struct {
+		name string
+		key  string
+		opts relayOptions
+	}{
+		{"direct", "", relayOptions{}},
+		{"idle timeout", "", relayOptions{idle: time.Minute}},
+		{"tunnel", "test-key", relayOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, client, err := dialPair(listener)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote, target := tcpPair(t)
+			if tt.key != "" {
+				local, _ = NewRC4Conn(local, tt.key)
+				client, _ = NewRC4Conn(client, tt.key)
+			}
+
+			result := make(chan relayResult, 1)
+			go func() { result <- relayWith(client, remote, tt.opts) }()
+			go func() {
+				target.Write([]byte("reply"))
+				target.Close()
+			}()
+
+			local.SetDeadline(time.Now().Add(5 * time.Second))
+			if reply, _ := io.ReadAll(local); string(reply) != "reply" {
+				t.Errorf("Expected the reply, got %q", reply)
+			}
+			local.Close()
+			if r := <-result; r.clientErr != nil || r.targetErr != nil || r.fromTarget != 5 {
+				t.Errorf("Expected a clean relay of the reply, got %v", r)
+			}
+		})
+	}
+}
+
+func TestRelayClosesWithoutHalfClose(t *testing.T) {
+	// Pipes can't be half-closed, so the end of one direction ends both
+	local, client := tcpPair(t)
+	remote, target := net.Pipe()
+	defer target.Close()
+
+	result := make(chan relayResult, 1)
+	go func() { result <- relay(client, remote) }()
+
+	local.(*net.TCPConn).CloseWrite()
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the client to be closed, got %v", err)
+	}
+
+	select {
+	case r := <-result:
+		if r.reason != errClientClosed {
+			t.Errorf("Expected %v, got %v", errClientClosed, r.reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay leaked the direction still waiting on the target")
+	}
+}
+
+func TestRelayPassesResets(t *testing.T) {
+	local, client := tcpPair(t)
+	remote, target := tcpPair(t)
+
+	result := make(chan relayResult, 1)
+	go func() { result <- relay(client, remote) }()
+
+	// A target that aborts must not look to the client like a finished reply
+	target.(*net.TCPConn).SetLinger(0)
+	target.Close()
+
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := local.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Expected the client to see the reset, got %v", err)
+	}
+	if r := <-result; r.targetErr == nil {
+		t.Errorf("Expected an error from the target, got %v", r)
+	}
+}
+
+// benchmarkRelay relays one stream of 1 MiB from target to client per
+// iteration, so allocations are reported per stream
+func benchmarkRelay(b *testing.B, key string, opts relayOptions) {
+	const size = 1 << 20
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	payload := make([]byte, size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		local, client, err := dialPair(listener)
+		if err != nil {
+			b.Fatal(err)
+		}
+		remote, target, err := dialPair(listener)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if key != "" {
+			local, _ = NewRC4Conn(local, key)
+			client, _ = NewRC4Conn(client, key)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			relayWith(client, remote, opts)
+			close(done)
+		}()
+		go func() {
+			target.Write(payload)
+			target.Close()
+		}()
+
+		n, _ := io.Copy(io.Discard, local)
+		if n != size {
+			b.Fatalf("Expected %d bytes, got %d", size, n)
+		}
+		local.Close()
+		<-done
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	// Plain sockets on both sides hand the copy to the runtime
+	b.Run("tcp", func(b *testing.B) { benchmarkRelay(b, "", relayOptions{}) })
+	// An idle timeout needs to see the data, so it goes through buffers
+	b.Run("tcp-buffered", func(b *testing.B) { benchmarkRelay(b, "", relayOptions{idle: time.Minute}) })
+	b.Run("rc4", func(b *testing.B) { benchmarkRelay(b, "bench-key", relayOptions{}) })
+}
+
+func BenchmarkRC4ConnWrite(b *testing.B) {
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	defer client.Close()
+
+	conn, _ := NewRC4Conn(client, "bench-key")
+	buf := make([]byte, relayBufferSize)
+	b.SetBytes(relayBufferSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn.Write(buf)
+	}
+}
@@ -0,0 +1,128 @@
+package pivot
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var errStdioClosed = errors.New("stdio tunnel closed")
+
+// pipeAddr names the endpoints of a pipe connection
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn carries the tunnel over a pair of pipes, such as the process's own
+// stdin and stdout or those of a child process. Pipes have no deadlines, so
+// the deadline methods are no-ops.
+type pipeConn struct {
+	r       io.ReadCloser
+	w       io.WriteCloser
+	remote  string
+	onClose func() error
+	once    sync.Once
+}
+
+// newStdioConn returns a connection over the process's stdin and stdout
+func newStdioConn() net.Conn {
+	return &pipeConn{r: os.Stdin, w: os.Stdout, remote: "stdio"}
+}
+
+// execConn runs command through the shell and returns a connection over its
+// stdin and stdout. The command's stderr is passed through.
+func execConn(command string) (net.Conn, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &pipeConn{
+		r:      stdout,
+		w:      stdin,
+		remote: "exec:" + command,
+		onClose: func() error {
+			cmd.Process.Kill()
+			return cmd.Wait()
+		},
+	}, nil
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// CloseWrite closes the writing pipe, which the other end reads as EOF
+func (c *pipeConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+// Close closes both pipes and stops the child process, if any
+func (c *pipeConn) Close() error {
+	c.once.Do(func() {
+		c.w.Close()
+		c.r.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr("stdio")
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.remote)
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// StdioLink returns a link function handing out the process's stdio once.
+// Stdio can't be reopened, so later calls fail with errStdioClosed.
+func StdioLink() func() (net.Conn, error) {
+	var used sync.Once
+	return func() (net.Conn, error) {
+		var conn net.Conn
+		used.Do(func() { conn = newStdioConn() })
+		if conn == nil {
+			return nil, errStdioClosed
+		}
+		return conn, nil
+	}
+}
+
+// ExecLink returns a link function that starts command for every session
+func ExecLink(command string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return execConn(command)
+	}
+}
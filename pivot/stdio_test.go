@@ -0,0 +1,76 @@
+package pivot
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConnPair returns two pipeConns connected back to back, like a client
+// and a server -stdio started by it
+func pipeConnPair() (net.Conn, net.Conn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &pipeConn{r: r1, w: w2, remote: "server"}, &pipeConn{r: r2, w: w1, remote: "client"}
+}
+
+func TestStdioTunnel(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, target)
+
+	clientEnd, serverEnd := pipeConnPair()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newServer("test-key", "")
+	served := make(chan error, 1)
+	go func() {
+		served <- server.serveLink(newTestRun(t, ctx), serverEnd)
+	}()
+
+	client := newClient("test-key", "", "")
+	links := 0
+	client.link = func() (net.Conn, error) {
+		links++
+		return clientEnd, nil
+	}
+
+	// Several SOCKS5 connections share the one link
+	for i := 0; i < 3; i++ {
+		stream, err := client.openStream(ctx)
+		if err != nil {
+			t.Fatalf("openStream failed: %v", err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if err := NewSOCKS5Client("").handshake(stream, target.Addr().String()); err != nil {
+			t.Fatalf("SOCKS5 handshake failed: %v", err)
+		}
+		stream.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "ping" {
+			t.Fatalf("Expected echoed ping, got %q: %v", reply, err)
+		}
+		stream.Close()
+	}
+	if links != 1 {
+		t.Errorf("Expected a single link, got %d", links)
+	}
+
+	// Closing the pipe ends the server
+	clientEnd.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serveLink failed: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Server didn't stop after the link closed")
+	}
+}
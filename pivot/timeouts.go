@@ -0,0 +1,57 @@
+package pivot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Default timeouts for the streams of every mode
+const (
+	defaultDialTimeout = 10 * time.Second
+	defaultIdleTimeout = 0 // streams may stay idle for as long as they like
+)
+
+// Reasons a relay ended, recorded when a stream is closed
+var (
+	errIdleTimeout  = errors.New("idle timeout")
+	errClientClosed = errors.New("closed by client")
+	errTargetClosed = errors.New("closed by target")
+	errRelayStopped = errors.New("relay stopped")
+)
+
+// Timeouts bound each phase of a stream's life, so a peer that connects and
+// goes quiet can't hold a goroutine forever
+type Timeouts struct {
+	Handshake time.Duration // SOCKS5 negotiation and route preamble
+	Dial      time.Duration // connecting to the target or the remote server
+	Idle      time.Duration // no data in either direction, 0 disables it
+}
+
+// DefaultTimeouts returns the default timeouts
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Handshake: handshakeTimeout,
+		Dial:      defaultDialTimeout,
+		Idle:      defaultIdleTimeout,
+	}
+}
+
+// Validate checks the settings
+func (t Timeouts) Validate() error {
+	if t.Handshake <= 0 {
+		return fmt.Errorf("handshake timeout must be positive")
+	}
+	if t.Dial <= 0 {
+		return fmt.Errorf("dial timeout must be positive")
+	}
+	if t.Idle < 0 {
+		return fmt.Errorf("idle timeout can't be negative")
+	}
+	return nil
+}
+
+// handshakeDeadline returns when a handshake starting now must be done
+func (t Timeouts) handshakeDeadline() time.Time {
+	return time.Now().Add(t.Handshake)
+}
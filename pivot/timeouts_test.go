@@ -0,0 +1,86 @@
+package pivot
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayCloseReason(t *testing.T) {
+	local, client := net.Pipe()
+	remote, target := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	result := make(chan relayResult, 1)
+	go func() { result <- relay(client, remote) }()
+
+	target.Close()
+	select {
+	case r := <-result:
+		if err := r.reason; err != errTargetClosed {
+			t.Errorf("Expected %v, got %v", errTargetClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay didn't end when the target closed")
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	local, client := net.Pipe()
+	remote, target := net.Pipe()
+	defer local.Close()
+	defer target.Close()
+
+	result := make(chan relayResult, 1)
+	start := time.Now()
+	go func() { result <- relayWith(client, remote, relayOptions{idle: 100 * time.Millisecond}) }()
+
+	// Traffic in one direction keeps the relay alive
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := local.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		target.Write([]byte("x"))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case r := <-result:
+		if err := r.reason; err != errIdleTimeout {
+			t.Errorf("Expected %v, got %v", errIdleTimeout, err)
+		}
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+			t.Errorf("Relay timed out after %v despite traffic", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle relay was never closed")
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	server := newServer("test-key", "")
+	server.timeouts.Handshake = 50 * time.Millisecond
+
+	// A peer that connects and never sends anything
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		server.handleTunnel(context.Background(), conn, 1, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Silent stream was never given up on")
+	}
+}
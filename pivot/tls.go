@@ -0,0 +1,275 @@
+package pivot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTLSCertFile = "pivot-tls.crt"
+	DefaultTLSKeyFile  = "pivot-tls.key"
+
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+// tlsNextProtos makes the tunnel negotiate like an ordinary HTTPS connection
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// TLSOptions configures tls:// endpoints
+type TLSOptions struct {
+	CertFile     string // certificate presented by this side, created self-signed when missing
+	KeyFile      string // private key for CertFile
+	Pin          string // expected SPKI fingerprint of the server certificate
+	CAFile       string // CA bundle used to verify the server when no pin is set
+	ClientCAFile string // certificates or CAs allowed to connect, enables mTLS
+	ServerName   string // SNI sent to the server, defaults to the dialed host
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// serverConfig builds the TLS configuration for listeners
+func (o *TLSOptions) serverConfig() (*tls.Config, error) {
+	certFile, keyFile := o.CertFile, o.KeyFile
+	if certFile == "" {
+		certFile = DefaultTLSCertFile
+	}
+	if keyFile == "" {
+		keyFile = DefaultTLSKeyFile
+	}
+
+	cert, err := o.certificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   tlsNextProtos,
+	}
+
+	if o.ClientCAFile != "" {
+		pool, err := loadCertPool(o.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// clientConfig builds the TLS configuration for dialing addr
+func (o *TLSOptions) clientConfig(addr string) (*tls.Config, error) {
+	serverName := o.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: serverName,
+		NextProtos: tlsNextProtos,
+	}
+
+	switch {
+	case o.Pin != "":
+		// The pin replaces chain verification so self-signed certificates work
+		pin := o.Pin
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			got := CertificatePin(cs.PeerCertificates[0])
+			if got != pin {
+				return fmt.Errorf("server certificate %s does not match pinned %s", got, pin)
+			}
+			return nil
+		}
+	case o.CAFile != "":
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	// Present a client certificate for mTLS when one is configured
+	if o.CertFile != "" {
+		cert, err := o.certificate(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+
+	return config, nil
+}
+
+// certificate loads the key pair once, generating it on first run
+func (o *TLSOptions) certificate(certFile, keyFile string) (*tls.Certificate, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.cert != nil {
+		return o.cert, nil
+	}
+
+	if keyFile == "" {
+		return nil, errors.New("TLS key file is required with a certificate")
+	}
+
+	cert, err := loadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using TLS certificate %s (pin %s)", certFile, CertificatePin(leaf))
+
+	o.cert = &cert
+	return o.cert, nil
+}
+
+// CertificatePin returns the SHA256 fingerprint of a certificate's public key
+func CertificatePin(cert *x509.Certificate) string {
+	return fingerprint(cert.RawSubjectPublicKeyInfo)
+}
+
+// ParseCertificatePin normalizes a -tls-pin value, which may be a SPKI
+// fingerprint or the path of a PEM certificate
+func ParseCertificatePin(value string) (string, error) {
+	if value == "" || strings.HasPrefix(value, "SHA256:") {
+		return value, nil
+	}
+
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return "", fmt.Errorf("TLS pin is neither a fingerprint nor a readable certificate: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no PEM certificate found in %s", value)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return CertificatePin(cert), nil
+}
+
+// loadOrCreateCertificate loads a PEM key pair, writing a new self-signed
+// certificate when neither file exists yet
+func loadOrCreateCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := generateSelfSigned(certFile, keyFile); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to generate TLS certificate: %v", err)
+		}
+		log.Printf("Generated self-signed TLS certificate %s", certFile)
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// generateSelfSigned writes a self-signed ECDSA certificate usable for both
+// server and client authentication
+func generateSelfSigned(certFile, keyFile string) error {
+	certPEM, keyPEM, err := newSelfSigned()
+	if err != nil {
+		return err
+	}
+
+	if err := WriteKeyFile(keyFile, keyPEM, 0o600, false); err != nil {
+		return err
+	}
+	return WriteKeyFile(certFile, certPEM, 0o644, false)
+}
+
+// newSelfSigned creates a self-signed ECDSA certificate and returns it and
+// its private key in PEM form
+func newSelfSigned() (certPEM, keyPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	dnsNames := []string{"localhost"}
+	if hostname != "" && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[len(dnsNames)-1]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// loadCertPool reads a PEM bundle of CA or self-signed certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
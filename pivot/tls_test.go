@@ -0,0 +1,108 @@
+package pivot
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTLSEcho listens on a tls:// endpoint and echoes everything it reads
+func startTLSEcho(t *testing.T, opts *TLSOptions) string {
+	t.Helper()
+	transport := &Transport{TLS: opts}
+	listener, err := transport.Listen("tls://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, listener)
+
+	return "tls://" + listener.Addr().String()
+}
+
+func dialTLSEcho(t *testing.T, addr string, opts *TLSOptions) error {
+	t.Helper()
+	return dialTLSEchoWith(t, &Transport{TLS: opts}, addr)
+}
+
+// dialTLSEchoWith round trips a message through an echo server with transport
+func dialTLSEchoWith(t *testing.T, transport *Transport, addr string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := transport.Dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Handshake errors on the server side surface on the first read
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	return err
+}
+
+func TestTLSTransportPinning(t *testing.T) {
+	dir := t.TempDir()
+	serverOpts := &TLSOptions{
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+	}
+	addr := startTLSEcho(t, serverOpts)
+
+	// The certificate is generated on first listen
+	pin, err := ParseCertificatePin(serverOpts.CertFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated certificate: %v", err)
+	}
+
+	if err := dialTLSEcho(t, addr, &TLSOptions{Pin: pin}); err != nil {
+		t.Errorf("Dial with correct pin failed: %v", err)
+	}
+
+	if err := dialTLSEcho(t, addr, &TLSOptions{Pin: "SHA256:AAAA"}); err == nil {
+		t.Error("Expected dial with wrong pin to fail")
+	}
+
+	// Without a pin or CA the self-signed certificate is not trusted
+	if err := dialTLSEcho(t, addr, &TLSOptions{}); err == nil {
+		t.Error("Expected dial without pin to reject self-signed certificate")
+	}
+}
+
+func TestTLSTransportMutualAuth(t *testing.T) {
+	dir := t.TempDir()
+	clientOpts := &TLSOptions{
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	if _, err := clientOpts.certificate(clientOpts.CertFile, clientOpts.KeyFile); err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+
+	serverOpts := &TLSOptions{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: clientOpts.CertFile,
+	}
+	addr := startTLSEcho(t, serverOpts)
+
+	pin, err := ParseCertificatePin(serverOpts.CertFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated certificate: %v", err)
+	}
+	clientOpts.Pin = pin
+
+	if err := dialTLSEcho(t, addr, clientOpts); err != nil {
+		t.Errorf("Dial with client certificate failed: %v", err)
+	}
+
+	if err := dialTLSEcho(t, addr, &TLSOptions{Pin: pin}); err == nil {
+		t.Error("Expected dial without client certificate to fail")
+	}
+}
@@ -0,0 +1,246 @@
+package pivot
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Transport schemes accepted in endpoint addresses
+const (
+	SchemeTCP  = "tcp"
+	SchemeTLS  = "tls"
+	SchemeWS   = "ws"
+	SchemeWSS  = "wss"
+	SchemeQUIC = "quic"
+)
+
+// Endpoint is a tunnel address with an optional transport scheme, such as
+// "tls://10.0.0.1:443" or "wss://cdn.example.com/updates". Addresses without
+// a scheme use plain TCP.
+type Endpoint struct {
+	Scheme string
+	Addr   string
+	Path   string // HTTP path for WebSocket endpoints
+}
+
+// ParseEndpoint parses a tunnel address
+func ParseEndpoint(s string) (Endpoint, error) {
+	scheme, addr, ok := strings.Cut(s, "://")
+	if !ok {
+		return Endpoint{Scheme: SchemeTCP, Addr: s}, nil
+	}
+
+	ep := Endpoint{Scheme: scheme, Addr: addr}
+	switch scheme {
+	case SchemeTCP, SchemeTLS, SchemeQUIC:
+	case SchemeWS, SchemeWSS:
+		ep.Path = "/"
+		if i := strings.Index(addr, "/"); i >= 0 {
+			ep.Addr, ep.Path = addr[:i], addr[i:]
+		}
+		if _, _, err := net.SplitHostPort(ep.Addr); err != nil && ep.Addr != "" {
+			port := "80"
+			if scheme == SchemeWSS {
+				port = "443"
+			}
+			ep.Addr = net.JoinHostPort(ep.Addr, port)
+		}
+	default:
+		return Endpoint{}, fmt.Errorf("unsupported transport scheme: %s", scheme)
+	}
+
+	if ep.Addr == "" {
+		return Endpoint{}, fmt.Errorf("missing address in %s", s)
+	}
+	return ep, nil
+}
+
+// String returns the endpoint in scheme://addr form
+func (e Endpoint) String() string {
+	return e.Scheme + "://" + e.Addr + e.Path
+}
+
+// Encrypted reports whether the transport itself protects the tunnel
+func (e Endpoint) Encrypted() bool {
+	return e.Scheme == SchemeTLS || e.Scheme == SchemeWSS || e.Scheme == SchemeQUIC
+}
+
+// Transport opens and accepts tunnel connections for every supported scheme
+type Transport struct {
+	TLS   *TLSOptions
+	Proxy *url.URL // optional upstream proxy for outbound connections
+
+	quic quicDialer
+}
+
+// NewTransport creates a transport with default settings
+func NewTransport() *Transport {
+	return &Transport{TLS: &TLSOptions{}}
+}
+
+// Listen starts a listener for the given tunnel address. On QUIC endpoints
+// every stream of every connection is accepted as a separate net.Conn.
+func (t *Transport) Listen(addr string) (net.Listener, error) {
+	return t.listen(addr, false)
+}
+
+// ListenSession starts a listener for links that carry a Session. On QUIC
+// endpoints only the control stream of each connection is returned and the
+// remaining streams belong to the session, other schemes behave like Listen.
+func (t *Transport) ListenSession(addr string) (net.Listener, error) {
+	return t.listen(addr, true)
+}
+
+func (t *Transport) listen(addr string, sessions bool) (net.Listener, error) {
+	ep, err := ParseEndpoint(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var listener net.Listener
+	switch ep.Scheme {
+	case SchemeQUIC:
+		config, err := t.TLS.serverConfig()
+		if err != nil {
+			return nil, err
+		}
+		return listenQUIC(ep.Addr, config, sessions)
+	case SchemeTLS, SchemeWSS:
+		config, err := t.TLS.serverConfig()
+		if err != nil {
+			return nil, err
+		}
+		if ep.Scheme == SchemeWSS {
+			config.NextProtos = wsNextProtos
+		}
+		listener, err = listenTCP(ep.Addr)
+		if err != nil {
+			return nil, err
+		}
+		listener = tls.NewListener(listener, config)
+	default:
+		listener, err = listenTCP(ep.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ep.Scheme == SchemeWS || ep.Scheme == SchemeWSS {
+		return listenWebSocket(listener, ep.Path), nil
+	}
+	return listener, nil
+}
+
+// Dial connects to the given tunnel address. QUIC dials share one
+// connection per address and open a new stream on it each time.
+func (t *Transport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return t.dial(ctx, addr, false)
+}
+
+// DialSession connects a link that will carry a Session. On QUIC endpoints
+// it establishes a dedicated connection and returns its control stream,
+// other schemes behave like Dial.
+func (t *Transport) DialSession(ctx context.Context, addr string) (net.Conn, error) {
+	return t.dial(ctx, addr, true)
+}
+
+func (t *Transport) dial(ctx context.Context, addr string, session bool) (net.Conn, error) {
+	ep, err := ParseEndpoint(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ep.Scheme == SchemeQUIC {
+		if t.Proxy != nil {
+			return nil, fmt.Errorf("upstream proxies are not supported for %s", SchemeQUIC)
+		}
+		config, err := t.TLS.clientConfig(ep.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if session {
+			return dialQUICSession(ctx, ep.Addr, config)
+		}
+		return t.quic.dialStream(ctx, ep.Addr, config)
+	}
+
+	conn, err := t.dialTCP(ctx, ep.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ep.Scheme == SchemeTLS || ep.Scheme == SchemeWSS {
+		config, err := t.TLS.clientConfig(ep.Addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if ep.Scheme == SchemeWSS {
+			config.NextProtos = wsNextProtos
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if ep.Scheme == SchemeWS || ep.Scheme == SchemeWSS {
+		wsConn, err := dialWebSocket(conn, ep.Addr, ep.Path)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = wsConn
+	}
+
+	return conn, nil
+}
+
+// dialTCP opens the raw TCP connection, through the upstream proxy if set
+func (t *Transport) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if t.Proxy != nil {
+		return dialProxy(ctx, t.Proxy, addr)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// checkLinkCipher validates the cipher for stdio and -exec links. Pipes may
+// carry anything, so the "none" cipher is never allowed on them.
+func checkLinkCipher(cipher string) error {
+	if cipher == CipherNone {
+		return fmt.Errorf("cipher %s requires an encrypted transport, but stdio pipes are plain", cipher)
+	}
+	return CheckCipher(cipher)
+}
+
+// CheckCipher rejects the "none" cipher unless every address uses an
+// encrypted transport
+func CheckCipher(cipher string, addrs ...string) error {
+	switch cipher {
+	case CipherRC4:
+		return nil
+	case CipherNone:
+	default:
+		return fmt.Errorf("unknown cipher: %s", cipher)
+	}
+
+	for _, addr := range addrs {
+		ep, err := ParseEndpoint(addr)
+		if err != nil {
+			return err
+		}
+		if !ep.Encrypted() {
+			return fmt.Errorf("cipher %s requires an encrypted transport, but %s is plain %s", cipher, addr, ep.Scheme)
+		}
+	}
+	return nil
+}
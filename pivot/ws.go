@@ -0,0 +1,406 @@
+package pivot
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	// wsMaxControlPayload is the largest payload allowed in a control frame
+	wsMaxControlPayload = 125
+
+	wsHandshakeTimeout = 10 * time.Second
+)
+
+// wsNextProtos keeps wss:// on HTTP/1.1, which is required for the upgrade
+var wsNextProtos = []string{"http/1.1"}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value for a client key
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsListener accepts WebSocket upgrades on an HTTP server and returns each
+// upgraded connection as a net.Conn. Other requests get a plain 404.
+type wsListener struct {
+	listener net.Listener
+	server   *http.Server
+	path     string
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// listenWebSocket serves WebSocket upgrades for path on listener
+func listenWebSocket(listener net.Listener, path string) *wsListener {
+	l := &wsListener{
+		listener: listener,
+		path:     path,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	l.server = &http.Server{
+		Handler:           http.HandlerFunc(l.handleUpgrade),
+		ReadHeaderTimeout: wsHandshakeTimeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+
+	go func() {
+		if err := l.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("WebSocket listener on %s stopped: %v", listener.Addr(), err)
+		}
+		l.Close()
+	}()
+
+	return l
+}
+
+func (l *wsListener) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path || r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws := newWSConn(wrapBuffered(conn, rw.Reader), false)
+	select {
+	case l.conns <- ws:
+	case <-l.closed:
+		ws.Close()
+	}
+}
+
+// Accept waits for the next upgraded connection
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the HTTP server
+func (l *wsListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.server.Close()
+	})
+	return nil
+}
+
+// Addr returns the listener's network address
+func (l *wsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// dialWebSocket performs the client upgrade handshake over conn
+func dialWebSocket(conn net.Conn, host, path string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("websocket upgrade failed: invalid accept key")
+	}
+
+	return newWSConn(wrapBuffered(conn, br), true), nil
+}
+
+// headerContains reports whether a comma separated header has the token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn carries a byte stream in WebSocket binary frames
+type wsConn struct {
+	net.Conn
+	client bool // clients mask every frame they send
+
+	readMu    sync.Mutex
+	remaining uint64 // unread payload bytes of the current frame
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	eof       bool
+
+	writeMu sync.Mutex
+}
+
+func newWSConn(conn net.Conn, client bool) *wsConn {
+	return &wsConn{Conn: conn, client: client}
+}
+
+// Read returns payload bytes from data frames, answering pings on the way
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.Conn.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with payload is found
+func (c *wsConn) nextFrame() error {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, ext); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.Conn, ext); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if masked == c.client {
+		return errors.New("websocket: unexpected frame masking")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.Conn, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpBinary, wsOpText, wsOpContinuation:
+		c.remaining = length
+		c.mask = mask
+		c.masked = masked
+		c.maskPos = 0
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlPayload {
+			return errors.New("websocket: control frame too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.Conn, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i&3]
+			}
+		}
+
+		switch opcode {
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.eof = true
+			c.writeFrame(wsOpClose, nil)
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", opcode)
+	}
+}
+
+// Write sends p as a single binary frame
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	start := len(frame)
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start = len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame before closing the underlying connection
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
+
+// reset aborts the underlying connection without a close frame
+func (c *wsConn) reset() error {
+	return resetConn(c.Conn)
+}
+
+// bufferedConn replays bytes that were read ahead while parsing HTTP
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// wrapBuffered returns conn, preserving any data already buffered in r
+func wrapBuffered(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r == nil || r.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	if b.r.Buffered() > 0 {
+		return b.r.Read(p)
+	}
+	return b.Conn.Read(p)
+}
+
+// reset aborts the underlying connection
+func (b *bufferedConn) reset() error {
+	return resetConn(b.Conn)
+}
+
+// CloseWrite half-closes the underlying connection if it supports that
+func (b *bufferedConn) CloseWrite() error {
+	if cw, ok := b.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,73 @@
+package pivot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startEcho accepts connections from listener and echoes everything it reads
+func startEcho(t *testing.T, listener net.Listener) {
+	t.Helper()
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	transport := NewTransport()
+	listener, err := transport.Listen("ws://127.0.0.1:0/tunnel")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	startEcho(t, listener)
+	addr := "ws://" + listener.Addr().String() + "/tunnel"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := transport.Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Large enough to need the 64-bit frame length
+	payload := make([]byte, 100*1024)
+	rand.Read(payload)
+	go conn.Write(payload)
+
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Error("Echoed payload doesn't match")
+	}
+
+	// Plain HTTP requests get an ordinary 404
+	resp, err := http.Get("http://" + listener.Addr().String() + "/tunnel")
+	if err != nil {
+		t.Fatalf("HTTP request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for non-upgrade request, got: %d", resp.StatusCode)
+	}
+}
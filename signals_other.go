@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Draining, upgrading and reloading on a signal aren't available on this
+// platform
+var (
+	drainSignal   os.Signal
+	upgradeSignal os.Signal
+	reloadSignal  os.Signal
+)
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals asking a running role to drain, to hand its listeners to a new
+// process before draining, and to reload its configuration
+var (
+	drainSignal   os.Signal = syscall.SIGUSR1
+	upgradeSignal os.Signal = syscall.SIGUSR2
+	reloadSignal  os.Signal = syscall.SIGHUP
+)